@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sort"
+	"time"
+	"wired/master/protocol/packets"
+	"wired/modules/env"
+	"wired/modules/event"
+	event_data "wired/modules/event/events"
+	"wired/modules/logger"
+	"wired/modules/protocol"
+	"wired/modules/utils"
+)
+
+/*
+	Certificate issuer election
+
+	Only one node orders certificates and hands them to the others, so names
+	aren't ordered once per node. The master picks SSL_ISSUER_NODE while it is
+	connected, the first connected node by key otherwise, and announces it
+	periodically so nodes connecting later learn it too.
+*/
+
+const issuerAnnounceInterval = 30 * time.Second
+
+var SSLEventBus = event.NewEventBus("ssl")
+
+func startIssuerElection() {
+	ticker := time.NewTicker(issuerAnnounceInterval)
+	defer ticker.Stop()
+
+	issuer := ""
+	for range ticker.C {
+		elected := electIssuer()
+		if elected != issuer {
+			logger.Printf("Elected %s as certificate issuer\n", elected)
+			issuer = elected
+			packets.SetCertificateIssuer(elected)
+		}
+
+		SSLEventBus.Pub(event.Event{
+			Type:    event.Event_CertificateIssuer,
+			FiredAt: time.Now(),
+			FiredBy: env.GetEnv("NODE_KEY", "master"),
+			Data:    event_data.CertificateIssuerData{Node: elected},
+		})
+	}
+}
+
+func electIssuer() string {
+	utils.NodesMux.RLock()
+	defer utils.NodesMux.RUnlock()
+
+	var ready []string
+	for key, node := range utils.Nodes {
+		if node.Conn != nil && node.Conn.State == protocol.StateFullyReady {
+			ready = append(ready, key)
+		}
+	}
+
+	if len(ready) == 0 {
+		return ""
+	}
+
+	preferred := env.GetEnv("SSL_ISSUER_NODE", "")
+	sort.Strings(ready)
+	for _, key := range ready {
+		if key == preferred {
+			return key
+		}
+	}
+
+	return ready[0]
+}
@@ -25,6 +25,7 @@ func main() {
 	logger.Printf(logger.Banner)
 
 	pgp.InitKeys()
+	go startIssuerElection()
 	initNodeListener()
 }
 
@@ -63,11 +64,17 @@ func nodeHandler(conn *protocol.Conn) {
 		}
 
 		conn.Close()
+		protocol.DropBinaryTransfers(conn)
 
 		if conn.Key != "" {
 			logger.Printf("Node %s%s%s disconnected\n", logger.ColorGray, conn.Key, logger.ColorReset)
 
 			utils.NodesMux.Lock()
+			// a reconnected node already replaced this connection
+			if utils.Nodes[conn.Key].Conn == conn {
+				delete(utils.Nodes, conn.Key)
+			}
+
 			for _, node := range utils.Nodes {
 				node.Conn.SendPacket(globals.Packet.ID_NodeDetached, types.NodeInfo{
 					Key: conn.Key,
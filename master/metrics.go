@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+	"wired/modules/event"
+	event_data "wired/modules/event/events"
+	"wired/modules/logger"
+)
+
+var (
+	// NodeDNSMetrics holds the latest DNS counters reported by every node
+	NodeDNSMetrics   = make(map[string]event_data.DNSMetricsData)
+	NodeDNSMetricsMu sync.RWMutex
+)
+
+func init() {
+	metricsChan := make(chan event.Event)
+	event.NewEventBus("dns").Sub(event.Event_DNSMetrics, metricsChan, func() { dnsMetricsHandler(metricsChan) })
+}
+
+func dnsMetricsHandler(eventChan <-chan event.Event) {
+	for e := range eventChan {
+		data, ok := event.DecodeData[event_data.DNSMetricsData](e)
+		if !ok {
+			logger.Println("Invalid event data for DNSMetrics")
+			continue
+		}
+
+		NodeDNSMetricsMu.Lock()
+		previous := NodeDNSMetrics[data.Node]
+		NodeDNSMetrics[data.Node] = data
+		NodeDNSMetricsMu.Unlock()
+
+		// counters are cumulative and restart with the node
+		if data.Dropped < previous.Dropped || data.Slipped < previous.Slipped || data.Capped < previous.Capped {
+			previous = event_data.DNSMetricsData{}
+		}
+
+		dropped, slipped, capped := data.Dropped-previous.Dropped, data.Slipped-previous.Slipped, data.Capped-previous.Capped
+		if dropped > 0 || slipped > 0 || capped > 0 {
+			logger.Printf("Node %s limited DNS responses: %d dropped, %d slipped, %d over zone caps\n", data.Node, dropped, slipped, capped)
+		}
+	}
+}
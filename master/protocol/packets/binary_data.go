@@ -0,0 +1,32 @@
+package packets
+
+import (
+	"wired/modules/certstore"
+	"wired/modules/logger"
+	"wired/modules/protocol"
+)
+
+type BinaryDataHandler struct{}
+
+func (h *BinaryDataHandler) Handle(conn *protocol.Conn, p *protocol.Packet) {
+	if err := protocol.ReceiveBinaryChunk(conn, p); err != nil {
+		logger.Printf("Failed to receive binary data from %s: %v\n", conn.Key, err)
+	}
+}
+
+type BinaryDataEndHandler struct{}
+
+func (h *BinaryDataEndHandler) Handle(conn *protocol.Conn, p *protocol.Packet) {
+	kind, payload, err := protocol.FinishBinary(conn, p)
+	if err != nil {
+		logger.Printf("Failed to receive binary data from %s: %v\n", conn.Key, err)
+		return
+	}
+
+	switch kind {
+	case certstore.BundleKind:
+		receiveBundle(conn, payload)
+	default:
+		logger.Printf("Unknown binary data kind %q from %s\n", kind, conn.Key)
+	}
+}
@@ -0,0 +1,131 @@
+package packets
+
+import (
+	"sync"
+	"wired/modules/certstore"
+	"wired/modules/logger"
+	packet "wired/modules/packets"
+	"wired/modules/protocol"
+	"wired/modules/utils"
+)
+
+/*
+	The master is the certificate authority of record: the issuer node uploads
+	new and renewed bundles, the master keeps the newest version of each in
+	certs/ and pushes it to the other nodes. Nodes ask for the bundles they
+	miss when they connect and when they serve a name without a certificate.
+	Only bundles uploaded by the elected issuer are accepted.
+*/
+
+const certificateDir = "certs"
+
+var (
+	issuer   string // node elected to order certificates
+	issuerMu sync.RWMutex
+)
+
+// SetCertificateIssuer sets the node whose bundle uploads are accepted
+func SetCertificateIssuer(node string) {
+	issuerMu.Lock()
+	issuer = node
+	issuerMu.Unlock()
+}
+
+func isCertificateIssuer(node string) bool {
+	issuerMu.RLock()
+	defer issuerMu.RUnlock()
+
+	return issuer != "" && issuer == node
+}
+
+type CertificateRequestHandler struct{}
+
+func (h *CertificateRequestHandler) Handle(conn *protocol.Conn, p *protocol.Packet) {
+	var request packet.CertificateRequest
+	if err := protocol.DecodePacket(p.Data, &request); err != nil {
+		logger.Println("Error decoding certificate request packet:", err)
+		return
+	}
+
+	var missing []*certstore.Bundle
+	for _, bundle := range certstore.List(certificateDir) {
+		if len(request.Names) > 0 && !bundle.Covers(request.Names) {
+			continue
+		}
+
+		if version, ok := request.Versions[bundle.Name]; ok && version >= bundle.Version {
+			continue
+		}
+
+		missing = append(missing, bundle)
+	}
+
+	if len(missing) == 0 {
+		return
+	}
+
+	// don't block the read loop of the connection while sending
+	go func() {
+		for _, bundle := range missing {
+			if err := sendBundle(conn, bundle); err != nil {
+				logger.Printf("Failed to send certificate bundle %s to %s: %v\n", bundle.Name, conn.Key, err)
+				return
+			}
+		}
+
+		logger.Printf("Sent %d certificate bundles to %s\n", len(missing), conn.Key)
+	}()
+}
+
+// receiveBundle stores a bundle uploaded by the issuer and pushes it to the other nodes when it is new
+func receiveBundle(conn *protocol.Conn, payload []byte) {
+	if !isCertificateIssuer(conn.Key) {
+		logger.Printf("Ignoring certificate bundle from %s, it is not the certificate issuer\n", conn.Key)
+		return
+	}
+
+	bundle, err := certstore.Decode(payload)
+	if err != nil {
+		logger.Printf("Invalid certificate bundle from %s: %v\n", conn.Key, err)
+		return
+	}
+
+	stored, err := certstore.Put(certificateDir, bundle)
+	if err != nil {
+		logger.Printf("Failed to store certificate bundle %s: %v\n", bundle.Name, err)
+		return
+	}
+
+	if !stored {
+		logger.Printf("Ignoring certificate bundle %s from %s, the stored one is as new\n", bundle.Name, conn.Key)
+		return
+	}
+
+	logger.Printf("Stored certificate bundle %s for %v from %s\n", bundle.Name, bundle.Names, conn.Key)
+
+	utils.NodesMux.RLock()
+	var conns []*protocol.Conn
+	for _, node := range utils.Nodes {
+		if node.Conn != nil && node.Conn != conn && node.Conn.State == protocol.StateFullyReady {
+			conns = append(conns, node.Conn)
+		}
+	}
+	utils.NodesMux.RUnlock()
+
+	go func() {
+		for _, nodeConn := range conns {
+			if err := sendBundle(nodeConn, bundle); err != nil {
+				logger.Printf("Failed to push certificate bundle %s to %s: %v\n", bundle.Name, nodeConn.Key, err)
+			}
+		}
+	}()
+}
+
+func sendBundle(conn *protocol.Conn, bundle *certstore.Bundle) error {
+	payload, err := bundle.Encode()
+	if err != nil {
+		return err
+	}
+
+	return conn.SendBinary(certstore.BundleKind, payload)
+}
@@ -29,6 +29,7 @@ func (h *EventTransmissionHandler) Handle(conn *protocol.Conn, p *protocol.Packe
 		return
 	}
 
+	// forwarded to every node, the one that fired it skips it
 	eventBus.Pub(txEvent.Event)
-	PacketEventBus.Pub(txEvent.Event)
+	PacketEventBus.PubLocal(txEvent.Event)
 }
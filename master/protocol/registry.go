@@ -7,9 +7,12 @@ import (
 )
 
 var handlers = map[globals.VarInt]PacketHandler{
-	globals.Packet.ID_Login:             &packets.LoginHandler{},
-	globals.Packet.ID_ChallengeResult:   &packets.ChallengeResultHandler{},
-	globals.Packet.ID_EventTransmission: &packets.EventTransmissionHandler{},
+	globals.Packet.ID_Login:              &packets.LoginHandler{},
+	globals.Packet.ID_ChallengeResult:    &packets.ChallengeResultHandler{},
+	globals.Packet.ID_EventTransmission:  &packets.EventTransmissionHandler{},
+	globals.Packet.ID_BinaryData:         &packets.BinaryDataHandler{},
+	globals.Packet.ID_BinaryDataEnd:      &packets.BinaryDataEndHandler{},
+	globals.Packet.ID_CertificateRequest: &packets.CertificateRequestHandler{},
 }
 
 func GetHandler(conn *protocol.Conn, id globals.VarInt) PacketHandler {
@@ -0,0 +1,422 @@
+package certstore
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"wired/modules/env"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+/*
+	Certificate bundles
+
+	A bundle is one SAN certificate with its keys as written by modules/ssl:
+	san_<batch id>.crt/.key (RSA) and san_<batch id>.ecdsa.crt/.key (ECDSA).
+	The master keeps the bundles of record and pushes new or renewed ones to
+	the nodes, nodes ask it for the ones they miss.
+
+	Version is the newest NotBefore of the certificates, Fingerprint hashes
+	their DER, both are taken from the certificates themselves so a sender
+	can't make a stale bundle look new. NotBefore is capped at the current
+	time so a forged date can't outrank later renewals.
+
+	Received bundles must chain to a trusted root, the system roots and the
+	PEM file in SSL_TRUSTED_ROOTS (e.g. Pebble's issuing root), and be named
+	after the hash of the names they cover.
+*/
+
+const BundleKind = "certificate_bundle" // kind of binary transfers carrying a bundle
+
+const (
+	ecdsaSuffix = ".ecdsa"
+	clockSkew   = 5 * time.Minute
+)
+
+var (
+	storeMu sync.Mutex // serializes reads and writes of bundle files
+
+	trustedRoots     *x509.CertPool
+	trustedRootsErr  error
+	trustedRootsOnce sync.Once
+)
+
+type File struct {
+	Name string // file name in the certificate directory
+	Data []byte
+}
+
+type Bundle struct {
+	Name        string // san_<batch id>
+	Names       []string
+	Version     int64 // unix time
+	Fingerprint string
+	Files       []File
+}
+
+// validName reports whether name is the name of a SAN bundle, san_ followed by hex
+func validName(name string) bool {
+	id, ok := strings.CutPrefix(name, "san_")
+	if !ok || id == "" {
+		return false
+	}
+
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// BatchName returns the name of the bundle covering the names, san_ followed by a hash of them
+func BatchName(names []string) string {
+	sorted := make([]string, 0, len(names))
+	for _, name := range names {
+		sorted = append(sorted, strings.ToLower(name))
+	}
+	slices.Sort(sorted)
+	sorted = slices.Compact(sorted)
+
+	sum := sha256.Sum256([]byte(strings.Join(sorted, ",")))
+	return "san_" + hex.EncodeToString(sum[:])[:8]
+}
+
+// verify checks the files of the bundle and derives its names, version and fingerprint
+func (b *Bundle) verify() error {
+	if !validName(b.Name) {
+		return fmt.Errorf("invalid bundle name %q", b.Name)
+	}
+
+	files := make(map[string][]byte)
+	for _, file := range b.Files {
+		files[file.Name] = file.Data
+	}
+
+	b.Names, b.Version = nil, 0
+	fingerprint := sha256.New()
+	pairs := 0
+	for _, suffix := range []string{"", ecdsaSuffix} {
+		base := b.Name + suffix
+		certPEM, hasCert := files[base+".crt"]
+		keyPEM, hasKey := files[base+".key"]
+		delete(files, base+".crt")
+		delete(files, base+".key")
+		if !hasCert && !hasKey {
+			continue
+		}
+
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return fmt.Errorf("invalid key pair %s: %w", base, err)
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("invalid certificate %s: %w", base, err)
+		}
+
+		names := make([]string, 0, len(leaf.DNSNames))
+		for _, name := range leaf.DNSNames {
+			names = append(names, strings.ToLower(name))
+		}
+		slices.Sort(names)
+
+		if b.Names == nil {
+			b.Names = names
+		} else if !slices.Equal(b.Names, names) {
+			return fmt.Errorf("certificates of %s cover different names", b.Name)
+		}
+
+		b.Version = max(b.Version, min(leaf.NotBefore.Unix(), time.Now().Unix()))
+		fingerprint.Write(leaf.Raw)
+		pairs++
+	}
+
+	if pairs == 0 {
+		return fmt.Errorf("bundle %s holds no certificate", b.Name)
+	}
+
+	if len(files) > 0 {
+		return fmt.Errorf("bundle %s holds unknown files", b.Name)
+	}
+
+	b.Fingerprint = hex.EncodeToString(fingerprint.Sum(nil))
+	return nil
+}
+
+// verifyTrust checks that a received bundle is named after its names and its certificates chain to a trusted root
+func (b *Bundle) verifyTrust() error {
+	if b.Name != BatchName(b.Names) {
+		return fmt.Errorf("bundle %s doesn't match its names %v", b.Name, b.Names)
+	}
+
+	roots, err := loadTrustedRoots()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range b.Files {
+		if filepath.Ext(file.Name) != ".crt" {
+			continue
+		}
+
+		chain, err := parseChain(file.Data)
+		if err != nil {
+			return fmt.Errorf("invalid certificate %s: %w", file.Name, err)
+		}
+
+		leaf := chain[0]
+		if leaf.NotBefore.After(time.Now().Add(clockSkew)) {
+			return fmt.Errorf("certificate %s is not valid before %s", file.Name, leaf.NotBefore.Format(time.RFC3339))
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range chain[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}); err != nil {
+			return fmt.Errorf("untrusted certificate %s: %w", file.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// loadTrustedRoots returns the system roots with the ones in SSL_TRUSTED_ROOTS, read once
+func loadTrustedRoots() (*x509.CertPool, error) {
+	trustedRootsOnce.Do(func() {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if rootsFile := env.GetEnv("SSL_TRUSTED_ROOTS", ""); rootsFile != "" {
+			rootsPEM, err := os.ReadFile(rootsFile)
+			if err != nil {
+				trustedRootsErr = fmt.Errorf("failed to read trusted roots: %w", err)
+				return
+			}
+
+			if !pool.AppendCertsFromPEM(rootsPEM) {
+				trustedRootsErr = errors.New("no certificates in trusted roots")
+				return
+			}
+		}
+
+		trustedRoots = pool
+	})
+
+	return trustedRoots, trustedRootsErr
+}
+
+// parseChain parses every certificate of a PEM chain, leaf first
+func parseChain(certPEM []byte) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		chain = append(chain, cert)
+	}
+
+	if len(chain) == 0 {
+		return nil, errors.New("no certificate in PEM data")
+	}
+
+	return chain, nil
+}
+
+// parseLeaf parses the first certificate of a PEM chain
+func parseLeaf(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate in PEM data")
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// Leaf parses the first certificate of the bundle, RSA when it has one
+func (b *Bundle) Leaf() (*x509.Certificate, error) {
+	for _, file := range b.Files {
+		if file.Name == b.Name+".crt" || file.Name == b.Name+ecdsaSuffix+".crt" {
+			return parseLeaf(file.Data)
+		}
+	}
+
+	return nil, errors.New("bundle holds no certificate")
+}
+
+// Covers reports whether the bundle holds a certificate for one of the names
+func (b *Bundle) Covers(names []string) bool {
+	for _, name := range names {
+		if slices.Contains(b.Names, strings.ToLower(name)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *Bundle) Encode() ([]byte, error) {
+	return cbor.Marshal(b)
+}
+
+// Decode reads a received bundle, its names, version and fingerprint are derived again and its certificates must be trusted
+func Decode(data []byte) (*Bundle, error) {
+	var b Bundle
+	if err := cbor.Unmarshal(data, &b); err != nil {
+		return nil, err
+	}
+
+	if err := b.verify(); err != nil {
+		return nil, err
+	}
+
+	if err := b.verifyTrust(); err != nil {
+		return nil, err
+	}
+
+	return &b, nil
+}
+
+// Read loads a bundle from the certificate directory, nil when it doesn't exist
+func Read(dir, name string) (*Bundle, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	return read(dir, name)
+}
+
+func read(dir, name string) (*Bundle, error) {
+	b := &Bundle{Name: name}
+	for _, suffix := range []string{"", ecdsaSuffix} {
+		for _, ext := range []string{".crt", ".key"} {
+			data, err := os.ReadFile(filepath.Join(dir, name+suffix+ext))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			b.Files = append(b.Files, File{Name: name + suffix + ext, Data: data})
+		}
+	}
+
+	if len(b.Files) == 0 {
+		return nil, nil
+	}
+
+	if err := b.verify(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// List loads every bundle in the certificate directory, broken ones are skipped
+func List(dir string) []*Bundle {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	certFiles, _ := filepath.Glob(filepath.Join(dir, "san_*.crt"))
+
+	var bundles []*Bundle
+	for _, certFile := range certFiles {
+		name := strings.TrimSuffix(filepath.Base(certFile), ".crt")
+		if strings.HasSuffix(name, ecdsaSuffix) {
+			continue
+		}
+
+		if b, err := read(dir, name); err == nil && b != nil {
+			bundles = append(bundles, b)
+		}
+	}
+
+	return bundles
+}
+
+// Put writes a bundle unless the directory holds the same or a newer version, it reports whether it was written.
+// Callers reload the certificates afterwards, a reload between two files only fails for that pair
+func Put(dir string, b *Bundle) (bool, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	current, err := read(dir, b.Name)
+	if err == nil && current != nil && (current.Fingerprint == b.Fingerprint || current.Version >= b.Version) {
+		return false, nil
+	}
+
+	if err := write(dir, b); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// write writes the files of a bundle, storeMu must be held
+func write(dir string, b *Bundle) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, file := range b.Files {
+		mode := os.FileMode(0644)
+		if filepath.Ext(file.Name) == ".key" {
+			mode = 0600
+		}
+
+		if err := writeFile(filepath.Join(dir, file.Name), file.Data, mode); err != nil {
+			return err
+		}
+	}
+
+	// a previous version may hold a pair this one doesn't
+	for _, suffix := range []string{"", ecdsaSuffix} {
+		for _, ext := range []string{".crt", ".key"} {
+			name := b.Name + suffix + ext
+			if !slices.ContainsFunc(b.Files, func(file File) bool { return file.Name == name }) {
+				os.Remove(filepath.Join(dir, name))
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeFile replaces a file atomically so readers never see it half written
+func writeFile(path string, data []byte, mode os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, mode); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
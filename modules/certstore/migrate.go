@@ -0,0 +1,96 @@
+package certstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Per host certificates
+
+	Before SAN bundles every name had its own <host>.crt/.key and
+	<host>.ecdsa.crt/.key. They are moved into the bundle named after the
+	names they cover so the renewal scheduler picks them up.
+*/
+
+// MigrateHostCertificates moves per host certificates into bundles, it returns the names of the written bundles
+func MigrateHostCertificates(dir string) ([]string, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	certFiles, _ := filepath.Glob(filepath.Join(dir, "*.crt"))
+
+	var migrated []string
+	var errs []error
+	for _, certFile := range certFiles {
+		host := strings.TrimSuffix(filepath.Base(certFile), ".crt")
+		if strings.HasPrefix(host, "san_") || strings.HasSuffix(host, ecdsaSuffix) {
+			continue
+		}
+
+		name, err := migrateHost(dir, host)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", host, err))
+			continue
+		}
+
+		if name != "" {
+			migrated = append(migrated, name)
+		}
+	}
+
+	return migrated, errors.Join(errs...)
+}
+
+// migrateHost writes the certificates of a host as a bundle and removes them, storeMu must be held
+func migrateHost(dir, host string) (string, error) {
+	var files []File
+	for _, suffix := range []string{"", ecdsaSuffix} {
+		for _, ext := range []string{".crt", ".key"} {
+			data, err := os.ReadFile(filepath.Join(dir, host+suffix+ext))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			if err != nil {
+				return "", err
+			}
+
+			files = append(files, File{Name: suffix + ext, Data: data})
+		}
+	}
+
+	leaf, err := parseLeaf(files[0].Data)
+	if err != nil {
+		return "", err
+	}
+
+	b := &Bundle{Name: BatchName(leaf.DNSNames)}
+	for _, file := range files {
+		b.Files = append(b.Files, File{Name: b.Name + file.Name, Data: file.Data})
+	}
+
+	if err := b.verify(); err != nil {
+		return "", err
+	}
+
+	// a bundle of the same names supersedes the host certificates unless they are newer
+	written := ""
+	current, err := read(dir, b.Name)
+	if err != nil || current == nil || (current.Fingerprint != b.Fingerprint && current.Version < b.Version) {
+		if err := write(dir, b); err != nil {
+			return "", err
+		}
+
+		written = b.Name
+	}
+
+	for _, file := range files {
+		os.Remove(filepath.Join(dir, host+file.Name))
+	}
+
+	return written, nil
+}
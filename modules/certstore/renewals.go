@@ -0,0 +1,112 @@
+package certstore
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+	Renewal state
+
+	Every bundle has its own renewal time, two thirds into the certificate's
+	lifetime or a time in the window the CA suggests through ACME Renewal
+	Information (ARI). The state is kept in a file so windows, failures and
+	backoffs survive restarts, the dashboard reads it from here.
+*/
+
+const (
+	RenewalLifetime = "lifetime"
+	RenewalARI      = "ari"
+)
+
+type Renewal struct {
+	Bundle         string    `json:"bundle"`
+	Names          []string  `json:"names"`
+	Fingerprint    string    `json:"fingerprint"`
+	NotBefore      time.Time `json:"not_before"`
+	NotAfter       time.Time `json:"not_after"`
+	RenewAt        time.Time `json:"renew_at"`
+	Source         string    `json:"source"`       // RenewalLifetime or RenewalARI
+	WindowStart    time.Time `json:"window_start"` // ARI suggested window, zero without ARI
+	WindowEnd      time.Time `json:"window_end"`
+	ExplanationURL string    `json:"explanation_url,omitempty"`
+	ARICheckAt     time.Time `json:"ari_check_at"`
+	Attempts       int       `json:"attempts"`
+	LastAttempt    time.Time `json:"last_attempt"`
+	LastError      string    `json:"last_error,omitempty"`
+	RetryAt        time.Time `json:"retry_at"`
+	Unused         bool      `json:"unused"` // none of the names is proxied anymore, left to expire
+}
+
+var (
+	renewals   = make(map[string]*Renewal) // bundle name -> renewal
+	renewalsMu sync.RWMutex
+)
+
+// Failed reports whether the last renewal attempt failed
+func (r *Renewal) Failed() bool {
+	return r.LastError != ""
+}
+
+// Renewals returns the renewal state of every bundle ordered by renewal time
+func Renewals() []Renewal {
+	renewalsMu.RLock()
+	defer renewalsMu.RUnlock()
+
+	list := make([]Renewal, 0, len(renewals))
+	for _, renewal := range renewals {
+		list = append(list, *renewal)
+	}
+
+	slices.SortFunc(list, func(a, b Renewal) int {
+		return a.RenewAt.Compare(b.RenewAt)
+	})
+
+	return list
+}
+
+// UpdateRenewals runs update with the renewal state locked
+func UpdateRenewals(update func(renewals map[string]*Renewal)) {
+	renewalsMu.Lock()
+	defer renewalsMu.Unlock()
+
+	update(renewals)
+}
+
+// LoadRenewals reads the renewal state, a missing file is an empty state
+func LoadRenewals(file string) error {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	loaded := make(map[string]*Renewal)
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return err
+	}
+
+	renewalsMu.Lock()
+	renewals = loaded
+	renewalsMu.Unlock()
+	return nil
+}
+
+// SaveRenewals writes the renewal state
+func SaveRenewals(file string) error {
+	renewalsMu.RLock()
+	data, err := json.MarshalIndent(renewals, "", "  ")
+	renewalsMu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFile(file, data, 0644)
+}
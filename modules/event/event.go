@@ -6,12 +6,23 @@ import (
 	"wired/modules/globals"
 	"wired/modules/protocol"
 	"wired/modules/utils"
+
+	"github.com/fxamacker/cbor/v2"
 )
 
 var (
 	Event_Tick                  uint8 = 0
 	Event_AddRecord             uint8 = 1
 	Event_RemoveRecord          uint8 = 2
+	Event_HealthReport          uint8 = 3
+	Event_DNSMetrics            uint8 = 4
+	Event_WAFRulesChanged       uint8 = 5
+	Event_RateLimitCounters     uint8 = 6
+	Event_CachePurge            uint8 = 7
+	Event_ErrorPageChanged      uint8 = 8
+	Event_CertificateIssuer     uint8 = 9
+	Event_RenewalStatus         uint8 = 10
+	Event_DomainSettingChanged  uint8 = 11
 	Event_DNSDataBuilt          uint8 = 128
 	Event_DNSServiceInitialized uint8 = 129
 )
@@ -52,11 +63,7 @@ func (eventBus *EventBus) Sub(eventType uint8, subscriber chan<- Event, handler
 }
 
 func (eventBus *EventBus) Pub(event Event) {
-	if subscribers, ok := eventBus.Subscribers[event.Type]; ok {
-		for _, subscriber := range subscribers {
-			subscriber <- event
-		}
-	}
+	eventBus.PubLocal(event)
 
 	if env.GetEnv("NODE_KEY", "node-key") == "master" {
 		// send ID_EventTransmission packet to nodes
@@ -77,7 +84,36 @@ func (eventBus *EventBus) Pub(event Event) {
 	}
 }
 
+// PubLocal hands the event to the subscribers of this process only, for events received from another one
+func (eventBus *EventBus) PubLocal(event Event) {
+	if subscribers, ok := eventBus.Subscribers[event.Type]; ok {
+		for _, subscriber := range subscribers {
+			subscriber <- event
+		}
+	}
+}
+
 type EventTransmission struct {
 	EventBusName string
 	Event        Event
 }
+
+// DecodeData returns the typed data of an event, events received over the
+// protocol carry their data as generic cbor maps and get decoded again
+func DecodeData[T any](event Event) (T, bool) {
+	if data, ok := event.Data.(T); ok {
+		return data, true
+	}
+
+	var data T
+	raw, err := cbor.Marshal(event.Data)
+	if err != nil {
+		return data, false
+	}
+
+	if err := cbor.Unmarshal(raw, &data); err != nil {
+		return data, false
+	}
+
+	return data, true
+}
@@ -0,0 +1,8 @@
+package event_data
+
+type CachePurgeData struct {
+	Domain   string
+	URLs     []string
+	Prefixes []string
+	Tags     []string
+}
@@ -0,0 +1,5 @@
+package event_data
+
+type CertificateIssuerData struct {
+	Node string // the only node ordering certificates, empty when none is connected
+}
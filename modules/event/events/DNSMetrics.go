@@ -0,0 +1,15 @@
+package event_data
+
+type DNSZoneMetrics struct {
+	Queries uint64
+	Capped  uint64
+}
+
+type DNSMetricsData struct {
+	Node    string
+	Queries uint64
+	Dropped uint64 // RRL, no response sent
+	Slipped uint64 // RRL, truncated response sent
+	Capped  uint64 // zone query cap exceeded
+	Zones   map[string]DNSZoneMetrics
+}
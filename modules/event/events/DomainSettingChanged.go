@@ -0,0 +1,9 @@
+package event_data
+
+type DomainSettingChangedData struct {
+	OwnerId  string
+	DomainId string
+	Setting  string
+	Host     string // balancer only, the protected name it applies to
+	Value    []byte // json, null removes the setting
+}
@@ -0,0 +1,7 @@
+package event_data
+
+type ErrorPageChangedData struct {
+	OwnerId string
+	Code    int
+	Html    string // empty when the page was removed
+}
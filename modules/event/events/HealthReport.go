@@ -0,0 +1,16 @@
+package event_data
+
+import "time"
+
+type HealthResult struct {
+	Target    string
+	Healthy   bool
+	Error     string
+	CheckedAt time.Time
+	Interval  time.Duration
+}
+
+type HealthReportData struct {
+	Node    string
+	Results []HealthResult
+}
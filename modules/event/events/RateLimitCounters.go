@@ -0,0 +1,6 @@
+package event_data
+
+type RateLimitCountersData struct {
+	Node   string
+	Counts map[string]uint64 // bucket key -> requests since the last exchange
+}
@@ -0,0 +1,7 @@
+package event_data
+
+import "wired/modules/certstore"
+
+type RenewalStatusData struct {
+	Renewals []certstore.Renewal // renewal state of the issuer
+}
@@ -0,0 +1,7 @@
+package event_data
+
+type WAFRulesChangedData struct {
+	OwnerId string
+	Domain  string
+	Rules   string // empty when the rules were removed
+}
@@ -0,0 +1,304 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+/*
+	AVIF/HEIF -> ISOBMFF Boxes
+	Box -> Size (4 Bytes, big endian) + Type (4 Bytes) + Data, size 1 -> 64 bit size follows, size 0 -> to the end
+	Full Box -> Box + Version (1 Byte) + Flags (3 Bytes)
+
+	meta (Full Box)
+		- iinf: item infos, every infe names an item id and its type
+			- Exif: EXIF data
+			- mime: XMP with the content type application/rdf+xml
+		- iloc: item locations, extents in the file (construction method 0) or in idat (1)
+
+	Removing items would move every offset in iloc, so the metadata items
+	keep their place and only their data is zeroed
+*/
+
+var errInvalidBox = errors.New("invalid AVIF box")
+
+type isoBox struct {
+	boxType string
+	data    []byte // content after the header
+	offset  int    // offset of data in the file
+}
+
+// readBoxes splits data into its boxes, base is the offset of data in the file
+func readBoxes(data []byte, base int) ([]isoBox, error) {
+	var boxes []isoBox
+	for offset := 0; offset < len(data); {
+		if len(data)-offset < 8 {
+			return nil, errInvalidBox
+		}
+
+		size := uint64(binary.BigEndian.Uint32(data[offset:]))
+		boxType := string(data[offset+4 : offset+8])
+		header := 8
+		switch size {
+		case 0:
+			size = uint64(len(data) - offset)
+		case 1:
+			if len(data)-offset < 16 {
+				return nil, errInvalidBox
+			}
+
+			size = binary.BigEndian.Uint64(data[offset+8:])
+			header = 16
+		}
+
+		if size < uint64(header) || size > uint64(len(data)-offset) {
+			return nil, errInvalidBox
+		}
+
+		end := offset + int(size)
+		boxes = append(boxes, isoBox{boxType: boxType, data: data[offset+header : end], offset: base + offset + header})
+		offset = end
+	}
+
+	return boxes, nil
+}
+
+// readUint reads a big endian number of size bytes
+func readUint(data []byte, offset *int, size int) (uint64, error) {
+	if size < 0 || *offset+size > len(data) {
+		return 0, errInvalidBox
+	}
+
+	var value uint64
+	for _, b := range data[*offset : *offset+size] {
+		value = value<<8 | uint64(b)
+	}
+
+	*offset += size
+	return value, nil
+}
+
+// metadataItems returns the ids of the items in iinf holding the metadata kinds
+func metadataItems(iinf []byte, kinds Kind) (map[uint64]bool, error) {
+	if len(iinf) < 4 {
+		return nil, errInvalidBox
+	}
+
+	offset := 4
+	countSize := 2
+	if iinf[0] != 0 {
+		countSize = 4
+	}
+
+	if _, err := readUint(iinf, &offset, countSize); err != nil {
+		return nil, err
+	}
+
+	entries, err := readBoxes(iinf[offset:], 0)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make(map[uint64]bool)
+	for _, entry := range entries {
+		// only version 2 and 3 entries carry an item type
+		if entry.boxType != "infe" || len(entry.data) < 4 || entry.data[0] < 2 {
+			continue
+		}
+
+		offset := 4
+		idSize := 2
+		if entry.data[0] == 3 {
+			idSize = 4
+		}
+
+		id, err := readUint(entry.data, &offset, idSize)
+		if err != nil {
+			return nil, err
+		}
+
+		// item protection index
+		offset += 2
+		if offset+4 > len(entry.data) {
+			return nil, errInvalidBox
+		}
+
+		itemType := string(entry.data[offset : offset+4])
+		switch itemType {
+		case "Exif":
+			if kinds&Exif != 0 {
+				items[id] = true
+			}
+		case "mime":
+			// item name + content type, both null terminated
+			_, rest, _ := bytes.Cut(entry.data[offset+4:], []byte{0})
+			contentType, _, _ := bytes.Cut(rest, []byte{0})
+			if kinds&XMP != 0 && string(contentType) == "application/rdf+xml" {
+				items[id] = true
+			}
+		}
+	}
+
+	return items, nil
+}
+
+// zeroItems zeroes the extents iloc lists for the items, idat is the data of the idat box
+func zeroItems(data []byte, iloc []byte, idat isoBox, items map[uint64]bool) error {
+	if len(iloc) < 6 {
+		return errInvalidBox
+	}
+
+	version := iloc[0]
+	offsetSize, lengthSize := int(iloc[4]>>4), int(iloc[4]&0x0F)
+	baseOffsetSize, indexSize := int(iloc[5]>>4), int(iloc[5]&0x0F)
+	if version == 0 {
+		indexSize = 0
+	}
+
+	offset := 6
+	countSize := 2
+	if version == 2 {
+		countSize = 4
+	}
+
+	count, err := readUint(iloc, &offset, countSize)
+	if err != nil {
+		return err
+	}
+
+	for range count {
+		id, err := readUint(iloc, &offset, countSize)
+		if err != nil {
+			return err
+		}
+
+		var method uint64
+		if version == 1 || version == 2 {
+			if method, err = readUint(iloc, &offset, 2); err != nil {
+				return err
+			}
+
+			method &= 0x0F
+		}
+
+		// data reference index
+		offset += 2
+		baseOffset, err := readUint(iloc, &offset, baseOffsetSize)
+		if err != nil {
+			return err
+		}
+
+		extents, err := readUint(iloc, &offset, 2)
+		if err != nil {
+			return err
+		}
+
+		for range extents {
+			offset += indexSize
+			extentOffset, err := readUint(iloc, &offset, offsetSize)
+			if err != nil {
+				return err
+			}
+
+			extentLength, err := readUint(iloc, &offset, lengthSize)
+			if err != nil {
+				return err
+			}
+
+			if !items[id] {
+				continue
+			}
+
+			var target []byte
+			switch method {
+			case 0:
+				target = data
+			case 1:
+				target = idat.data
+			default:
+				// items referencing other items hold no data themselves
+				continue
+			}
+
+			start := baseOffset + extentOffset
+			end := start + extentLength
+			if extentLength == 0 {
+				end = uint64(len(target))
+			}
+
+			if start > end || end > uint64(len(target)) {
+				return errInvalidBox
+			}
+
+			clear(target[start:end])
+		}
+	}
+
+	return nil
+}
+
+func CleanAVIF(r io.Reader, w io.Writer, kinds Kind) error {
+	data, err := readBuffered(r)
+	if errors.Is(err, errTooLarge) {
+		return passThrough(data, r, w)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	boxes, err := readBoxes(data, 0)
+	if err != nil {
+		return err
+	}
+
+	if len(boxes) == 0 || boxes[0].boxType != "ftyp" {
+		return errors.New("not a valid AVIF")
+	}
+
+	for _, box := range boxes {
+		if box.boxType != "meta" || len(box.data) < 4 {
+			continue
+		}
+
+		children, err := readBoxes(box.data[4:], box.offset+4)
+		if err != nil {
+			return err
+		}
+
+		var iinf, iloc []byte
+		var idat isoBox
+		for _, child := range children {
+			switch child.boxType {
+			case "iinf":
+				iinf = child.data
+			case "iloc":
+				iloc = child.data
+			case "idat":
+				idat = child
+			}
+		}
+
+		if iinf == nil || iloc == nil {
+			continue
+		}
+
+		items, err := metadataItems(iinf, kinds)
+		if err != nil {
+			return err
+		}
+
+		if len(items) == 0 {
+			continue
+		}
+
+		if err := zeroItems(data, iloc, idat, items); err != nil {
+			return err
+		}
+	}
+
+	_, err = w.Write(data)
+	return err
+}
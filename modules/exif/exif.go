@@ -0,0 +1,116 @@
+package exif
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+)
+
+/*
+	Metadata stripping of proxied images
+
+	Every cleaner streams the image from r to w and leaves out the metadata
+	kinds it was asked to remove, everything else is copied as it is. Formats
+	with sizes in their headers (WebP, AVIF/HEIF) are read up to maxBuffered,
+	larger images of those are passed through unchanged. Strip buffers every
+	format so a parse failure still hands out the original image.
+*/
+
+type Kind uint8
+
+const (
+	Exif    Kind = 1 << iota
+	XMP          // Adobe extensible metadata
+	IPTC         // press metadata, Photoshop resources in JPEG
+	Comment      // free text: JPEG COM, PNG text chunks, GIF comments
+
+	All = Exif | XMP | IPTC | Comment
+)
+
+const maxBuffered = 32 << 20 // 32MB
+
+var errTooLarge = errors.New("image too large to buffer")
+
+// Supported reports whether images of the content type can be cleaned
+func Supported(contentType string) bool {
+	return cleaner(contentType) != nil
+}
+
+// Clean strips the metadata kinds from an image of the content type
+func Clean(contentType string, r io.Reader, w io.Writer, kinds Kind) error {
+	clean := cleaner(contentType)
+	if clean == nil {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	return clean(r, w, kinds)
+}
+
+// Strip cleans a whole image before writing it, images the cleaner fails on are written unchanged
+func Strip(contentType string, r io.Reader, w io.Writer, kinds Kind) error {
+	data, err := readBuffered(r)
+	if err == errTooLarge {
+		return passThrough(data, r, w)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var cleaned bytes.Buffer
+	if err := Clean(contentType, bytes.NewReader(data), &cleaned, kinds); err != nil {
+		_, err = w.Write(data)
+		return err
+	}
+
+	_, err = w.Write(cleaned.Bytes())
+	return err
+}
+
+func cleaner(contentType string) func(io.Reader, io.Writer, Kind) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+
+	switch mediaType {
+	case "image/jpeg", "image/jpg", "image/pjpeg":
+		return CleanJPEG
+	case "image/png", "image/apng":
+		return CleanPNG
+	case "image/webp":
+		return CleanWebP
+	case "image/gif":
+		return CleanGIF
+	case "image/avif", "image/heic", "image/heif":
+		return CleanAVIF
+	}
+
+	return nil
+}
+
+// readBuffered reads a whole image, errTooLarge comes with everything read so far
+func readBuffered(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxBuffered+1))
+	if err != nil {
+		return data, err
+	}
+
+	if len(data) > maxBuffered {
+		return data, errTooLarge
+	}
+
+	return data, nil
+}
+
+// passThrough writes the read part of an image too large to clean and copies the rest
+func passThrough(data []byte, r io.Reader, w io.Writer) error {
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(w, r)
+	return err
+}
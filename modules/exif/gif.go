@@ -0,0 +1,157 @@
+package exif
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+/*
+	GIF -> Header (6 Bytes) + Logical Screen Descriptor (7 Bytes) + Global Color Table + Blocks + Trailer (0x3B)
+	GIF Block -> Extension (0x21 + Label + Sub-blocks) or Image (0x2C + Descriptor (9 Bytes) + Color Table + Data)
+	GIF Sub-block -> Size (1 Byte) + Data (Size Bytes), a size of 0 ends the block
+
+	GIF Extension Labels:
+		- 0xFE: Comment
+		- 0xFF: Application, XMP with the identifier "XMP DataXMP"
+*/
+
+const (
+	gifExtension = 0x21
+	gifImage     = 0x2C
+	gifTrailer   = 0x3B
+)
+
+// colorTableSize returns the size of the color table a packed field announces
+func colorTableSize(packed byte) int64 {
+	if packed&0x80 == 0 {
+		return 0
+	}
+
+	return 3 << (packed&0x07 + 1)
+}
+
+// readSubBlocks returns the sub-blocks of a block including their terminator
+func readSubBlocks(br *bufio.Reader) ([]byte, error) {
+	var blocks bytes.Buffer
+	for {
+		size, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		blocks.WriteByte(size)
+		if size == 0 {
+			return blocks.Bytes(), nil
+		}
+
+		if _, err := io.CopyN(&blocks, br, int64(size)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// copySubBlocks streams the sub-blocks of image data including their terminator
+func copySubBlocks(w io.Writer, br *bufio.Reader) error {
+	for {
+		size, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		if _, err := w.Write([]byte{size}); err != nil {
+			return err
+		}
+
+		if size == 0 {
+			return nil
+		}
+
+		if _, err := io.CopyN(w, br, int64(size)); err != nil {
+			return err
+		}
+	}
+}
+
+func CleanGIF(r io.Reader, w io.Writer, kinds Kind) error {
+	br := bufio.NewReader(r)
+
+	// header + logical screen descriptor
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return err
+	}
+
+	if string(header[:3]) != "GIF" {
+		return errors.New("not a valid GIF")
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	if _, err := io.CopyN(w, br, colorTableSize(header[10])); err != nil {
+		return err
+	}
+
+	for {
+		introducer, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		switch introducer {
+		case gifTrailer:
+			_, err := w.Write([]byte{gifTrailer})
+			return err
+		case gifImage:
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(br, descriptor); err != nil {
+				return err
+			}
+
+			if _, err := w.Write([]byte{gifImage}); err != nil {
+				return err
+			}
+
+			if _, err := w.Write(descriptor); err != nil {
+				return err
+			}
+
+			// local color table + lzw minimum code size
+			if _, err := io.CopyN(w, br, colorTableSize(descriptor[8])+1); err != nil {
+				return err
+			}
+
+			if err := copySubBlocks(w, br); err != nil {
+				return err
+			}
+		case gifExtension:
+			label, err := br.ReadByte()
+			if err != nil {
+				return err
+			}
+
+			blocks, err := readSubBlocks(br)
+			if err != nil {
+				return err
+			}
+
+			if label == 0xFE && kinds&Comment != 0 ||
+				label == 0xFF && kinds&XMP != 0 && bytes.HasPrefix(blocks, []byte("\x0bXMP DataXMP")) {
+				continue
+			}
+
+			if _, err := w.Write([]byte{gifExtension, label}); err != nil {
+				return err
+			}
+
+			if _, err := w.Write(blocks); err != nil {
+				return err
+			}
+		default:
+			return errors.New("invalid GIF block")
+		}
+	}
+}
@@ -2,6 +2,7 @@ package exif
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
@@ -11,10 +12,40 @@ import (
 	Segment -> Header (2 Byte) + Data
 	3rd Byte -> Length of the segment
 
-	JPEG EXIF Header -> 0xFFE1 -> 0xFF, 0xE1
+	JPEG EXIF Header -> 0xFFE1 -> 0xFF, 0xE1 + "Exif\0\0"
+	JPEG XMP Header  -> 0xFFE1 + "http://ns.adobe.com/xap/1.0/\0" (extended: ".../xmp/extension/\0")
+	JPEG IPTC Header -> 0xFFED -> 0xFF, 0xED + "Photoshop 3.0\0"
+	JPEG Comment     -> 0xFFFE
 */
 
-func CleanJPEG(r io.Reader, w io.Writer) error {
+var (
+	xmpHeader         = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	xmpExtendedHeader = []byte("http://ns.adobe.com/xmp/extension/\x00")
+)
+
+// jpegKind returns the metadata kind of a segment, 0 for image data
+func jpegKind(marker byte, segData []byte) Kind {
+	switch marker {
+	case 0xE1:
+		if bytes.HasPrefix(segData, []byte("Exif\x00\x00")) {
+			return Exif
+		}
+
+		if bytes.HasPrefix(segData, xmpHeader) || bytes.HasPrefix(segData, xmpExtendedHeader) {
+			return XMP
+		}
+	case 0xED:
+		if bytes.HasPrefix(segData, []byte("Photoshop 3.0\x00")) {
+			return IPTC
+		}
+	case 0xFE:
+		return Comment
+	}
+
+	return 0
+}
+
+func CleanJPEG(r io.Reader, w io.Writer, kinds Kind) error {
 	br := bufio.NewReader(r)
 
 	soi := make([]byte, 2)
@@ -34,7 +65,6 @@ func CleanJPEG(r io.Reader, w io.Writer) error {
 		// read marker (2b header)
 		marker := make([]byte, 2)
 		if _, err := io.ReadFull(br, marker); err != nil {
-			_, _ = io.Copy(w, br)
 			return err
 		}
 
@@ -42,7 +72,17 @@ func CleanJPEG(r io.Reader, w io.Writer) error {
 			return errors.New("invalid JPEG marker")
 		}
 
-		// no segment length for SOF, SOS, EOI
+		// markers may be padded with fill bytes
+		for marker[1] == 0xFF {
+			b, err := br.ReadByte()
+			if err != nil {
+				return err
+			}
+
+			marker[1] = b
+		}
+
+		// no segment length for SOS (entropy coded data follows) and EOI
 		if marker[1] == 0xDA || marker[1] == 0xD9 {
 			if _, err := w.Write(marker); err != nil {
 				return err
@@ -52,6 +92,15 @@ func CleanJPEG(r io.Reader, w io.Writer) error {
 			return err
 		}
 
+		// standalone markers without a length
+		if marker[1] == 0x01 || (marker[1] >= 0xD0 && marker[1] <= 0xD7) {
+			if _, err := w.Write(marker); err != nil {
+				return err
+			}
+
+			continue
+		}
+
 		// read segment length
 		lenBytes := make([]byte, 2)
 		if _, err := io.ReadFull(br, lenBytes); err != nil {
@@ -59,19 +108,29 @@ func CleanJPEG(r io.Reader, w io.Writer) error {
 		}
 
 		segLen := int(binary.BigEndian.Uint16(lenBytes))
+		if segLen < 2 {
+			return errors.New("invalid JPEG segment length")
+		}
+
 		segData := make([]byte, segLen-2)
 		if _, err := io.ReadFull(br, segData); err != nil {
 			return err
 		}
 
-		if marker[1] == 0xE1 {
-			if len(segData) >= 6 && string(segData[:6]) == "Exif\x00\x00" { // confirm EXIF header
-				continue
-			}
+		if kinds&jpegKind(marker[1], segData) != 0 {
+			continue
 		}
 
-		w.Write(marker)
-		w.Write(lenBytes)
-		w.Write(segData)
+		if _, err := w.Write(marker); err != nil {
+			return err
+		}
+
+		if _, err := w.Write(lenBytes); err != nil {
+			return err
+		}
+
+		if _, err := w.Write(segData); err != nil {
+			return err
+		}
 	}
 }
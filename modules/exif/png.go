@@ -2,8 +2,11 @@ package exif
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
+	"strings"
 )
 
 /*
@@ -12,15 +15,42 @@ import (
 
 	PNG Chunk Types:
 		- eXIf: EXIF data
-		- iTXt: International text
+		- iTXt: International text (XMP with the keyword XML:com.adobe.xmp)
 		- tEXt: Textual data
 		- zTXt: Compressed textual data
 
+	Text chunks start with their keyword, ImageMagick stores EXIF, XMP and
+	IPTC in them as "Raw profile type <kind>"
+
 	Big Endian -> left to right
 	Little Endian -> right to left
 */
 
-func CleanPNG(r io.Reader, w io.Writer) error {
+var pngSignature = []byte{137, 80, 78, 71, 13, 10, 26, 10}
+
+// pngKind returns the metadata kind of a chunk, 0 for image data, keyword is the start of its data
+func pngKind(chunkType string, keyword []byte) Kind {
+	switch chunkType {
+	case "eXIf":
+		return Exif
+	case "iTXt", "tEXt", "zTXt":
+		name, _, _ := bytes.Cut(keyword, []byte{0})
+		switch strings.ToLower(string(name)) {
+		case "xml:com.adobe.xmp", "raw profile type xmp":
+			return XMP
+		case "raw profile type exif", "raw profile type app1":
+			return Exif
+		case "raw profile type iptc", "raw profile type 8bim":
+			return IPTC
+		}
+
+		return Comment
+	}
+
+	return 0
+}
+
+func CleanPNG(r io.Reader, w io.Writer, kinds Kind) error {
 	bufReader := bufio.NewReader(r)
 
 	// PNG signature
@@ -29,45 +59,45 @@ func CleanPNG(r io.Reader, w io.Writer) error {
 		return err
 	}
 
+	if !bytes.Equal(sig, pngSignature) {
+		return errors.New("not a valid PNG")
+	}
+
 	if _, err := w.Write(sig); err != nil {
 		return err
 	}
 
+	header := make([]byte, 8)
 	for {
-		lengthBytes := make([]byte, 4)
-		if _, err := io.ReadFull(bufReader, lengthBytes); err != nil {
-			return nil // EOF
-		}
-
-		// chunk length
-		length := binary.BigEndian.Uint32(lengthBytes)
-		chunkType := make([]byte, 4)
-		if _, err := io.ReadFull(bufReader, chunkType); err != nil {
+		// chunk length + type
+		if _, err := io.ReadFull(bufReader, header); err != nil {
 			return err
 		}
 
-		chunkData := make([]byte, length)
-		if _, err := io.ReadFull(bufReader, chunkData); err != nil {
-			return err
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		chunkType := string(header[4:])
+
+		// keywords are at most 79 bytes
+		keyword, _ := bufReader.Peek(int(min(length, 80)))
+		if kinds&pngKind(chunkType, keyword) != 0 {
+			// data + 4b checksum
+			if _, err := io.CopyN(io.Discard, bufReader, length+4); err != nil {
+				return err
+			}
+
+			continue
 		}
 
-		// 4b checksum
-		crc := make([]byte, 4)
-		if _, err := io.ReadFull(bufReader, crc); err != nil {
+		if _, err := w.Write(header); err != nil {
 			return err
 		}
 
-		switch string(chunkType) {
-		case "eXIf", "iTXt", "tEXt", "zTXt":
-			continue
+		if _, err := io.CopyN(w, bufReader, length+4); err != nil {
+			return err
 		}
 
 		// PNG end chunk
-		if string(chunkType) == "IEND" {
-			w.Write(lengthBytes)
-			w.Write(chunkType)
-			w.Write(chunkData)
-			w.Write(crc)
+		if chunkType == "IEND" {
 			return nil
 		}
 	}
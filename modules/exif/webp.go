@@ -0,0 +1,89 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+/*
+	WebP -> "RIFF" + Size (4 Bytes, little endian) + "WEBP" + Chunks
+	WebP Chunk -> FourCC (4 Bytes) + Size (4 Bytes, little endian) + Data (padded to an even size)
+
+	WebP Chunk Types:
+		- EXIF: EXIF data
+		- XMP : XMP data
+		- VP8X: extended header, its first byte flags EXIF (0x08) and XMP (0x04)
+
+	The RIFF size covers every chunk, so the image is buffered to write it
+*/
+
+const (
+	vp8xExifFlag = 0x08
+	vp8xXMPFlag  = 0x04
+)
+
+func CleanWebP(r io.Reader, w io.Writer, kinds Kind) error {
+	data, err := readBuffered(r)
+	if errors.Is(err, errTooLarge) {
+		return passThrough(data, r, w)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return errors.New("not a valid WebP")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+
+	var vp8x int = -1 // offset of the VP8X flags in out
+	for offset := 12; offset < len(data); {
+		if len(data)-offset < 8 {
+			return errors.New("truncated WebP chunk")
+		}
+
+		fourCC := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		end := offset + 8 + size + size&1
+		if size < 0 || end > len(data) {
+			// some encoders leave out the padding of the last chunk
+			if end-1 != len(data) {
+				return errors.New("truncated WebP chunk")
+			}
+
+			end = len(data)
+		}
+
+		switch {
+		case fourCC == "EXIF" && kinds&Exif != 0, fourCC == "XMP " && kinds&XMP != 0:
+		default:
+			if fourCC == "VP8X" && size > 0 {
+				vp8x = out.Len() + 8
+			}
+
+			out.Write(data[offset:end])
+		}
+
+		offset = end
+	}
+
+	cleaned := out.Bytes()
+	binary.LittleEndian.PutUint32(cleaned[4:8], uint32(len(cleaned)-8))
+	if vp8x >= 0 {
+		if kinds&Exif != 0 {
+			cleaned[vp8x] &^= vp8xExifFlag
+		}
+
+		if kinds&XMP != 0 {
+			cleaned[vp8x] &^= vp8xXMPFlag
+		}
+	}
+
+	_, err = w.Write(cleaned)
+	return err
+}
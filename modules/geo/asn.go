@@ -0,0 +1,81 @@
+package geo
+
+import (
+	"fmt"
+	"net"
+	"wired/modules/logger"
+	"wired/modules/utils"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+type MMASN struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+var (
+	asnV4DB  *maxminddb.Reader
+	asnV6DB  *maxminddb.Reader
+	asnV4URL string = "https://github.com/sapics/ip-location-db/raw/refs/heads/main/geolite2-asn-mmdb/geolite2-asn-ipv4.mmdb"
+	asnV6URL string = "https://github.com/sapics/ip-location-db/raw/refs/heads/main/geolite2-asn-mmdb/geolite2-asn-ipv6.mmdb"
+)
+
+var asnDBLoaded = make(chan struct{})
+
+// the ASN databases are optional, lookups fail without blocking until they are available
+func init() {
+	go func() {
+		defer close(asnDBLoaded)
+		asnV4DB = loadOrDownloadASN(asnV4URL, "geolite2-asn-ipv4.mmdb")
+		asnV6DB = loadOrDownloadASN(asnV6URL, "geolite2-asn-ipv6.mmdb")
+	}()
+}
+
+// GetASN looks up the AS of an ip, the ASN is unknown while the databases are still loading
+func GetASN(ip net.IP) (*MMASN, error) {
+	select {
+	case <-asnDBLoaded:
+	default:
+		return nil, fmt.Errorf("ASN database not loaded yet")
+	}
+
+	db := asnV6DB
+	if utils.IsIPv4(ip) {
+		db = asnV4DB
+	} else if !utils.IsIPv6(ip) {
+		return nil, fmt.Errorf("could not determine ip version: %s", ip.String())
+	}
+
+	if db == nil {
+		return nil, fmt.Errorf("ASN database not available")
+	}
+
+	var asn MMASN
+	if err := db.Lookup(ip, &asn); err != nil {
+		return nil, fmt.Errorf("failed to lookup ASN: %w", err)
+	}
+
+	return &asn, nil
+}
+
+func loadOrDownloadASN(url, filename string) *maxminddb.Reader {
+	db, err := loadMaxMindDB(filename)
+	if err == nil {
+		return db
+	}
+
+	logger.Println("Downloading", filename)
+	if err := utils.DownloadFile(url, filename); err != nil {
+		logger.Println("Error downloading ", filename, ": ", err)
+		return nil
+	}
+
+	db, err = loadMaxMindDB(filename)
+	if err != nil {
+		logger.Println("Error loading ", filename, ": ", err)
+		return nil
+	}
+
+	return db
+}
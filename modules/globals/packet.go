@@ -94,7 +94,7 @@ func readByte(r io.Reader) (int64, byte, error) {
 type packetIDs struct {
 	ID_SharedSecret, ID_Login, ID_ChallengeStart, ID_ChallengeResult, ID_ChallengeFinish VarInt
 	ID_Config, ID_Ready, ID_Ping, ID_Pong, Error, ID_BinaryData, ID_BinaryDataEnd        VarInt
-	ID_EventTransmission, ID_NodeAttached, ID_NodeDetached                               VarInt
+	ID_EventTransmission, ID_NodeAttached, ID_NodeDetached, ID_CertificateRequest        VarInt
 }
 
-var Packet = packetIDs{0, 1, 2, 3, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+var Packet = packetIDs{0, 1, 2, 3, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
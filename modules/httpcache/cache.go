@@ -0,0 +1,511 @@
+package httpcache
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Shared HTTP cache (RFC 9111) in front of a handler
+
+	GET responses are stored when Cache-Control, Expires or Last-Modified allow
+	it and selected by Vary, Last-Modified alone only for requests without
+	cookies. Stale entries are served while revalidating in the
+	background (stale-while-revalidate) or when the origin fails (stale-if-error),
+	concurrent misses for one URL wait for a single origin request. Responses can
+	be tagged with the Cache-Tag header and purged by URL, prefix or tag.
+*/
+
+const StatusHeader = "Wired-Cache"
+
+type Options struct {
+	Dir           string
+	MemoryLimit   int64
+	DiskLimit     int64
+	MaxObjectSize int64
+	IgnoreHeaders []string                 // per request headers that must never be stored
+	Domain        func(host string) string // groups entries for purging
+}
+
+type Cache struct {
+	opts  Options
+	store *store
+
+	flights   map[string]chan struct{} // primary key -> closed when the origin request is done
+	flightsMu sync.Mutex
+}
+
+type Purge struct {
+	Domain   string
+	URLs     []string
+	Prefixes []string
+	Tags     []string
+}
+
+func New(opts Options) (*Cache, error) {
+	s, err := newStore(opts.Dir, opts.MemoryLimit, opts.DiskLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Domain == nil {
+		opts.Domain = func(host string) string { return host }
+	}
+
+	return &Cache{opts: opts, store: s, flights: make(map[string]chan struct{})}, nil
+}
+
+// NormalizeURL turns "https://Example.com/a?b" and "example.com/a?b" into the form entries are keyed by
+func NormalizeURL(raw string) string {
+	if _, rest, ok := strings.Cut(raw, "://"); ok {
+		raw = rest
+	}
+
+	host, path, _ := strings.Cut(raw, "/")
+	return strings.ToLower(host) + "/" + path
+}
+
+func requestURL(r *http.Request) string {
+	return NormalizeURL(r.Host + r.URL.RequestURI())
+}
+
+func requestHost(r *http.Request) string {
+	host, _, _ := strings.Cut(NormalizeURL(r.Host), "/")
+	if i := strings.LastIndexByte(host, ':'); i != -1 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+
+	return host
+}
+
+// Purge removes the matching entries of a domain on this node
+func (c *Cache) Purge(p Purge) int {
+	urls := make(map[string]bool, len(p.URLs))
+	for _, url := range p.URLs {
+		urls[NormalizeURL(url)] = true
+	}
+
+	prefixes := make([]string, 0, len(p.Prefixes))
+	for _, prefix := range p.Prefixes {
+		prefixes = append(prefixes, NormalizeURL(prefix))
+	}
+
+	return c.store.purge(func(rec *record) bool {
+		if rec.domain != p.Domain {
+			return false
+		}
+
+		if urls[rec.url] {
+			return true
+		}
+
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(rec.url, prefix) {
+				return true
+			}
+		}
+
+		for _, tag := range p.Tags {
+			if slices.Contains(rec.tags, tag) {
+				return true
+			}
+		}
+
+		return false
+	})
+}
+
+func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		// unsafe methods invalidate the target URL (RFC 9111 4.4)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		if r.Method != http.MethodOptions && r.Method != http.MethodTrace && sw.status < 400 {
+			c.store.removePrimary(requestURL(r))
+		}
+		return
+	}
+
+	policy := parseRequestPolicy(r)
+	if policy.noStore || r.Header.Get("Upgrade") != "" || r.Header.Get("Range") != "" {
+		w.Header().Set(StatusHeader, "BYPASS")
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	primary := requestURL(r)
+	entry := c.store.get(primary, r)
+	if entry != nil && !policy.revalidate {
+		stale := entry.staleness(time.Now())
+		if stale <= 0 {
+			c.serve(w, r, entry, "HIT")
+			return
+		}
+
+		if stale <= entry.StaleWhileRevalidate {
+			c.serve(w, r, entry, "STALE")
+			go c.revalidate(r, primary, entry, next)
+			return
+		}
+	}
+
+	if r.Method == http.MethodHead {
+		w.Header().Set(StatusHeader, "MISS")
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	done, leader := c.join(primary)
+	if !leader {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+			return
+		}
+
+		// the leader stored what every waiter can use, otherwise ask the origin ourselves
+		if collapsed := c.store.get(primary, r); collapsed != nil && collapsed.staleness(time.Now()) <= 0 {
+			c.serve(w, r, collapsed, "HIT")
+			return
+		}
+
+		c.fetch(w, r, primary, entry, next)
+		return
+	}
+
+	defer c.leave(primary, done)
+	c.fetch(w, r, primary, entry, next)
+}
+
+func (c *Cache) join(primary string) (chan struct{}, bool) {
+	c.flightsMu.Lock()
+	defer c.flightsMu.Unlock()
+
+	if done, ok := c.flights[primary]; ok {
+		return done, false
+	}
+
+	done := make(chan struct{})
+	c.flights[primary] = done
+	return done, true
+}
+
+func (c *Cache) leave(primary string, done chan struct{}) {
+	c.flightsMu.Lock()
+	delete(c.flights, primary)
+	c.flightsMu.Unlock()
+	close(done)
+}
+
+// revalidate refreshes a stale entry without a client waiting for it
+func (c *Cache) revalidate(r *http.Request, primary string, entry *Entry, next http.Handler) {
+	done, leader := c.join(primary)
+	if !leader {
+		return
+	}
+	defer c.leave(primary, done)
+
+	req := r.Clone(context.Background())
+	req.Body = http.NoBody
+	c.fetch(nil, req, primary, entry, next)
+}
+
+// fetch asks the origin, conditionally when an entry is stored, and stores the response.
+// w is nil for background revalidation
+func (c *Cache) fetch(w http.ResponseWriter, r *http.Request, primary string, entry *Entry, next http.Handler) {
+	req := r
+	conditional := false
+	if entry != nil && r.Header.Get("If-None-Match") == "" && r.Header.Get("If-Modified-Since") == "" {
+		req = r.Clone(r.Context())
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+			conditional = true
+		}
+
+		if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+			conditional = true
+		}
+	}
+
+	requestTime := time.Now()
+	fw := &fetchWriter{
+		client: w,
+		header: make(http.Header),
+		limit:  c.opts.MaxObjectSize,
+		intercept: func(status int) bool {
+			if entry == nil {
+				return false
+			}
+
+			return conditional && status == http.StatusNotModified ||
+				status >= 500 && entry.staleness(time.Now()) <= entry.StaleIfError
+		},
+		buffer: func(status int, header http.Header) bool {
+			return r.Method == http.MethodGet && storable(r, status, header)
+		},
+	}
+
+	next.ServeHTTP(fw, req)
+	if !fw.wroteHeader {
+		fw.WriteHeader(http.StatusOK)
+	}
+
+	responseTime := time.Now()
+	switch {
+	case fw.intercepted && fw.status == http.StatusNotModified:
+		updated := c.refresh(entry, fw.header, requestTime, responseTime)
+		c.store.put(primary, r, updated)
+		if w != nil {
+			c.serve(w, r, updated, "REVALIDATED")
+		}
+	case fw.intercepted:
+		if w != nil {
+			c.serve(w, r, entry, "STALE")
+		}
+	case fw.body != nil:
+		c.store.put(primary, r, c.newEntry(r, fw.status, fw.header, fw.body.Bytes(), requestTime, responseTime))
+	case entry != nil && fw.status < 500 && fw.status != http.StatusNotModified:
+		// the origin doesn't allow storing the new response, don't keep serving the old one
+		c.store.removePrimary(primary)
+	}
+}
+
+func (c *Cache) newEntry(r *http.Request, status int, header http.Header, body []byte, requestTime, responseTime time.Time) *Entry {
+	entry := &Entry{
+		Status:       status,
+		Header:       c.storedHeader(header),
+		Body:         bytes.Clone(body),
+		URL:          requestURL(r),
+		Domain:       c.opts.Domain(requestHost(r)),
+		Tags:         parseTags(header),
+		Vary:         varyHeaders(header),
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+
+	if age, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && age > 0 {
+		entry.InitialAge = time.Duration(age) * time.Second
+	}
+
+	entry.Lifetime, entry.StaleWhileRevalidate, entry.StaleIfError = freshness(entry.Header)
+	return entry
+}
+
+// refresh applies the headers of a 304 to a copy of the stored entry (RFC 9111 4.3.4)
+func (c *Cache) refresh(entry *Entry, header http.Header, requestTime, responseTime time.Time) *Entry {
+	updated := *entry
+	updated.Header = entry.Header.Clone()
+	for name, values := range c.storedHeader(header) {
+		if name == "Content-Length" || name == "Content-Type" || name == "Content-Encoding" {
+			continue
+		}
+
+		updated.Header[name] = values
+	}
+
+	updated.InitialAge = 0
+	if age, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && age > 0 {
+		updated.InitialAge = time.Duration(age) * time.Second
+	}
+
+	updated.RequestTime, updated.ResponseTime = requestTime, responseTime
+	updated.Lifetime, updated.StaleWhileRevalidate, updated.StaleIfError = freshness(updated.Header)
+	return &updated
+}
+
+func (c *Cache) storedHeader(header http.Header) http.Header {
+	stored := header.Clone()
+	for _, name := range hopHeaders {
+		stored.Del(name)
+	}
+
+	for _, name := range c.opts.IgnoreHeaders {
+		stored.Del(name)
+	}
+
+	stored.Del("Age")
+	stored.Del("Content-Length")
+	stored.Del("Cache-Tag")
+	stored.Del(StatusHeader)
+	return stored
+}
+
+func parseTags(header http.Header) []string {
+	var tags []string
+	for _, value := range header.Values("Cache-Tag") {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	return tags
+}
+
+func (c *Cache) serve(w http.ResponseWriter, r *http.Request, entry *Entry, status string) {
+	header := w.Header()
+	for name, values := range entry.Header {
+		header[name] = slices.Clone(values)
+	}
+
+	header.Set("Age", strconv.FormatInt(int64(entry.age(time.Now()).Seconds()), 10))
+	header.Set(StatusHeader, status)
+
+	if entry.Status == http.StatusOK && notModified(r, entry) {
+		header.Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	header.Set("Content-Length", strconv.Itoa(len(entry.Body)))
+	w.WriteHeader(entry.Status)
+	if r.Method != http.MethodHead {
+		w.Write(entry.Body)
+	}
+}
+
+// notModified evaluates the conditional headers of the client against a stored entry
+func notModified(r *http.Request, entry *Entry) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(entry.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	lastModified, err := http.ParseTime(entry.Header.Get("Last-Modified"))
+	return err == nil && !lastModified.After(since)
+}
+
+// fetchWriter forwards the origin response to the client while buffering it for the cache,
+// responses the cache answers itself (304 to our own validators, errors hidden by stale-if-error) are swallowed
+type fetchWriter struct {
+	client    http.ResponseWriter
+	header    http.Header
+	limit     int64
+	intercept func(status int) bool
+	buffer    func(status int, header http.Header) bool
+
+	status      int
+	wroteHeader bool
+	intercepted bool
+	body        *bytes.Buffer
+}
+
+func (fw *fetchWriter) Header() http.Header {
+	return fw.header
+}
+
+func (fw *fetchWriter) WriteHeader(status int) {
+	if fw.wroteHeader {
+		return
+	}
+
+	fw.wroteHeader = true
+	fw.status = status
+	if fw.intercept(status) {
+		fw.intercepted = true
+		return
+	}
+
+	if fw.buffer(status, fw.header) {
+		fw.body = &bytes.Buffer{}
+	}
+
+	if fw.client == nil {
+		return
+	}
+
+	header := fw.client.Header()
+	for name, values := range fw.header {
+		header[name] = values
+	}
+
+	header.Del("Cache-Tag")
+	header.Set(StatusHeader, "MISS")
+	fw.client.WriteHeader(status)
+}
+
+func (fw *fetchWriter) Write(p []byte) (int, error) {
+	if !fw.wroteHeader {
+		fw.WriteHeader(http.StatusOK)
+	}
+
+	if fw.intercepted {
+		return len(p), nil
+	}
+
+	if fw.body != nil {
+		if int64(fw.body.Len()+len(p)) > fw.limit {
+			fw.body = nil
+		} else {
+			fw.body.Write(p)
+		}
+	}
+
+	if fw.client == nil {
+		return len(p), nil
+	}
+
+	return fw.client.Write(p)
+}
+
+func (fw *fetchWriter) Flush() {
+	if flusher, ok := fw.client.(http.Flusher); ok && !fw.intercepted {
+		flusher.Flush()
+	}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,199 @@
+package httpcache
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const heuristicMaxLifetime = 24 * time.Hour
+
+// statuses that may be cached without explicit freshness (RFC 9110 15.1)
+var heuristicStatuses = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// statuses stored when the origin gives explicit freshness
+var explicitStatuses = map[int]bool{302: true, 307: true}
+
+// headers that only apply to a single connection (RFC 9110 7.6.1)
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+type directives map[string]string
+
+func parseCacheControl(header http.Header) directives {
+	d := directives{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name == "" {
+				continue
+			}
+
+			d[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+
+	return d
+}
+
+func (d directives) has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// seconds returns a delta-seconds argument, invalid values count as missing
+func (d directives) seconds(name string) (time.Duration, bool) {
+	arg, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	return time.Duration(n) * time.Second, true
+}
+
+// requestPolicy is what the client asks of the cache
+type requestPolicy struct {
+	noStore    bool // neither serve nor store
+	revalidate bool // don't serve without asking the origin
+}
+
+func parseRequestPolicy(r *http.Request) requestPolicy {
+	cc := parseCacheControl(r.Header)
+	policy := requestPolicy{noStore: cc.has("no-store")}
+
+	if cc.has("no-cache") {
+		policy.revalidate = true
+	} else if maxAge, ok := cc.seconds("max-age"); ok && maxAge == 0 {
+		policy.revalidate = true
+	} else if len(cc) == 0 && strings.Contains(strings.ToLower(r.Header.Get("Pragma")), "no-cache") {
+		policy.revalidate = true
+	}
+
+	return policy
+}
+
+// storable decides whether a shared cache may keep the response (RFC 9111 3)
+func storable(r *http.Request, status int, header http.Header) bool {
+	cc := parseCacheControl(header)
+	if cc.has("no-store") || cc.has("private") {
+		return false
+	}
+
+	// a cookie would be handed to every client
+	if header.Get("Set-Cookie") != "" || slices.Contains(varyHeaders(header), "*") {
+		return false
+	}
+
+	if r.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+
+	// pages requested with cookies may be personalized, they are only stored with explicit freshness
+	_, explicit := explicitLifetime(cc, header)
+	heuristic := header.Get("Last-Modified") != "" && r.Header.Get("Cookie") == ""
+	switch {
+	case heuristicStatuses[status]:
+		return explicit || heuristic
+	case explicitStatuses[status]:
+		return explicit
+	}
+
+	return false
+}
+
+func explicitLifetime(cc directives, header http.Header) (time.Duration, bool) {
+	if cc.has("no-cache") {
+		return 0, true
+	}
+
+	if sMaxAge, ok := cc.seconds("s-maxage"); ok {
+		return sMaxAge, true
+	}
+
+	if maxAge, ok := cc.seconds("max-age"); ok {
+		return maxAge, true
+	}
+
+	if expiresValue := header.Get("Expires"); expiresValue != "" {
+		// invalid dates like "0" mean already expired
+		expires, err := http.ParseTime(expiresValue)
+		if err != nil {
+			return 0, true
+		}
+
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+
+		return max(0, expires.Sub(date)), true
+	}
+
+	return 0, false
+}
+
+// freshness computes the lifetime and stale windows of a stored response (RFC 9111 4.2, RFC 5861)
+func freshness(header http.Header) (lifetime, staleWhileRevalidate, staleIfError time.Duration) {
+	cc := parseCacheControl(header)
+
+	lifetime, ok := explicitLifetime(cc, header)
+	if !ok {
+		lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+		if err == nil {
+			date, err := http.ParseTime(header.Get("Date"))
+			if err != nil {
+				date = time.Now()
+			}
+
+			lifetime = min(heuristicMaxLifetime, max(0, date.Sub(lastModified)/10))
+		}
+	}
+
+	if cc.has("no-cache") || cc.has("must-revalidate") || cc.has("proxy-revalidate") {
+		return lifetime, 0, 0
+	}
+
+	staleWhileRevalidate, _ = cc.seconds("stale-while-revalidate")
+	staleIfError, _ = cc.seconds("stale-if-error")
+	return lifetime, staleWhileRevalidate, staleIfError
+}
+
+// varyHeaders returns the canonical request header names a response varies on
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	return names
+}
+
+// varyValues normalizes the request headers named by vary for the secondary cache key
+func varyValues(r *http.Request, vary []string) string {
+	var b strings.Builder
+	for _, name := range vary {
+		values := r.Header.Values(name)
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(strings.ToLower(strings.Join(values, ",")))
+		b.WriteByte('\n')
+	}
+
+	return b.String()
+}
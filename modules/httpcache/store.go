@@ -0,0 +1,380 @@
+package httpcache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wired/modules/logger"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Entry is a stored response
+type Entry struct {
+	Status       int
+	Header       http.Header
+	Body         []byte
+	URL          string // host + request uri
+	Domain       string
+	Tags         []string
+	Vary         []string
+	InitialAge   time.Duration // Age header of the origin response
+	RequestTime  time.Time
+	ResponseTime time.Time
+
+	Lifetime             time.Duration
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+}
+
+// age is the current_age of RFC 9111 4.2.3
+func (e *Entry) age(now time.Time) time.Duration {
+	apparentAge := time.Duration(0)
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		apparentAge = max(0, e.ResponseTime.Sub(date))
+	}
+
+	correctedAge := e.InitialAge + e.ResponseTime.Sub(e.RequestTime)
+	return max(apparentAge, correctedAge) + now.Sub(e.ResponseTime)
+}
+
+// staleness is how long the entry has been stale, negative while fresh
+func (e *Entry) staleness(now time.Time) time.Duration {
+	return e.age(now) - e.Lifetime
+}
+
+func (e *Entry) size() int64 {
+	size := int64(len(e.Body) + len(e.URL))
+	for name, values := range e.Header {
+		size += int64(len(name))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+
+	return size
+}
+
+type record struct {
+	key     string
+	primary string
+	domain  string
+	url     string
+	tags    []string
+	size    int64
+	entry   *Entry // memory tier, nil when the entry is on disk
+	path    string // disk tier
+	elem    *list.Element
+}
+
+type variants struct {
+	vary []string
+	keys map[string]struct{}
+}
+
+// store keeps entries in a bounded memory LRU, entries evicted from memory and
+// large ones live in a bounded disk LRU below dir/entries
+type store struct {
+	mu       sync.Mutex
+	records  map[string]*record   // primary + vary values -> record
+	variants map[string]*variants // primary -> vary header names
+	memLRU   *list.List
+	diskLRU  *list.List
+	memSize  int64
+	diskSize int64
+
+	dir            string
+	memLimit       int64
+	diskLimit      int64
+	memObjectLimit int64
+	fileSeq        atomic.Uint64
+}
+
+func newStore(dir string, memLimit, diskLimit int64) (*store, error) {
+	// entries purged while the node was down must not come back, only the
+	// directory the cache owns is cleared in case dir is shared or mistyped
+	dir = filepath.Join(dir, "entries")
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &store{
+		records:        make(map[string]*record),
+		variants:       make(map[string]*variants),
+		memLRU:         list.New(),
+		diskLRU:        list.New(),
+		dir:            dir,
+		memLimit:       memLimit,
+		diskLimit:      diskLimit,
+		memObjectLimit: max(1, memLimit/64),
+	}, nil
+}
+
+func secondaryKey(primary string, r *http.Request, vary []string) string {
+	return primary + "\x00" + varyValues(r, vary)
+}
+
+func (s *store) get(primary string, r *http.Request) *Entry {
+	s.mu.Lock()
+	v, ok := s.variants[primary]
+	if !ok {
+		s.mu.Unlock()
+		return nil
+	}
+
+	rec, ok := s.records[secondaryKey(primary, r, v.vary)]
+	if !ok {
+		s.mu.Unlock()
+		return nil
+	}
+
+	if rec.entry != nil {
+		// entries being demoted are in neither LRU
+		if rec.elem != nil {
+			s.memLRU.MoveToFront(rec.elem)
+		}
+
+		entry := rec.entry
+		s.mu.Unlock()
+		return entry
+	}
+
+	s.diskLRU.MoveToFront(rec.elem)
+	path := rec.path
+	s.mu.Unlock()
+
+	entry, err := readEntry(path)
+	if err != nil {
+		// purged or evicted in the meantime
+		return nil
+	}
+
+	if rec.size <= s.memObjectLimit {
+		var demoted []*record
+		s.mu.Lock()
+		if s.records[rec.key] == rec && rec.entry == nil {
+			s.diskLRU.Remove(rec.elem)
+			s.diskSize -= rec.size
+			os.Remove(rec.path)
+
+			rec.entry, rec.path = entry, ""
+			rec.elem = s.memLRU.PushFront(rec)
+			s.memSize += rec.size
+			demoted = s.evictMemory()
+		}
+		s.mu.Unlock()
+
+		s.writeDemoted(demoted)
+	}
+
+	return entry
+}
+
+func (s *store) put(primary string, r *http.Request, entry *Entry) {
+	key := secondaryKey(primary, r, entry.Vary)
+	rec := &record{
+		key:     key,
+		primary: primary,
+		domain:  entry.Domain,
+		url:     entry.URL,
+		tags:    entry.Tags,
+		size:    entry.size(),
+	}
+
+	// large entries are written before taking the lock
+	if rec.size > s.memObjectLimit {
+		path, err := s.writeEntry(key, entry)
+		if err != nil {
+			logger.Println("Failed to write cache entry: ", err)
+			return
+		}
+
+		rec.path = path
+	} else {
+		rec.entry = entry
+	}
+
+	s.mu.Lock()
+	var demoted []*record
+	defer func() {
+		s.mu.Unlock()
+		s.writeDemoted(demoted)
+	}()
+
+	v, ok := s.variants[primary]
+	if !ok || !slices.Equal(v.vary, entry.Vary) {
+		// the origin changed what it varies on, older variants can't be selected anymore
+		if ok {
+			for variantKey := range v.keys {
+				s.remove(s.records[variantKey])
+			}
+		}
+
+		v = &variants{vary: entry.Vary, keys: make(map[string]struct{})}
+		s.variants[primary] = v
+	}
+
+	if old, ok := s.records[key]; ok {
+		s.remove(old)
+		// remove may have dropped the last variant
+		s.variants[primary] = v
+	}
+
+	v.keys[key] = struct{}{}
+	s.records[key] = rec
+
+	if rec.entry != nil {
+		rec.elem = s.memLRU.PushFront(rec)
+		s.memSize += rec.size
+		demoted = s.evictMemory()
+	} else {
+		rec.elem = s.diskLRU.PushFront(rec)
+		s.diskSize += rec.size
+		s.evictDisk()
+	}
+}
+
+// remove drops a record from the index and both tiers, the lock must be held
+func (s *store) remove(rec *record) {
+	if rec == nil || s.records[rec.key] != rec {
+		return
+	}
+
+	delete(s.records, rec.key)
+	if v, ok := s.variants[rec.primary]; ok {
+		delete(v.keys, rec.key)
+		if len(v.keys) == 0 {
+			delete(s.variants, rec.primary)
+		}
+	}
+
+	if rec.entry != nil {
+		// entries being demoted were already taken out of the memory tier
+		if rec.elem != nil {
+			s.memLRU.Remove(rec.elem)
+			s.memSize -= rec.size
+		}
+
+		return
+	}
+
+	s.diskLRU.Remove(rec.elem)
+	s.diskSize -= rec.size
+	os.Remove(rec.path)
+}
+
+// evictMemory takes the least recently used entries out of the memory tier, the lock must be held.
+// They are still served from memory until writeDemoted moved them to disk.
+func (s *store) evictMemory() []*record {
+	var demoted []*record
+	for s.memSize > s.memLimit && s.memLRU.Len() > 0 {
+		rec := s.memLRU.Remove(s.memLRU.Back()).(*record)
+		s.memSize -= rec.size
+		rec.elem = nil
+		demoted = append(demoted, rec)
+	}
+
+	return demoted
+}
+
+// writeDemoted writes entries taken out of memory to disk, the lock must not be held so lookups go on meanwhile
+func (s *store) writeDemoted(demoted []*record) {
+	for _, rec := range demoted {
+		path, err := s.writeEntry(rec.key, rec.entry)
+
+		s.mu.Lock()
+		switch {
+		case s.records[rec.key] != rec:
+			// purged or replaced meanwhile
+			if err == nil {
+				os.Remove(path)
+			}
+		case err != nil:
+			logger.Println("Failed to write cache entry: ", err)
+			s.remove(rec)
+		default:
+			rec.entry, rec.path = nil, path
+			rec.elem = s.diskLRU.PushFront(rec)
+			s.diskSize += rec.size
+			s.evictDisk()
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *store) evictDisk() {
+	for s.diskSize > s.diskLimit && s.diskLRU.Len() > 0 {
+		s.remove(s.diskLRU.Back().Value.(*record))
+	}
+}
+
+// removePrimary removes every variant stored for a URL
+func (s *store) removePrimary(primary string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.variants[primary]; ok {
+		for key := range v.keys {
+			s.remove(s.records[key])
+		}
+	}
+}
+
+// purge removes every record matching, it returns the number of removed entries
+func (s *store) purge(match func(rec *record) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := 0
+	for _, rec := range s.records {
+		if match(rec) {
+			s.remove(rec)
+			purged++
+		}
+	}
+
+	return purged
+}
+
+// writeEntry stores an entry in its own file, names are unique so readers never see partial files
+func (s *store) writeEntry(key string, entry *Entry) (string, error) {
+	data, err := cbor.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:]) + "." + strconv.FormatUint(s.fileSeq.Add(1), 10)
+	path := filepath.Join(s.dir, name[:2], name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+
+	return path, os.WriteFile(path, data, 0600)
+}
+
+func readEntry(path string) (*Entry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entry Entry
+	if err := cbor.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
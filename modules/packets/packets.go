@@ -23,3 +23,9 @@ type EventTransmission struct {
 	EventBusName string
 	Event        event.Event
 }
+
+// CertificateRequest asks the master for the certificate bundles a node misses
+type CertificateRequest struct {
+	Names    []string         // only bundles covering these names, all when empty
+	Versions map[string]int64 // bundle name -> version the node holds
+}
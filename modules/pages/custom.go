@@ -0,0 +1,33 @@
+package pages
+
+import (
+	"html"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CustomCodes are the pages users can replace with their own html
+var CustomCodes = []int{403, 429, 502, 504, 605}
+
+// Vars are substituted into custom pages as {{status}}, {{request_id}}, {{node}}, {{client_ip}} and {{timestamp}}
+type Vars struct {
+	Status    int
+	RequestId string
+	Node      string
+	ClientIP  string
+	Time      time.Time
+}
+
+// RenderCustom fills the variables of a custom page, values are html escaped
+func RenderCustom(page string, vars Vars) []byte {
+	replacer := strings.NewReplacer(
+		"{{status}}", strconv.Itoa(vars.Status),
+		"{{request_id}}", html.EscapeString(vars.RequestId),
+		"{{node}}", html.EscapeString(vars.Node),
+		"{{client_ip}}", html.EscapeString(vars.ClientIP),
+		"{{timestamp}}", vars.Time.UTC().Format(time.RFC3339),
+	)
+
+	return []byte(replacer.Replace(page))
+}
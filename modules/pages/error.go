@@ -25,6 +25,14 @@ var ErrorPages = map[int]ErrorPageTemplate{
 		},
 		Html: nil,
 	},
+	429: {
+		Code: 429,
+		Messages: []string{
+			"You are sending too many requests to this website.",
+			"Please wait a moment before trying again.",
+		},
+		Html: nil,
+	},
 	500: {
 		Code: 500,
 		Messages: []string{
@@ -0,0 +1,71 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// SetErrorPage stores the custom html of an error page, empty html removes it
+func SetErrorPage(userId string, code int, html string) error {
+	conn := Manager.GetPool("users")
+	if conn == nil {
+		return errors.New("no DB connection available for users")
+	}
+
+	var err error
+	if html == "" {
+		_, err = conn.Exec(context.Background(), `DELETE FROM error_pages WHERE user_id=$1 AND code=$2`, userId, code)
+	} else {
+		_, err = conn.Exec(context.Background(),
+			`INSERT INTO error_pages (user_id, code, html) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, code) DO UPDATE SET html = EXCLUDED.html`,
+			userId, code, html)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to store error page %d for user %s: %v", code, userId, err)
+	}
+
+	CacheErrorPage(userId, code, html)
+	return nil
+}
+
+// CacheErrorPage updates the pages of an already loaded user, used for changes made on other nodes
+func CacheErrorPage(userId string, code int, html string) {
+	UsersMu.Lock()
+	defer UsersMu.Unlock()
+
+	user, ok := Users[userId]
+	if !ok {
+		return
+	}
+
+	// the map may be shared with copies handed out by GetUser
+	pages := make(map[int]string, len(user.ErrorPages)+1)
+	for c, page := range user.ErrorPages {
+		pages[c] = page
+	}
+
+	if html == "" {
+		delete(pages, code)
+	} else {
+		pages[code] = html
+	}
+
+	user.ErrorPages = pages
+}
+
+// CachedErrorPage returns a custom error page of a loaded user without querying the DB
+func CachedErrorPage(userId string, code int) (string, bool) {
+	UsersMu.RLock()
+	defer UsersMu.RUnlock()
+
+	user, ok := Users[userId]
+	if !ok {
+		return "", false
+	}
+
+	page, ok := user.ErrorPages[code]
+	return page, ok
+}
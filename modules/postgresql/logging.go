@@ -1,10 +1,17 @@
 package postgresql
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
 )
 
 type HTTPRequestLog struct {
+	RequestId            string          `json:"request_id"`
+	Domain               string          `json:"domain"`
 	RequestTime          int64           `json:"request_time"`
 	ClientIP             string          `json:"client_ip"`
 	Method               string          `json:"method"`
@@ -15,22 +22,115 @@ type HTTPRequestLog struct {
 	ResponseHeaders      json.RawMessage `json:"response_headers"`
 	ResponseStatusOrigin int             `json:"response_status_origin"`
 	ResponseStatusProxy  int             `json:"response_status_proxy"`
-	ResponseTime         int64           `json:"response_time"`
+	ResponseTime         int64           `json:"response_time"` // microseconds
 	TLSVersion           string          `json:"tls_version"`
 	RequestSize          int64           `json:"request_size"`
 	ResponseSize         int64           `json:"response_size"`
 	RequestHTTPVersion   string          `json:"request_http_version"`
 	ClientCountry        string          `json:"client_country"`
+	Node                 string          `json:"node"`
 }
 
 type DNSRequestLog struct {
 	QueryTime     int64  `json:"query_time"`
 	ClientIP      string `json:"client_ip"`
+	ECSSubnet     string `json:"ecs_subnet"`
 	QueryName     string `json:"query_name"`
 	QueryType     string `json:"query_type"`
 	QueryClass    string `json:"query_class"`
+	Zone          string `json:"zone"`
 	ResponseCode  string `json:"response_code"`
-	ResponseTime  int64  `json:"response_time"`
+	ResponseTime  int64  `json:"response_time"` // microseconds
 	IsSuccessful  bool   `json:"is_successful"`
 	ClientCountry string `json:"client_country"`
+	Node          string `json:"node"`
+}
+
+var dnsRequestLogColumns = []string{
+	"query_time", "client_ip", "ecs_subnet", "query_name", "query_type", "query_class", "zone",
+	"response_code", "response_time", "is_successful", "client_country", "node",
+}
+
+// InsertDNSRequestLogs batch-inserts query logs into the logs DB
+func InsertDNSRequestLogs(ctx context.Context, logs []DNSRequestLog) error {
+	conn := Manager.GetPool("logs")
+	if conn == nil {
+		return errors.New("no DB connection available for logs")
+	}
+
+	rows := make([][]interface{}, 0, len(logs))
+	for _, l := range logs {
+		rows = append(rows, []interface{}{
+			l.QueryTime, l.ClientIP, l.ECSSubnet, l.QueryName, l.QueryType, l.QueryClass, l.Zone,
+			l.ResponseCode, l.ResponseTime, l.IsSuccessful, l.ClientCountry, l.Node,
+		})
+	}
+
+	_, err := conn.CopyFrom(ctx, pgx.Identifier{"dns_request_logs"}, dnsRequestLogColumns, pgx.CopyFromRows(rows))
+	return err
+}
+
+var httpRequestLogColumns = []string{
+	"request_id", "domain", "request_time", "client_ip", "method", "host", "path", "query_params",
+	"request_headers", "response_headers", "response_status_origin", "response_status_proxy",
+	"response_time", "tls_version", "request_size", "response_size", "request_http_version",
+	"client_country", "node",
+}
+
+// InsertHTTPRequestLogs batch-inserts access logs into the logs DB
+func InsertHTTPRequestLogs(ctx context.Context, logs []HTTPRequestLog) error {
+	conn := Manager.GetPool("logs")
+	if conn == nil {
+		return errors.New("no DB connection available for logs")
+	}
+
+	rows := make([][]interface{}, 0, len(logs))
+	for _, l := range logs {
+		rows = append(rows, []interface{}{
+			l.RequestId, l.Domain, l.RequestTime, l.ClientIP, l.Method, l.Host, l.Path, l.QueryParams,
+			l.RequestHeaders, l.ResponseHeaders, l.ResponseStatusOrigin, l.ResponseStatusProxy,
+			l.ResponseTime, l.TLSVersion, l.RequestSize, l.ResponseSize, l.RequestHTTPVersion,
+			l.ClientCountry, l.Node,
+		})
+	}
+
+	_, err := conn.CopyFrom(ctx, pgx.Identifier{"http_request_logs"}, httpRequestLogColumns, pgx.CopyFromRows(rows))
+	return err
+}
+
+// GetHTTPRequestLogs returns the newest access logs of a domain older than before (unix ms, 0 -> now)
+func GetHTTPRequestLogs(ctx context.Context, domain string, before int64, limit int) ([]HTTPRequestLog, error) {
+	conn := Manager.GetPool("logs")
+	if conn == nil {
+		return nil, errors.New("no DB connection available for logs")
+	}
+
+	query := `SELECT request_id, domain, request_time, client_ip, method, host, path, query_params,
+		request_headers, response_headers, response_status_origin, response_status_proxy,
+		response_time, tls_version, request_size, response_size, request_http_version,
+		client_country, node
+		FROM http_request_logs WHERE domain=$1 AND ($2 = 0 OR request_time < $2)
+		ORDER BY request_time DESC LIMIT $3`
+
+	rows, err := conn.Query(ctx, query, domain, before, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query http logs of %s: %v", domain, err)
+	}
+	defer rows.Close()
+
+	logs := []HTTPRequestLog{}
+	for rows.Next() {
+		var l HTTPRequestLog
+		err := rows.Scan(&l.RequestId, &l.Domain, &l.RequestTime, &l.ClientIP, &l.Method, &l.Host, &l.Path, &l.QueryParams,
+			&l.RequestHeaders, &l.ResponseHeaders, &l.ResponseStatusOrigin, &l.ResponseStatusProxy,
+			&l.ResponseTime, &l.TLSVersion, &l.RequestSize, &l.ResponseSize, &l.RequestHTTPVersion,
+			&l.ClientCountry, &l.Node)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan http logs of %s: %v", domain, err)
+		}
+
+		logs = append(logs, l)
+	}
+
+	return logs, rows.Err()
 }
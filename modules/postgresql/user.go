@@ -44,6 +44,7 @@ func CreateOrUpdateUser(user *types.User) error {
 		Avatar:        user.Avatar,
 		WorkerScripts: []workers.WorkerScript{},
 		ErrorPages:    map[int]string{},
+		WAFRules:      map[string]string{},
 		CreatedAt:     time.Now(),
 	}
 
@@ -110,6 +111,7 @@ func GetUser(user *types.User) error {
 	}
 	defer errRows.Close()
 
+	user.ErrorPages = map[int]string{}
 	for errRows.Next() {
 		var code int
 		var html string
@@ -121,6 +123,23 @@ func GetUser(user *types.User) error {
 		user.ErrorPages[code] = html
 	}
 
+	wafRows, err := conn.Query(context.Background(), `SELECT domain, rules FROM waf_rules WHERE user_id=$1`, user.Id)
+	if err != nil {
+		return fmt.Errorf("failed to query waf rules for user %s (%s): %v", user.Username, user.Id, err)
+	}
+	defer wafRows.Close()
+
+	user.WAFRules = map[string]string{}
+	for wafRows.Next() {
+		var domain, rules string
+		err := wafRows.Scan(&domain, &rules)
+		if err != nil {
+			return fmt.Errorf("failed to scan waf rules for user %s (%s): %v", user.Username, user.Id, err)
+		}
+
+		user.WAFRules[domain] = rules
+	}
+
 	Users[user.Id] = user
 	return nil
 }
@@ -0,0 +1,57 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// SetWAFRules stores the firewall rules of a domain, empty rules remove them
+func SetWAFRules(userId, domain, rules string) error {
+	conn := Manager.GetPool("users")
+	if conn == nil {
+		return errors.New("no DB connection available for users")
+	}
+
+	var err error
+	if rules == "" {
+		_, err = conn.Exec(context.Background(), `DELETE FROM waf_rules WHERE user_id=$1 AND domain=$2`, userId, domain)
+	} else {
+		_, err = conn.Exec(context.Background(),
+			`INSERT INTO waf_rules (user_id, domain, rules) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, domain) DO UPDATE SET rules = EXCLUDED.rules`,
+			userId, domain, rules)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to store waf rules of %s for user %s: %v", domain, userId, err)
+	}
+
+	CacheWAFRules(userId, domain, rules)
+	return nil
+}
+
+// CacheWAFRules updates the rules of an already loaded user, used for changes made on other nodes
+func CacheWAFRules(userId, domain, rules string) {
+	UsersMu.Lock()
+	defer UsersMu.Unlock()
+
+	user, ok := Users[userId]
+	if !ok {
+		return
+	}
+
+	// the map may be shared with copies handed out by GetUser
+	wafRules := make(map[string]string, len(user.WAFRules)+1)
+	for d, r := range user.WAFRules {
+		wafRules[d] = r
+	}
+
+	if rules == "" {
+		delete(wafRules, domain)
+	} else {
+		wafRules[domain] = rules
+	}
+
+	user.WAFRules = wafRules
+}
@@ -0,0 +1,153 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"wired/modules/globals"
+)
+
+/*
+	Binary transfers
+
+	Payloads larger than a packet should carry are split into ID_BinaryData
+	chunks and closed by ID_BinaryDataEnd with the chunk count and a SHA-256
+	of the whole payload. Chunks of different transfers may interleave on a
+	connection, the transfer id keeps them apart. Kind tells the receiver what
+	the payload is, e.g. "certificate_bundle".
+*/
+
+const (
+	BinaryChunkSize    = 32 * 1024
+	MaxBinarySize      = 16 * 1024 * 1024
+	maxBinaryTransfers = 16 // unfinished transfers per connection
+)
+
+type BinaryData struct {
+	TransferID string
+	Index      int
+	Data       []byte
+}
+
+type BinaryDataEnd struct {
+	TransferID string
+	Kind       string
+	Chunks     int
+	Hash       []byte // SHA-256 of the payload
+}
+
+type binaryTransfer struct {
+	next int
+	data bytes.Buffer
+}
+
+var (
+	binaryTransfers   = make(map[*Conn]map[string]*binaryTransfer)
+	binaryTransfersMu sync.Mutex
+)
+
+// SendBinary sends a payload in chunks, concurrent packets on the connection may interleave
+func (c *Conn) SendBinary(kind string, payload []byte) error {
+	if len(payload) > MaxBinarySize {
+		return fmt.Errorf("binary payload of %d bytes exceeds %d bytes", len(payload), MaxBinarySize)
+	}
+
+	transferID := RandomUUID()
+	chunks := 0
+	for offset := 0; offset < len(payload) || chunks == 0; offset += BinaryChunkSize {
+		err := c.SendPacket(globals.Packet.ID_BinaryData, BinaryData{
+			TransferID: transferID,
+			Index:      chunks,
+			Data:       payload[offset:min(offset+BinaryChunkSize, len(payload))],
+		})
+		if err != nil {
+			return err
+		}
+
+		chunks++
+	}
+
+	hash := sha256.Sum256(payload)
+	return c.SendPacket(globals.Packet.ID_BinaryDataEnd, BinaryDataEnd{
+		TransferID: transferID,
+		Kind:       kind,
+		Chunks:     chunks,
+		Hash:       hash[:],
+	})
+}
+
+// ReceiveBinaryChunk appends an ID_BinaryData packet to its transfer
+func ReceiveBinaryChunk(conn *Conn, p *Packet) error {
+	var chunk BinaryData
+	if err := DecodePacket(p.Data, &chunk); err != nil {
+		return err
+	}
+
+	binaryTransfersMu.Lock()
+	defer binaryTransfersMu.Unlock()
+
+	transfers, ok := binaryTransfers[conn]
+	if !ok {
+		transfers = make(map[string]*binaryTransfer)
+		binaryTransfers[conn] = transfers
+	}
+
+	transfer, ok := transfers[chunk.TransferID]
+	if !ok {
+		if len(transfers) >= maxBinaryTransfers {
+			return errors.New("too many unfinished binary transfers")
+		}
+
+		transfer = &binaryTransfer{}
+		transfers[chunk.TransferID] = transfer
+	}
+
+	if chunk.Index != transfer.next || transfer.data.Len()+len(chunk.Data) > MaxBinarySize {
+		delete(transfers, chunk.TransferID)
+		return fmt.Errorf("invalid chunk %d of binary transfer %s", chunk.Index, chunk.TransferID)
+	}
+
+	transfer.data.Write(chunk.Data)
+	transfer.next++
+	return nil
+}
+
+// FinishBinary completes a transfer with its ID_BinaryDataEnd packet and returns the kind and payload
+func FinishBinary(conn *Conn, p *Packet) (string, []byte, error) {
+	var end BinaryDataEnd
+	if err := DecodePacket(p.Data, &end); err != nil {
+		return "", nil, err
+	}
+
+	binaryTransfersMu.Lock()
+	transfer, ok := binaryTransfers[conn][end.TransferID]
+	delete(binaryTransfers[conn], end.TransferID)
+	if len(binaryTransfers[conn]) == 0 {
+		delete(binaryTransfers, conn)
+	}
+	binaryTransfersMu.Unlock()
+
+	if !ok {
+		return "", nil, fmt.Errorf("unknown binary transfer %s", end.TransferID)
+	}
+
+	if transfer.next != end.Chunks {
+		return "", nil, fmt.Errorf("binary transfer %s ended after %d of %d chunks", end.TransferID, transfer.next, end.Chunks)
+	}
+
+	payload := transfer.data.Bytes()
+	if hash := sha256.Sum256(payload); !bytes.Equal(hash[:], end.Hash) {
+		return "", nil, fmt.Errorf("binary transfer %s does not match its hash", end.TransferID)
+	}
+
+	return end.Kind, payload, nil
+}
+
+// DropBinaryTransfers forgets the unfinished transfers of a closed connection
+func DropBinaryTransfers(conn *Conn) {
+	binaryTransfersMu.Lock()
+	delete(binaryTransfers, conn)
+	binaryTransfersMu.Unlock()
+}
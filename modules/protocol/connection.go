@@ -9,6 +9,7 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 	"wired/modules/globals"
 )
@@ -27,6 +28,7 @@ type Conn struct {
 	conn    net.Conn
 	r       io.Reader
 	w       io.Writer
+	writeMu sync.Mutex // packets are written in two parts and must not interleave
 }
 
 var MasterConn *Conn
@@ -125,6 +127,8 @@ func (c *Conn) SendPacket(id globals.VarInt, packet any) error {
 	}
 
 	//assemble and send packet
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	_, err = (&Packet{
 		ID:   id,
 		Data: data,
@@ -134,6 +138,9 @@ func (c *Conn) SendPacket(id globals.VarInt, packet any) error {
 }
 
 func (c *Conn) SendRawPacket(id globals.VarInt, packet []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
 	_, err := (&Packet{
 		ID:   id,
 		Data: packet,
@@ -0,0 +1,156 @@
+package ssl
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	ACME Renewal Information (RFC 9773)
+
+	The directory lists a renewalInfo URL, GET <renewalInfo>/<cert id> returns
+	the window the CA suggests renewing the certificate in. The cert id is
+	base64url(authority key id) "." base64url(serial number). Retry-After
+	tells when to ask again, the window may move earlier if the CA has to
+	revoke certificates.
+*/
+
+const ariDefaultRetry = 6 * time.Hour
+
+var errARIUnsupported = errors.New("the ACME directory has no renewalInfo")
+
+type renewalInfo struct {
+	SuggestedWindow struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+	} `json:"suggestedWindow"`
+	ExplanationURL string        `json:"explanationURL"`
+	RetryAfter     time.Duration `json:"-"`
+}
+
+var (
+	renewalInfoURL   string
+	renewalInfoMu    sync.Mutex
+	renewalInfoKnown bool
+)
+
+// ariCertID returns the ARI identifier of a certificate
+func ariCertID(leaf *x509.Certificate) (string, error) {
+	if len(leaf.AuthorityKeyId) == 0 {
+		return "", errors.New("certificate has no authority key id")
+	}
+
+	// DER encoding of a positive INTEGER, a set high bit needs a leading zero
+	serial := leaf.SerialNumber.Bytes()
+	if len(serial) == 0 || serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(leaf.AuthorityKeyId) + "." + base64.RawURLEncoding.EncodeToString(serial), nil
+}
+
+// ariEndpoint returns the renewalInfo URL of the directory, read once
+func ariEndpoint(ctx context.Context) (string, *http.Client, error) {
+	client, err := getClient()
+	if err != nil {
+		return "", nil, err
+	}
+
+	httpClient := client.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	renewalInfoMu.Lock()
+	defer renewalInfoMu.Unlock()
+
+	if !renewalInfoKnown {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, client.DirectoryURL, nil)
+		if err != nil {
+			return "", nil, err
+		}
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return "", nil, err
+		}
+		defer resp.Body.Close()
+
+		var directory struct {
+			RenewalInfo string `json:"renewalInfo"`
+		}
+
+		if err := json.NewDecoder(resp.Body).Decode(&directory); err != nil {
+			return "", nil, fmt.Errorf("failed to read ACME directory: %w", err)
+		}
+
+		renewalInfoURL, renewalInfoKnown = directory.RenewalInfo, true
+	}
+
+	if renewalInfoURL == "" {
+		return "", nil, errARIUnsupported
+	}
+
+	return renewalInfoURL, httpClient, nil
+}
+
+// fetchRenewalInfo asks the CA when to renew a certificate
+func fetchRenewalInfo(ctx context.Context, leaf *x509.Certificate) (*renewalInfo, error) {
+	certID, err := ariCertID(leaf)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, httpClient, err := ariEndpoint(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(endpoint, "/")+"/"+certID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("renewal info returned %s", resp.Status)
+	}
+
+	info := &renewalInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, fmt.Errorf("invalid renewal info: %w", err)
+	}
+
+	if info.SuggestedWindow.Start.IsZero() || info.SuggestedWindow.End.Before(info.SuggestedWindow.Start) {
+		return nil, errors.New("invalid renewal info window")
+	}
+
+	info.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	return info, nil
+}
+
+// parseRetryAfter reads seconds or an HTTP date, clamped to a minute and a day
+func parseRetryAfter(value string) time.Duration {
+	retryAfter := ariDefaultRetry
+	if seconds, err := strconv.Atoi(value); err == nil {
+		retryAfter = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		retryAfter = time.Until(date)
+	}
+
+	return min(max(retryAfter, time.Minute), 24*time.Hour)
+}
@@ -2,6 +2,9 @@ package ssl
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -10,127 +13,167 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"time"
+	"wired/modules/certstore"
+	"wired/modules/env"
 	"wired/modules/logger"
 
 	"golang.org/x/crypto/acme"
 )
 
+var ctx = context.Background()
+
+/*
+	Every name gets an RSA and an ECDSA certificate, clients supporting ECDSA
+	get the smaller chain. The ECDSA one sits next to the RSA one with an
+	".ecdsa" suffix (certs/san_<id>.ecdsa.crt), keys are written as PKCS#8.
+	SSL_ECDSA_CURVE picks P-256 (default) or P-384.
+*/
+
+const ecdsaSuffix = ".ecdsa"
+
+// orderInterval paces orders below Let's Encrypt's limit (300 orders / 3h = 1 order / 36s)
+const orderInterval = 36 * time.Second
+
 var (
-	client *acme.Client
-	ctx    = context.Background()
+	lastOrder time.Time
+	orderMu   sync.Mutex
 )
 
-func init() {
-	client = getClient()
-	if client == nil {
-		logger.Println("Failed to initialize ACME client")
-		return
-	}
-}
-
-func GenerateSANCertificate(domains []string) (time.Time, time.Time, error) {
-	logger.Printf("Generating SAN certificate for %v\n", domains)
+// waitForOrder blocks until the next order may be placed
+func waitForOrder() {
+	orderMu.Lock()
+	defer orderMu.Unlock()
 
-	certPEM, keyPEM, err := prepareCertificate(domains)
-	if err != nil {
-		return time.Time{}, time.Time{}, err
+	if wait := time.Until(lastOrder.Add(orderInterval)); wait > 0 {
+		time.Sleep(wait)
 	}
 
-	domainList := make([]string, 0, len(domains))
-	for _, domain := range domains {
-		domainList = append(domainList, domain)
-	}
+	lastOrder = time.Now()
+}
 
-	batchID := generateBatchID(domainList)
-	certFile := fmt.Sprintf("certs/san_%s.crt", batchID)
-	keyFile := fmt.Sprintf("certs/san_%s.key", batchID)
+// nameError attributes the failure of an order to one of its names
+type nameError struct {
+	name string
+	err  error
+}
 
-	if err := os.MkdirAll("certs", 0755); err != nil {
-		return time.Time{}, time.Time{}, err
-	}
+func (e *nameError) Error() string { return e.err.Error() }
+func (e *nameError) Unwrap() error { return e.err }
 
-	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
-		return time.Time{}, time.Time{}, err
-	}
+type certificateKey struct {
+	suffix string
+	key    crypto.Signer
+}
 
-	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
-		os.Remove(certFile)
-		return time.Time{}, time.Time{}, err
+// newCertificateKeys generates the keys of the certificates issued per name
+func newCertificateKeys() ([]certificateKey, error) {
+	var curve elliptic.Curve
+	switch strings.ToUpper(env.GetEnv("SSL_ECDSA_CURVE", "P-256")) {
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-256":
+		curve = elliptic.P256()
+	default:
+		return nil, errors.New("SSL_ECDSA_CURVE must be P-256 or P-384")
 	}
 
-	block, _ := pem.Decode(certPEM)
-	cert, err := x509.ParseCertificate(block.Bytes)
+	ecdsaKey, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {
-		return time.Time{}, time.Time{}, err
+		return nil, err
 	}
 
-	for _, domain := range domains {
-		oldCert := fmt.Sprintf("certs/%s.crt", domain)
-		oldKey := fmt.Sprintf("certs/%s.key", domain)
-		os.Remove(oldCert)
-		os.Remove(oldKey)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
 	}
 
-	return cert.NotBefore, cert.NotAfter, nil
+	return []certificateKey{{suffix: ecdsaSuffix, key: ecdsaKey}, {suffix: "", key: rsaKey}}, nil
 }
 
-func GenerateCertificate(domains []string) (time.Time, time.Time, error) {
-	logger.Println("Generating SSL certificate for ", domains)
-
-	certPEM, keyPEM, err := prepareCertificate(domains)
+// issueCertificates orders the certificates of the names and writes them to base + suffix + .crt/.key
+func issueCertificates(domains []string, base string) (time.Time, time.Time, error) {
+	keys, err := newCertificateKeys()
 	if err != nil {
-		logger.Println("Failed to generate certificate: ", err.Error())
 		return time.Time{}, time.Time{}, err
 	}
 
-	domainList := make([]string, 0, len(domains))
-	for _, domain := range domains {
-		domainList = append(domainList, domain)
+	if err := os.MkdirAll("certs", 0755); err != nil {
+		return time.Time{}, time.Time{}, err
 	}
 
-	batchID := generateBatchID(domainList)
-	certFile := fmt.Sprintf("certs/%s.crt", batchID)
-	keyFile := fmt.Sprintf("certs/%s.key", batchID)
+	var issuedAt, expiresAt time.Time
+	for _, certKey := range keys {
+		certPEM, keyPEM, err := prepareCertificate(domains, certKey.key)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+
+		block, _ := pem.Decode(certPEM)
+		if block == nil {
+			return time.Time{}, time.Time{}, errors.New("failed to decode PEM block for certificate")
+		}
 
-	if _, err := os.Stat("certs"); os.IsNotExist(err) {
-		err := os.Mkdir("certs", 0755)
+		cert, err := x509.ParseCertificate(block.Bytes)
 		if err != nil {
-			logger.Println("Failed to create certs directory: ", err)
 			return time.Time{}, time.Time{}, err
 		}
+
+		certFile := base + certKey.suffix + ".crt"
+		if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+
+		if err := os.WriteFile(base+certKey.suffix+".key", keyPEM, 0600); err != nil {
+			os.Remove(certFile)
+			return time.Time{}, time.Time{}, err
+		}
+
+		// the record shows the certificate expiring first
+		if expiresAt.IsZero() || cert.NotAfter.Before(expiresAt) {
+			issuedAt, expiresAt = cert.NotBefore, cert.NotAfter
+		}
 	}
 
-	writer, err := os.Create(certFile)
+	return issuedAt, expiresAt, nil
+}
+
+func GenerateSANCertificate(domains []string) (time.Time, time.Time, error) {
+	logger.Printf("Generating SAN certificate for %v\n", domains)
+
+	// the master only accepts bundles named after their names
+	issuedAt, expiresAt, err := issueCertificates(domains, fmt.Sprintf("certs/%s", certstore.BatchName(domains)))
 	if err != nil {
-		logger.Println("Failed to create cert file: ", err)
 		return time.Time{}, time.Time{}, err
 	}
-	defer writer.Close()
-	writer.Write(certPEM)
 
-	writer, err = os.Create(keyFile)
-	if err != nil {
-		logger.Println("failed to create key file: ", err)
-		return time.Time{}, time.Time{}, err
+	for _, domain := range domains {
+		for _, suffix := range []string{"", ecdsaSuffix} {
+			os.Remove(fmt.Sprintf("certs/%s%s.crt", domain, suffix))
+			os.Remove(fmt.Sprintf("certs/%s%s.key", domain, suffix))
+		}
 	}
-	defer writer.Close()
-	writer.Write(keyPEM)
 
-	block, _ := pem.Decode(certPEM)
-	if block == nil {
-		logger.Println("Failed to decode PEM block for certificate")
-		return time.Time{}, time.Time{}, errors.New("failed to decode PEM block for certificate")
+	return issuedAt, expiresAt, nil
+}
+
+func GenerateCertificate(domains []string) (time.Time, time.Time, error) {
+	logger.Println("Generating SSL certificate for ", domains)
+
+	domainList := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		domainList = append(domainList, domain)
 	}
 
-	cert, err := x509.ParseCertificate(block.Bytes)
+	batchID := generateBatchID(domainList)
+	issuedAt, expirationTime, err := issueCertificates(domains, fmt.Sprintf("certs/%s", batchID))
 	if err != nil {
-		logger.Println("Failed to parse certificate:", err)
+		logger.Println("Failed to generate certificate: ", err.Error())
 		return time.Time{}, time.Time{}, err
 	}
 
-	expirationTime := cert.NotAfter
-	issuedAt := cert.NotBefore
 	renewalTime := expirationTime.Add(-7 * 24 * time.Hour)
 
 	for _, domain := range domains {
@@ -145,9 +188,13 @@ func GenerateCertificate(domains []string) (time.Time, time.Time, error) {
 	return issuedAt, expirationTime, nil
 }
 
-func prepareCertificate(domains []string) ([]byte, []byte, error) {
-	if client == nil {
-		return nil, nil, errors.New("failed to get ACME client")
+// prepareCertificate orders a certificate of the names for the key, returning the chain and the PKCS#8 key
+func prepareCertificate(domains []string, certKey crypto.Signer) ([]byte, []byte, error) {
+	waitForOrder()
+
+	client, err := getClient()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get ACME client: %w", err)
 	}
 
 	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
@@ -161,9 +208,8 @@ func prepareCertificate(domains []string) ([]byte, []byte, error) {
 			return nil, nil, err
 		}
 
-		domain := authz.Identifier.Value
-		if err := dns01Handling(domains, authzURL); err != nil {
-			return nil, nil, fmt.Errorf("DNS challenge failed for %s: %w", domain, err)
+		if err := dns01Handling(client, authz); err != nil {
+			return nil, nil, &nameError{name: authz.Identifier.Value, err: fmt.Errorf("DNS challenge failed for %s: %w", authz.Identifier.Value, err)}
 		}
 	}
 
@@ -172,11 +218,6 @@ func prepareCertificate(domains []string) ([]byte, []byte, error) {
 		return nil, nil, err
 	}
 
-	certKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return nil, nil, err
-	}
-
 	csr, err := createCSR(domains, certKey)
 	if err != nil {
 		return nil, nil, err
@@ -195,15 +236,20 @@ func prepareCertificate(domains []string) ([]byte, []byte, error) {
 		})...)
 	}
 
+	keyDER, err := x509.MarshalPKCS8PrivateKey(certKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	keyPEM := pem.EncodeToMemory(&pem.Block{
 		Type:  "PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(certKey),
+		Bytes: keyDER,
 	})
 
 	return certPEM, keyPEM, nil
 }
 
-func createCSR(domains []string, key *rsa.PrivateKey) ([]byte, error) {
+func createCSR(domains []string, key crypto.Signer) ([]byte, error) {
 	tmpl := x509.CertificateRequest{
 		DNSNames: domains,
 		Subject:  pkix.Name{CommonName: domains[0]},
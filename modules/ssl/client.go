@@ -4,41 +4,96 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
+	"fmt"
 	"os"
+	"sync"
 	"wired/modules/logger"
 
 	"golang.org/x/crypto/acme"
 )
 
-func getClient() *acme.Client {
+var (
+	client   *acme.Client
+	clientMu sync.Mutex
+)
+
+// accountFile returns where the account key for a directory is kept, Let's Encrypt keeps the original file
+func accountFile(config *ACMEConfig) string {
+	if config.Name == "" {
+		return "ssl_client_key.json"
+	}
+
+	return fmt.Sprintf("ssl_client_key_%s.json", config.Name)
+}
+
+// getClient returns the registered ACME client, registering on first use
+func getClient() (*acme.Client, error) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+
+	if client != nil {
+		return client, nil
+	}
+
+	config, err := loadACMEConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	newClient, err := registerClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	client = newClient
+	return client, nil
+}
+
+func registerClient(config *ACMEConfig) (*acme.Client, error) {
 	sslClient := &SSLClient{}
+	keyFile := accountFile(config)
 
-	if _, err := os.Stat("ssl_client_key.json"); err == nil {
-		sslClient.loadKey()
+	if _, err := os.Stat(keyFile); err == nil {
+		if err := sslClient.loadKey(keyFile); err != nil {
+			return nil, err
+		}
 	} else {
 		accountKey, err := rsa.GenerateKey(rand.Reader, 2048)
 		if err != nil {
-			logger.Fatal("Failed to generate account key: ", err)
+			return nil, fmt.Errorf("failed to generate account key: %w", err)
 		}
 
 		sslClient.Key = accountKey
-		sslClient.DirectoryURL = acme.LetsEncryptURL
-		sslClient.saveKey()
+		sslClient.DirectoryURL = config.DirectoryURL
+		if err := sslClient.saveKey(keyFile); err != nil {
+			return nil, err
+		}
 	}
 
-	client := &acme.Client{
+	acmeClient := &acme.Client{
 		Key:          sslClient.Key,
-		DirectoryURL: sslClient.DirectoryURL,
+		DirectoryURL: config.DirectoryURL,
+		HTTPClient:   config.HTTPClient,
+		UserAgent:    "wired",
+	}
+
+	account := &acme.Account{Contact: config.Contact}
+	if config.EABKeyID != "" {
+		account.ExternalAccountBinding = &acme.ExternalAccountBinding{
+			KID: config.EABKeyID,
+			Key: config.EABKey,
+		}
 	}
 
-	_, err := client.Register(context.Background(), &acme.Account{
-		Contact: []string{"mailto:ssl@wired.rip"},
-	}, func(tosURL string) bool {
-		return true
+	_, err := acmeClient.Register(context.Background(), account, func(tosURL string) bool {
+		logger.Printf("ACME terms of service of %s: %s (accepted: %t)\n", config.DirectoryURL, tosURL, config.AcceptTOS)
+		return config.AcceptTOS
 	})
-	if err != nil && err != acme.ErrAccountAlreadyExists {
-		logger.Fatal("Failed to register account: ", err)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("failed to register account: %w", err)
 	}
 
-	return client
+	logger.Println("Using ACME directory ", config.DirectoryURL)
+	return acmeClient, nil
 }
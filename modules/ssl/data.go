@@ -5,10 +5,10 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"os"
 	"sort"
 	"strings"
-	"wired/modules/logger"
 )
 
 type SSLClient struct {
@@ -16,28 +16,32 @@ type SSLClient struct {
 	DirectoryURL string          `json:"directory_url"`
 }
 
-func (s *SSLClient) saveKey() {
+func (s *SSLClient) saveKey(file string) error {
 	data, err := json.MarshalIndent(s, "", "  ")
 	if err != nil {
-		logger.Fatal("Failed to marshal key: ", err)
+		return fmt.Errorf("failed to marshal key: %w", err)
 	}
 
-	err = os.WriteFile("ssl_client_key.json", data, 0600)
+	err = os.WriteFile(file, data, 0600)
 	if err != nil {
-		logger.Fatal("Failed to save key to file: ", err)
+		return fmt.Errorf("failed to save key to file: %w", err)
 	}
+
+	return nil
 }
 
-func (s *SSLClient) loadKey() {
-	data, err := os.ReadFile("ssl_client_key.json")
+func (s *SSLClient) loadKey(file string) error {
+	data, err := os.ReadFile(file)
 	if err != nil {
-		logger.Fatal("Failed to read key from file: ", err)
+		return fmt.Errorf("failed to read key from file: %w", err)
 	}
 
 	err = json.Unmarshal(data, s)
 	if err != nil {
-		logger.Fatal("Failed to unmarshal key: ", err)
+		return fmt.Errorf("failed to unmarshal key: %w", err)
 	}
+
+	return nil
 }
 
 func generateBatchID(domains []string) string {
@@ -0,0 +1,134 @@
+package ssl
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"wired/modules/env"
+
+	"golang.org/x/crypto/acme"
+)
+
+/*
+	ACME directories
+
+	ACME_DIRECTORY selects the CA by name or directory URL, ACME_STAGING=true
+	switches a named CA to its staging directory. ACME_CA_ROOTS trusts extra
+	roots for the directory, e.g. Pebble's minica or the test CA of the
+	integration test (modules/ssl/integration).
+
+	ZeroSSL and Google only register accounts with an External Account
+	Binding, ACME_EAB_KID + ACME_EAB_HMAC_KEY (base64url) from their dashboards.
+*/
+
+type acmeDirectory struct {
+	URL        string
+	StagingURL string
+	RequireEAB bool
+}
+
+var acmeDirectories = map[string]acmeDirectory{
+	"letsencrypt": {URL: acme.LetsEncryptURL, StagingURL: "https://acme-staging-v02.api.letsencrypt.org/directory"},
+	"zerossl":     {URL: "https://acme.zerossl.com/v2/DV90", RequireEAB: true},
+	"buypass":     {URL: "https://api.buypass.com/acme/directory", StagingURL: "https://api.test4.buypass.no/acme/directory"},
+	"google":      {URL: "https://dv.acme-v02.api.pki.goog/directory", StagingURL: "https://dv.acme-v02.test-api.pki.goog/directory", RequireEAB: true},
+}
+
+type ACMEConfig struct {
+	Name         string // names the account key file, empty for Let's Encrypt
+	DirectoryURL string
+	Contact      []string // mailto: URIs
+	EABKeyID     string
+	EABKey       []byte
+	AcceptTOS    bool
+	HTTPClient   *http.Client // nil -> http.DefaultClient
+}
+
+// loadACMEConfig reads the ACME settings of this deployment from the environment
+func loadACMEConfig() (*ACMEConfig, error) {
+	config := &ACMEConfig{
+		AcceptTOS: env.GetEnv("ACME_ACCEPT_TOS", "true") == "true",
+	}
+
+	for _, contact := range strings.Split(env.GetEnv("ACME_CONTACT", "ssl@wired.rip"), ",") {
+		if contact = strings.TrimSpace(contact); contact != "" {
+			config.Contact = append(config.Contact, "mailto:"+strings.TrimPrefix(contact, "mailto:"))
+		}
+	}
+
+	directory := strings.ToLower(env.GetEnv("ACME_DIRECTORY", "letsencrypt"))
+	staging := env.GetEnv("ACME_STAGING", "false") == "true"
+	requireEAB := false
+	switch known, ok := acmeDirectories[directory]; {
+	case ok:
+		if directory != "letsencrypt" {
+			config.Name = directory
+		}
+
+		config.DirectoryURL = known.URL
+		if staging {
+			if known.StagingURL == "" {
+				return nil, fmt.Errorf("%s has no staging directory", directory)
+			}
+
+			config.Name = directory + "-staging"
+			config.DirectoryURL = known.StagingURL
+		}
+
+		requireEAB = known.RequireEAB
+	case strings.HasPrefix(directory, "https://"), strings.HasPrefix(directory, "http://"):
+		config.DirectoryURL = env.GetEnv("ACME_DIRECTORY", "")
+		config.Name = generateBatchID([]string{config.DirectoryURL})
+	default:
+		return nil, fmt.Errorf("unknown ACME directory %q", directory)
+	}
+
+	if rootsFile := env.GetEnv("ACME_CA_ROOTS", ""); rootsFile != "" {
+		rootsPEM, err := os.ReadFile(rootsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ACME CA roots: %w", err)
+		}
+
+		if config.HTTPClient, err = trustingClient(rootsPEM); err != nil {
+			return nil, err
+		}
+	}
+
+	config.EABKeyID = env.GetEnv("ACME_EAB_KID", "")
+	if hmacKey := env.GetEnv("ACME_EAB_HMAC_KEY", ""); hmacKey != "" {
+		key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(hmacKey, "="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ACME_EAB_HMAC_KEY: %w", err)
+		}
+
+		config.EABKey = key
+	}
+
+	if requireEAB && (config.EABKeyID == "" || config.EABKey == nil) {
+		return nil, fmt.Errorf("%s requires ACME_EAB_KID and ACME_EAB_HMAC_KEY", directory)
+	}
+
+	return config, nil
+}
+
+// trustingClient returns an http client trusting the PEM roots besides the system ones
+func trustingClient(rootsPEM []byte) (*http.Client, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(rootsPEM) {
+		return nil, errors.New("no certificates in ACME CA roots")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport, Timeout: time.Minute}, nil
+}
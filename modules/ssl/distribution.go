@@ -0,0 +1,110 @@
+package ssl
+
+import (
+	"errors"
+	"fmt"
+	"wired/modules/certstore"
+	"wired/modules/globals"
+	"wired/modules/logger"
+	packet "wired/modules/packets"
+	"wired/modules/protocol"
+	"wired/services/http"
+)
+
+/*
+	Certificate distribution
+
+	The issuer uploads every bundle it orders or renews to the master, which
+	pushes it to the other nodes as a chunked binary transfer. Received
+	bundles only replace the local ones when they are newer, stale or
+	duplicate pushes are ignored, and are swapped into the proxy right away.
+*/
+
+const certificateDir = "certs"
+
+// RequestCertificates asks the master for the bundles covering the names which are newer than ours, all when names is empty
+func RequestCertificates(names []string) error {
+	if protocol.MasterConn == nil {
+		return errors.New("not connected to the master")
+	}
+
+	versions := make(map[string]int64)
+	for _, bundle := range certstore.List(certificateDir) {
+		versions[bundle.Name] = bundle.Version
+	}
+
+	return protocol.MasterConn.SendPacket(globals.Packet.ID_CertificateRequest, packet.CertificateRequest{
+		Names:    names,
+		Versions: versions,
+	})
+}
+
+// ReceiveBundle stores a bundle pushed by the master and reloads the certificates when it is newer
+func ReceiveBundle(payload []byte) {
+	bundle, err := certstore.Decode(payload)
+	if err != nil {
+		logger.Println("Invalid certificate bundle from master:", err)
+		return
+	}
+
+	stored, err := certstore.Put(certificateDir, bundle)
+	if err != nil {
+		logger.Printf("Failed to store certificate bundle %s: %v\n", bundle.Name, err)
+		return
+	}
+
+	if !stored {
+		return
+	}
+
+	logger.Printf("Received certificate bundle %s for %v\n", bundle.Name, bundle.Names)
+
+	issuanceMu.Lock()
+	for _, name := range bundle.Names {
+		delete(pendingIssuance, name)
+	}
+	issuanceMu.Unlock()
+
+	http.ReloadCertificates()
+}
+
+// uploadBundle sends the bundle GenerateSANCertificate wrote for the names to the master
+func uploadBundle(domains []string) error {
+	name := certstore.BatchName(domains)
+	bundle, err := certstore.Read(certificateDir, name)
+	if err != nil {
+		return err
+	}
+
+	if bundle == nil {
+		return fmt.Errorf("no certificate bundle %s", name)
+	}
+
+	return sendBundle(bundle)
+}
+
+// uploadBundles sends every local bundle to the master, it keeps the newer ones
+func uploadBundles() {
+	bundles := certstore.List(certificateDir)
+	for _, bundle := range bundles {
+		if err := sendBundle(bundle); err != nil {
+			logger.Printf("Failed to upload certificate bundle %s: %v\n", bundle.Name, err)
+			return
+		}
+	}
+
+	logger.Printf("Uploaded %d certificate bundles to the master\n", len(bundles))
+}
+
+func sendBundle(bundle *certstore.Bundle) error {
+	if protocol.MasterConn == nil {
+		return errors.New("not connected to the master")
+	}
+
+	payload, err := bundle.Encode()
+	if err != nil {
+		return err
+	}
+
+	return protocol.MasterConn.SendBinary(certstore.BundleKind, payload)
+}
@@ -4,7 +4,6 @@ import (
 	"errors"
 	"fmt"
 	"wired/modules/logger"
-	"wired/modules/postgresql"
 	"wired/modules/types"
 
 	"github.com/miekg/dns"
@@ -14,89 +13,65 @@ import (
 	"golang.org/x/crypto/acme"
 )
 
-func dns01Handling(domains []string, authzURL string) error {
-	for _, domain := range domains {
-		authz, err := client.GetAuthorization(ctx, authzURL)
-		if err != nil {
-			return err
-		}
-
-		if authz.Status == acme.StatusValid {
-			logger.Printf("Authorization for %s is already valid\n", domain)
-			return nil
-		}
-
-		if authz.Status != acme.StatusPending {
-			return fmt.Errorf("authorization status '%s' not pending", authz.Status)
-		}
-
-		var chal *acme.Challenge
-		for _, c := range authz.Challenges {
-			if c.Type == "dns-01" {
-				chal = c
-				break
-			}
-		}
+// dns01Handling answers the dns-01 challenge of an authorization with a TXT record in the zone of its name
+func dns01Handling(client *acme.Client, authz *acme.Authorization) error {
+	domain := authz.Identifier.Value
+	if authz.Status == acme.StatusValid {
+		logger.Printf("Authorization for %s is already valid\n", domain)
+		return nil
+	}
 
-		if chal == nil {
-			return errors.New("authorization challenge not available")
-		}
+	if authz.Status != acme.StatusPending {
+		return fmt.Errorf("authorization status '%s' not pending", authz.Status)
+	}
 
-		challengeText, err := client.DNS01ChallengeRecord(chal.Token)
-		if err != nil {
-			return err
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+			break
 		}
+	}
 
-		var id string
-		var owner *types.User
-
-		postgresql.UsersMu.RLock()
-		defer func() {
-			err := wired_dns.DeleteRecord(owner, id)
-			if err != nil {
-				return
-			}
-
-			postgresql.UsersMu.RUnlock()
-		}()
-
-		owner = postgresql.Users[wired_dns.DomainDataIndexName[domain].Owner]
-		if owner == nil {
-			postgresql.Users[wired_dns.DomainDataIndexName[domain].Owner] = &types.User{
-				Id: wired_dns.DomainDataIndexName[domain].Owner,
-			}
-		}
+	if chal == nil {
+		return errors.New("authorization challenge not available")
+	}
 
-		err = postgresql.GetUser(owner)
-		if err != nil {
-			return err
-		}
+	challengeText, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
 
-		id, err = wired_dns.CreateRecord(owner, wired_dns.DomainDataIndexName[domain].Id, &types.DNSRecord{
-			RR: &dns.TXT{
-				Hdr: dns.RR_Header{Name: dns.Fqdn("_acme-challenge." + domain), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 3600},
-				Txt: []string{challengeText},
-			},
-			Metadata: types.RecordMetadata{
-				Protected: false,
-				Geo:       false,
-			},
-		})
+	domainData := wired_dns.DomainDataIndexName[wired_dns.FindApex(dns.Fqdn(domain))]
+	if domainData == nil {
+		return fmt.Errorf("no zone for %s", domain)
+	}
 
-		if err != nil {
-			return err
-		}
+	owner := &types.User{Id: domainData.Owner}
+	id, err := wired_dns.CreateRecord(owner, domainData.Id, &types.DNSRecord{
+		RR: &dns.TXT{
+			Hdr: dns.RR_Header{Name: dns.Fqdn("_acme-challenge." + domain), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{challengeText},
+		},
+		Metadata: types.RecordMetadata{
+			Protected: false,
+			Geo:       false,
+		},
+	})
+	if err != nil {
+		return err
+	}
 
-		_, err = client.Accept(ctx, chal)
-		if err != nil {
-			return err
+	defer func() {
+		if err := wired_dns.DeleteRecord(owner, id); err != nil {
+			logger.Printf("Failed to remove the challenge record of %s: %v\n", domain, err)
 		}
+	}()
 
-		_, err = client.WaitAuthorization(ctx, chal.URI)
-		if err != nil {
-			return err
-		}
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return err
 	}
 
-	return nil
+	_, err = client.WaitAuthorization(ctx, authz.URI)
+	return err
 }
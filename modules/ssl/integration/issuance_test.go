@@ -0,0 +1,201 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+	"wired/modules/certstore"
+	"wired/modules/env"
+	"wired/modules/ssl"
+	"wired/modules/ssl/testca"
+	"wired/modules/types"
+	wired_dns "wired/services/dns"
+
+	"github.com/miekg/dns"
+)
+
+/*
+	End to end issuance
+
+	The test CA validates the dns-01 challenges against our DNS service on a
+	free local port, the whole flow runs without network access:
+		go test -tags integration -timeout 5m ./modules/ssl/integration/
+
+	The DNS service needs the GeoLite databases, they are downloaded next to
+	the test on the first run or can be placed there beforehand.
+	Orders are paced, the RSA certificate follows the ECDSA one after 36s.
+*/
+
+const zone = "example.test."
+
+func TestGenerateSANCertificate(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the geo databases load in the background, from either directory
+	dir := t.TempDir()
+	databases, _ := filepath.Glob("*.mmdb")
+	for _, database := range databases {
+		data, err := os.ReadFile(database)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, database), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.Chdir(cwd) })
+
+	dnsAddr := freeAddr(t)
+	ca, err := testca.Start(testca.Config{Addr: "127.0.0.1:0", Resolver: dnsAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ca.Close()
+
+	if err := os.WriteFile("ca.pem", ca.RootPEM(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// env only reads .env, the settings of the test are merged into the ones of the package
+	settings := fmt.Sprintf("DNS_ADDR=%s\nACME_DIRECTORY=%s\nACME_CA_ROOTS=ca.pem\nSSL_TRUSTED_ROOTS=ca.pem\n", dnsAddr, ca.DirectoryURL())
+	if err := os.WriteFile(".env", []byte(settings), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	env.LoadEnvFile()
+
+	if err := os.MkdirAll("zonefiles", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	owner := &types.User{Id: "integration"}
+	if err := wired_dns.CreateDomain(owner, zone); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go wired_dns.Start(ctx)
+	waitForDNS(t, dnsAddr)
+
+	names := []string{"example.test", "www.example.test"}
+	_, expiresAt, err := ssl.GenerateSANCertificate(names)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Until(expiresAt) <= 0 {
+		t.Fatalf("certificate expired at %s", expiresAt)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.RootPEM())
+	base := filepath.Join("certs", certstore.BatchName(names))
+	for _, suffix := range []string{"", ".ecdsa"} {
+		leaf, intermediates := readChain(t, base+suffix+".crt")
+		if !slices.Equal(leaf.DNSNames, names) {
+			t.Errorf("%s covers %v, want %v", suffix, leaf.DNSNames, names)
+		}
+
+		if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, DNSName: names[1]}); err != nil {
+			t.Errorf("%s: %v", suffix, err)
+		}
+
+		if _, err := os.Stat(base + suffix + ".key"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// the challenge records are removed once the authorizations are valid
+	domainData := wired_dns.DomainDataIndexName[zone]
+	for _, record := range wired_dns.GetRecordsByDomain(owner, domainData.Id) {
+		if record.RR.Header().Rrtype == dns.TypeTXT {
+			t.Errorf("challenge record left behind: %s", record.RR)
+		}
+	}
+}
+
+// freeAddr returns a local address with a port free for udp and tcp
+func freeAddr(t *testing.T) string {
+	for range 10 {
+		udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := udp.LocalAddr().String()
+		tcp, err := net.Listen("tcp", addr)
+		udp.Close()
+		if err == nil {
+			tcp.Close()
+			return addr
+		}
+	}
+
+	t.Fatal("no free port for the DNS service")
+	return ""
+}
+
+// waitForDNS blocks until the DNS service answers for the zone
+func waitForDNS(t *testing.T, addr string) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(zone, dns.TypeNS)
+	client := &dns.Client{Timeout: time.Second}
+	for range 20 {
+		if resp, _, err := client.Exchange(msg, addr); err == nil && len(resp.Answer) > 0 {
+			return
+		}
+
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	t.Fatal("DNS service did not answer")
+}
+
+func readChain(t *testing.T, path string) (*x509.Certificate, *x509.CertPool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		t.Fatalf("no certificates in %s", path)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	return certs[0], intermediates
+}
@@ -0,0 +1,278 @@
+package ssl
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"wired/modules/env"
+	"wired/modules/event"
+	event_data "wired/modules/event/events"
+	"wired/modules/logger"
+	"wired/modules/protocol"
+	wired_dns "wired/services/dns"
+	"wired/services/http"
+
+	"golang.org/x/crypto/acme"
+)
+
+/*
+	Certificate issuance queue
+
+	Protected names without a certificate are queued when their record is
+	added or the proxy serves them with a placeholder. Names queued within
+	issuanceDelay share a SAN order. Only the node elected by the master
+	(Event_CertificateIssuer) orders, the others get the certificates from
+	the master (see distribution.go). Names an order failed for are retried
+	with exponential backoff, the rest of the batch is ordered again without
+	them. Rate limited orders wait for the CA's Retry-After.
+*/
+
+const (
+	issuanceDelay = 30 * time.Second // hosts added meanwhile share the order
+	issuanceBatch = 100
+	retryMinDelay = 5 * time.Minute
+	retryMaxDelay = 24 * time.Hour
+)
+
+type pendingHost struct {
+	attempts  int
+	notBefore time.Time
+}
+
+var (
+	SSLEventBus = event.NewEventBus("ssl")
+
+	pendingIssuance  = make(map[string]*pendingHost)
+	issuanceRunning  bool
+	issuerNode       string    // elected by the master, empty until announced
+	rateLimitedUntil time.Time // no orders before, set by the CA's Retry-After
+	issuanceMu       sync.Mutex
+)
+
+func init() {
+	http.CertificateNeeded = certificateNeeded
+
+	addChan := make(chan event.Event)
+	wired_dns.DNSEventBus.Sub(event.Event_AddRecord, addChan, func() { addRecordEventHandler(addChan) })
+
+	issuerChan := make(chan event.Event)
+	SSLEventBus.Sub(event.Event_CertificateIssuer, issuerChan, func() { issuerEventHandler(issuerChan) })
+}
+
+// addRecordEventHandler queues protected names, the queue skips the ones with a certificate
+func addRecordEventHandler(eventChan <-chan event.Event) {
+	for e := range eventChan {
+		data, ok := event.DecodeData[event_data.AddRecordData](e)
+		if !ok || data.Record == nil || data.Record.RR == nil || !data.Record.Metadata.Protected {
+			continue
+		}
+
+		scheduleIssuance(strings.ToLower(strings.TrimSuffix(data.Record.RR.Header().Name, ".")))
+	}
+}
+
+func issuerEventHandler(eventChan <-chan event.Event) {
+	for e := range eventChan {
+		data, ok := event.DecodeData[event_data.CertificateIssuerData](e)
+		if !ok {
+			logger.Println("Invalid event data for CertificateIssuer")
+			continue
+		}
+
+		issuanceMu.Lock()
+		changed := data.Node != issuerNode
+		issuerNode = data.Node
+		elected := changed && isIssuer()
+		issuanceMu.Unlock()
+
+		if changed {
+			logger.Printf("Certificate issuer is now %q\n", data.Node)
+		}
+
+		// the master may miss what we issued before, it keeps the newer bundles
+		if elected {
+			go uploadBundles()
+		}
+	}
+}
+
+// certificateNeeded asks the master for a certificate of a host served with a placeholder and queues its issuance
+func certificateNeeded(host string) {
+	// before connecting, the request after the login covers it
+	if protocol.MasterConn != nil {
+		if err := RequestCertificates([]string{host}); err != nil {
+			logger.Printf("Failed to request the certificate of %s: %v\n", host, err)
+		}
+	}
+
+	scheduleIssuance(host)
+}
+
+// isIssuer reports whether this node orders certificates, issuanceMu must be held
+func isIssuer() bool {
+	return issuerNode != "" && issuerNode == env.GetEnv("NODE_KEY", "node-key")
+}
+
+// scheduleIssuance queues a host for the next SAN order
+func scheduleIssuance(host string) {
+	issuanceMu.Lock()
+	defer issuanceMu.Unlock()
+
+	if _, ok := pendingIssuance[host]; !ok {
+		pendingIssuance[host] = &pendingHost{}
+	}
+
+	if !issuanceRunning {
+		issuanceRunning = true
+		go issuePending()
+	}
+}
+
+func issuePending() {
+	for {
+		time.Sleep(issuanceDelay)
+
+		issuanceMu.Lock()
+		hosts := make([]string, 0, len(pendingIssuance))
+		for host, pending := range pendingIssuance {
+			// issued meanwhile, here or by the issuer
+			if http.HasCertificate(host) {
+				delete(pendingIssuance, host)
+				continue
+			}
+
+			if time.Now().After(pending.notBefore) {
+				hosts = append(hosts, host)
+			}
+		}
+
+		if len(pendingIssuance) == 0 {
+			issuanceRunning = false
+			issuanceMu.Unlock()
+			return
+		}
+
+		// the other nodes wait for the issuer's certificates
+		if !isIssuer() || time.Now().Before(rateLimitedUntil) {
+			hosts = nil
+		}
+		issuanceMu.Unlock()
+
+		sort.Strings(hosts)
+		for i := 0; i < len(hosts); i += issuanceBatch {
+			// the remaining batches would hit the same limit
+			if issueBatch(hosts[i:min(i+issuanceBatch, len(hosts))]) {
+				break
+			}
+		}
+	}
+}
+
+// issueBatch orders a SAN certificate of the hosts, it reports whether the CA rate limited the order.
+// Only the hosts an order failed for are backed off, the others are ordered again without them.
+func issueBatch(batch []string) bool {
+	if _, _, err := GenerateSANCertificate(batch); err != nil {
+		logger.Printf("Failed to issue certificates for %v: %v\n", batch, err)
+		if _, limited := rateLimited(err); limited {
+			return retryIssuance(batch, err)
+		}
+
+		if failed := failedNames(err, batch); len(failed) > 0 {
+			// the others stay pending for the next round
+			return retryIssuance(failed, err)
+		}
+
+		// the CA refused the order without naming a host, halving it finds the ones it refuses
+		var acmeErr *acme.Error
+		if len(batch) > 1 && errors.As(err, &acmeErr) {
+			half := len(batch) / 2
+			return issueBatch(batch[:half]) || issueBatch(batch[half:])
+		}
+
+		// the CA is unreachable or refuses the account, nothing to do with the hosts
+		return retryIssuance(batch, err)
+	}
+
+	issuanceMu.Lock()
+	for _, host := range batch {
+		delete(pendingIssuance, host)
+	}
+	issuanceMu.Unlock()
+
+	http.ReloadCertificates()
+	if err := uploadBundle(batch); err != nil {
+		logger.Printf("Failed to upload certificates for %v: %v\n", batch, err)
+	}
+
+	return false
+}
+
+// failedNames returns the hosts of a batch an order failed for, nil when the failure is not specific to hosts
+func failedNames(err error, batch []string) []string {
+	var names []string
+	var nameErr *nameError
+	var acmeErr *acme.Error
+	switch {
+	case errors.As(err, &nameErr):
+		names = []string{nameErr.name}
+	case errors.As(err, &acmeErr):
+		for _, sub := range acmeErr.Subproblems {
+			if sub.Identifier != nil {
+				names = append(names, sub.Identifier.Value)
+			}
+		}
+	}
+
+	var failed []string
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if slices.Contains(batch, name) && !slices.Contains(failed, name) {
+			failed = append(failed, name)
+		}
+	}
+
+	return failed
+}
+
+// retryIssuance backs off the hosts of a failed order, it reports whether the CA rate limited it
+func retryIssuance(batch []string, err error) bool {
+	retryAfter, limited := rateLimited(err)
+
+	issuanceMu.Lock()
+	defer issuanceMu.Unlock()
+
+	if limited {
+		rateLimitedUntil = time.Now().Add(retryAfter)
+	}
+
+	for _, host := range batch {
+		pending, ok := pendingIssuance[host]
+		if !ok {
+			continue
+		}
+
+		pending.attempts++
+		delay := min(retryMinDelay<<min(pending.attempts-1, 16), retryMaxDelay)
+		pending.notBefore = time.Now().Add(max(delay, retryAfter))
+	}
+
+	return limited
+}
+
+// rateLimited returns how long the CA asked to wait when err is a rate limit error
+func rateLimited(err error) (time.Duration, bool) {
+	var acmeErr *acme.Error
+	if !errors.As(err, &acmeErr) {
+		return 0, false
+	}
+
+	retryAfter, ok := acme.RateLimit(acmeErr)
+	if ok && retryAfter <= 0 {
+		retryAfter = time.Hour
+	}
+
+	return retryAfter, ok
+}
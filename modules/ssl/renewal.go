@@ -2,119 +2,315 @@ package ssl
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
-	"fmt"
-	"os"
+	"math/rand/v2"
+	"slices"
 	"time"
+	"wired/modules/certstore"
+	"wired/modules/env"
+	"wired/modules/event"
+	event_data "wired/modules/event/events"
 	"wired/modules/logger"
 	"wired/services/http"
 )
 
+/*
+	Renewal scheduler
+
+	Every bundle in certs/ renews on its own schedule: two thirds into its
+	lifetime, or at a random time in the window the CA suggests through ARI.
+	Per host certificates are moved into bundles at startup to be renewed too.
+	Only the issuer polls ARI and orders, failures back off per bundle and a
+	rate limit pauses renewals together with the issuance queue. The issuer
+	publishes its state (Event_RenewalStatus) so the dashboard of every node
+	shows the same upcoming and failed renewals. The state is persisted to
+	renewalStateFile.
+*/
+
+const (
+	renewalStateFile     = "ssl_renewals.json"
+	renewalCheckInterval = time.Hour // bundles received meanwhile are planned on the next check
+	renewalMinWait       = time.Minute
+	renewalMinRetry      = time.Hour
+	renewalMaxRetry      = 24 * time.Hour
+)
+
+func init() {
+	statusChan := make(chan event.Event)
+	SSLEventBus.Sub(event.Event_RenewalStatus, statusChan, func() { renewalStatusEventHandler(statusChan) })
+}
+
 func StartRenewalChecker(ctx context.Context) {
-	ticker := time.NewTicker(48 * time.Hour)
-	defer ticker.Stop()
+	// per host certificates would never be renewed otherwise
+	migrated, err := certstore.MigrateHostCertificates(certificateDir)
+	if err != nil {
+		logger.Println("Failed to migrate per host certificates:", err)
+	}
+
+	if len(migrated) > 0 {
+		logger.Printf("Migrated per host certificates into %d bundles\n", len(migrated))
+		http.ReloadCertificates()
+	}
+
+	if err := certstore.LoadRenewals(renewalStateFile); err != nil {
+		logger.Println("Failed to load the renewal state, starting over:", err)
+	}
 
 	for {
+		issuanceMu.Lock()
+		issuer := isIssuer()
+		issuanceMu.Unlock()
+
+		planRenewals(ctx, issuer)
+		if issuer {
+			renewDue()
+			publishRenewals()
+		}
+
+		if err := certstore.SaveRenewals(renewalStateFile); err != nil {
+			logger.Println("Failed to save the renewal state:", err)
+		}
+
 		select {
 		case <-ctx.Done():
 			logger.Println("Stopping SSL renewal checker...")
 			return
-		case <-ticker.C:
-			domains := []string{}
-			logger.Println("Checking for certificates to renew...")
-			for domain, sslEntry := range http.CertMap {
-				if sslEntry.Cert.Leaf == nil {
-					if len(sslEntry.Cert.Certificate) == 0 {
-						logger.Printf("No certificate data for %s\n", domain)
-						continue
-					}
-
-					leaf, err := x509.ParseCertificate(sslEntry.Cert.Certificate[0])
-					if err != nil {
-						logger.Printf("Error parsing leaf cert for %s: %v\n", domain, err)
-						continue
-					}
-
-					sslEntry.Cert.Leaf = leaf
-					http.CertMap[domain] = sslEntry
-				}
+		case <-time.After(nextRenewalCheck(issuer)):
+		}
+	}
+}
 
-				if time.Until(sslEntry.Cert.Leaf.NotAfter) <= 90*24*time.Hour {
-					domains = append(domains, domain)
-				}
+// planRenewals tracks the bundles in certs/ and sets when to renew them, the issuer asks the CA through ARI
+func planRenewals(ctx context.Context, issuer bool) {
+	bundles := certstore.List(certificateDir)
+
+	type ariUpdate struct {
+		bundle string
+		info   *renewalInfo
+		err    error
+	}
+
+	var updates []ariUpdate
+	if issuer {
+		renewals := make(map[string]certstore.Renewal)
+		for _, renewal := range certstore.Renewals() {
+			renewals[renewal.Bundle] = renewal
+		}
+
+		// ARI requests go out without holding the state
+		for _, bundle := range bundles {
+			renewal, ok := renewals[bundle.Name]
+			if ok && renewal.Fingerprint == bundle.Fingerprint && time.Now().Before(renewal.ARICheckAt) {
+				continue
 			}
 
-			if len(domains) == 0 {
-				logger.Println("No certificates to renew")
-				return
-			} else {
-				logger.Printf("Renewing %d certificates: %s\n", len(domains), domains)
+			leaf, err := bundle.Leaf()
+			if err != nil {
+				continue
 			}
 
-			batchSize := 100
-			for i := 0; i < len(domains); i += batchSize {
-				end := i + batchSize
-				if end > len(domains) {
-					end = len(domains)
-				}
+			info, err := fetchRenewalInfo(ctx, leaf)
+			updates = append(updates, ariUpdate{bundle.Name, info, err})
+		}
+	}
 
-				batch := domains[i:end]
-				logger.Printf("Renewing batch %d-%d: %s\n", i, end, batch)
+	certstore.UpdateRenewals(func(renewals map[string]*certstore.Renewal) {
+		present := make(map[string]bool)
+		for _, bundle := range bundles {
+			present[bundle.Name] = true
 
-				certPEM, keyPEM, err := prepareCertificate(batch)
+			renewal := renewals[bundle.Name]
+			if renewal == nil || renewal.Fingerprint != bundle.Fingerprint {
+				leaf, err := bundle.Leaf()
 				if err != nil {
-					logger.Printf("Failed to renew batch %d-%d: %v\n", i, end, err)
+					logger.Printf("Failed to read certificate bundle %s: %v\n", bundle.Name, err)
 					continue
 				}
 
-				block, _ := pem.Decode(certPEM)
-				if block == nil {
-					logger.Println("Failed to decode new certificate PEM")
-					continue
+				renewal = &certstore.Renewal{
+					Bundle:      bundle.Name,
+					Names:       bundle.Names,
+					Fingerprint: bundle.Fingerprint,
+					NotBefore:   leaf.NotBefore,
+					NotAfter:    leaf.NotAfter,
+					RenewAt:     leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) * 2 / 3),
+					Source:      certstore.RenewalLifetime,
 				}
+				renewals[bundle.Name] = renewal
+			}
 
-				newCert, err := x509.ParseCertificate(block.Bytes)
-				if err != nil {
-					logger.Printf("Failed to parse new certificate: %v\n", err)
-					continue
-				}
+			renewal.Unused = !slices.ContainsFunc(renewal.Names, http.Serves)
+		}
 
-				tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
-				if err != nil {
-					logger.Printf("Failed to create TLS cert: %v\n", err)
-					continue
-				}
+		for name := range renewals {
+			if !present[name] {
+				delete(renewals, name)
+			}
+		}
 
-				tlsCert.Leaf = newCert
+		for _, update := range updates {
+			renewal := renewals[update.bundle]
+			if renewal == nil {
+				continue
+			}
 
-				http.CertMapLock.Lock()
-				for _, dnsName := range newCert.DNSNames {
-					http.CertMap[dnsName].Cert = &tlsCert
+			switch {
+			case update.err == nil:
+				applyRenewalInfo(renewal, update.info)
+			case update.err == errARIUnsupported:
+				renewal.ARICheckAt = time.Now().Add(renewalMaxRetry)
+			default:
+				logger.Printf("Failed to fetch renewal info of %s: %v\n", renewal.Bundle, update.err)
+				renewal.ARICheckAt = time.Now().Add(ariDefaultRetry)
+			}
+		}
+	})
+}
 
-					os.Remove(fmt.Sprintf("certs/%s.crt", dnsName))
-					os.Remove(fmt.Sprintf("certs/%s.key", dnsName))
-				}
-				http.CertMapLock.Unlock()
+// applyRenewalInfo moves the renewal into the window suggested by the CA
+func applyRenewalInfo(renewal *certstore.Renewal, info *renewalInfo) {
+	renewal.ARICheckAt = time.Now().Add(info.RetryAfter)
+	renewal.ExplanationURL = info.ExplanationURL
 
-				domainList := make([]string, 0, len(batch))
-				for _, domain := range batch {
-					domainList = append(domainList, domain)
-				}
+	start, end := info.SuggestedWindow.Start, info.SuggestedWindow.End
+	if renewal.Source == certstore.RenewalARI && start.Equal(renewal.WindowStart) && end.Equal(renewal.WindowEnd) {
+		return
+	}
+
+	logger.Printf("Renewal window of %s is %s to %s\n", renewal.Bundle, start.Format(time.RFC3339), end.Format(time.RFC3339))
+
+	// a random time in the window spreads the renewals of many certificates
+	renewal.WindowStart, renewal.WindowEnd = start, end
+	renewal.RenewAt = start
+	if window := end.Sub(start); window > 0 {
+		renewal.RenewAt = start.Add(rand.N(window))
+	}
+	renewal.Source = certstore.RenewalARI
+}
 
-				batchID := generateBatchID(domainList)
-				certFile := fmt.Sprintf("certs/san_%s.crt", batchID)
-				keyFile := fmt.Sprintf("certs/san_%s.key", batchID)
-				os.WriteFile(certFile, certPEM, 0644)
-				os.WriteFile(keyFile, keyPEM, 0600)
+// renewDue renews the bundles whose time has come, one order each
+func renewDue() {
+	now := time.Now()
 
-				logger.Printf("Renewed batch of %d domains (expires %s)\n",
-					len(batch), newCert.NotAfter.Format("2006-01-02"))
+	var due []certstore.Renewal
+	for _, renewal := range certstore.Renewals() {
+		if !renewal.Unused && !now.Before(renewal.RenewAt) && !now.Before(renewal.RetryAt) {
+			due = append(due, renewal)
+		}
+	}
+
+	if len(due) == 0 {
+		return
+	}
+
+	logger.Printf("Renewing %d certificates\n", len(due))
+	for _, renewal := range due {
+		issuanceMu.Lock()
+		limited := time.Now().Before(rateLimitedUntil)
+		issuanceMu.Unlock()
+		if limited {
+			logger.Println("Renewals paused by the CA's rate limit")
+			break
+		}
 
-				// (300 orders / 3h = 1 order / 36s)
-				time.Sleep(36 * time.Second)
+		_, expiresAt, err := GenerateSANCertificate(renewal.Names)
+		if err != nil {
+			logger.Printf("Failed to renew %s %v: %v\n", renewal.Bundle, renewal.Names, err)
+			if renewalFailed(renewal.Bundle, err) {
+				break
 			}
+
+			continue
+		}
+
+		logger.Printf("Renewed %s %v (expires %s)\n", renewal.Bundle, renewal.Names, expiresAt.Format("2006-01-02"))
+		http.ReloadCertificates()
+		if err := uploadBundle(renewal.Names); err != nil {
+			logger.Printf("Failed to upload renewed %s: %v\n", renewal.Bundle, err)
+		}
+	}
+
+	// the renewed certificates get their own schedule
+	planRenewals(context.Background(), false)
+}
+
+// renewalFailed records a failed renewal and backs it off, it reports whether the CA rate limited it
+func renewalFailed(bundle string, err error) bool {
+	retryAfter, limited := rateLimited(err)
+	if limited {
+		issuanceMu.Lock()
+		rateLimitedUntil = time.Now().Add(retryAfter)
+		issuanceMu.Unlock()
+	}
+
+	certstore.UpdateRenewals(func(renewals map[string]*certstore.Renewal) {
+		renewal := renewals[bundle]
+		if renewal == nil {
+			return
 		}
+
+		renewal.Attempts++
+		renewal.LastAttempt = time.Now()
+		renewal.LastError = err.Error()
+		delay := min(renewalMinRetry<<min(renewal.Attempts-1, 16), renewalMaxRetry)
+		renewal.RetryAt = time.Now().Add(max(delay, retryAfter))
+	})
+
+	return limited
+}
+
+// nextRenewalCheck returns how long to wait for the next renewal or ARI check
+func nextRenewalCheck(issuer bool) time.Duration {
+	wait := renewalCheckInterval
+	if !issuer {
+		return wait
+	}
+
+	for _, renewal := range certstore.Renewals() {
+		wait = min(wait, time.Until(renewal.ARICheckAt))
+		if renewal.Unused {
+			continue
+		}
+
+		next := renewal.RenewAt
+		if renewal.RetryAt.After(next) {
+			next = renewal.RetryAt
+		}
+
+		wait = min(wait, time.Until(next))
+	}
+
+	return max(wait, renewalMinWait)
+}
+
+// publishRenewals shares the issuer's renewal state with the other nodes
+func publishRenewals() {
+	SSLEventBus.Pub(event.Event{
+		Type:    event.Event_RenewalStatus,
+		FiredAt: time.Now(),
+		FiredBy: env.GetEnv("NODE_KEY", "node-key"),
+		Data:    event_data.RenewalStatusData{Renewals: certstore.Renewals()},
+	})
+}
+
+// renewalStatusEventHandler takes over the issuer's state for the bundles we hold in the same version
+func renewalStatusEventHandler(eventChan <-chan event.Event) {
+	for e := range eventChan {
+		if e.FiredBy == env.GetEnv("NODE_KEY", "node-key") {
+			continue
+		}
+
+		data, ok := event.DecodeData[event_data.RenewalStatusData](e)
+		if !ok {
+			logger.Println("Invalid event data for RenewalStatus")
+			continue
+		}
+
+		certstore.UpdateRenewals(func(renewals map[string]*certstore.Renewal) {
+			for _, status := range data.Renewals {
+				if renewal := renewals[status.Bundle]; renewal != nil && renewal.Fingerprint == status.Fingerprint {
+					*renewal = status
+				}
+			}
+		})
 	}
 }
@@ -0,0 +1,180 @@
+package testca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+)
+
+/*
+	JWS -> Flattened JSON (RFC 7515): Protected + Payload + Signature, all base64url
+	Protected -> alg, nonce, url and either jwk (new accounts) or kid (account url)
+	POST-as-GET -> empty payload
+
+	RS256 -> RSASSA-PKCS1-v1_5, ES256/384/512 -> ECDSA with r || s
+*/
+
+type jws struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+type jwsHeader struct {
+	Alg   string          `json:"alg"`
+	Nonce string          `json:"nonce"`
+	URL   string          `json:"url"`
+	JWK   json.RawMessage `json:"jwk"`
+	KID   string          `json:"kid"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWS decodes a request body into its header, payload and signed input
+func parseJWS(body []byte) (*jwsHeader, []byte, *jws, error) {
+	var signed jws
+	if err := json.Unmarshal(body, &signed); err != nil {
+		return nil, nil, nil, err
+	}
+
+	protected, err := base64.RawURLEncoding.DecodeString(signed.Protected)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var header jwsHeader
+	if err := json.Unmarshal(protected, &header); err != nil {
+		return nil, nil, nil, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(signed.Payload)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return &header, payload, &signed, nil
+}
+
+// verify checks the signature of a JWS with the public key
+func (signed *jws) verify(alg string, key crypto.PublicKey) error {
+	signature, err := base64.RawURLEncoding.DecodeString(signed.Signature)
+	if err != nil {
+		return err
+	}
+
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "ES384":
+		hash = crypto.SHA384
+	case "ES512":
+		hash = crypto.SHA512
+	default:
+		return errors.New("unsupported algorithm " + alg)
+	}
+
+	h := hash.New()
+	h.Write([]byte(signed.Protected + "." + signed.Payload))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return errors.New("algorithm does not match the key")
+		}
+
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg == "RS256" || len(signature) != 2*size {
+			return errors.New("algorithm does not match the key")
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+
+		return nil
+	}
+
+	return errors.New("unsupported key type")
+}
+
+// publicKey decodes a JWK into an RSA or ECDSA public key
+func publicKey(raw json.RawMessage) (crypto.PublicKey, error) {
+	var key jwk
+	if err := json.Unmarshal(raw, &key); err != nil {
+		return nil, err
+	}
+
+	decode := func(value string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch key.Kty {
+	case "RSA":
+		n, err := decode(key.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decode(key.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve " + key.Crv)
+		}
+
+		x, err := decode(key.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decode(key.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, errors.New("unsupported key type " + key.Kty)
+}
@@ -0,0 +1,834 @@
+package testca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/acme"
+)
+
+/*
+	Local test CA
+
+	A Pebble-style ACME server (RFC 8555) kept in memory, for issuing
+	certificates without network access. It only offers dns-01 challenges and
+	validates them by asking Resolver, usually our own DNS service, for the
+	_acme-challenge TXT record. Certificates are signed by a root created on
+	start, which is also used for the https listener of the directory.
+
+	Endpoints:
+		- GET /dir: directory
+		- HEAD|GET /nonce: fresh nonce
+		- POST /account, /account/{id}: accounts
+		- POST /order, /order/{id}, /finalize/{id}: orders
+		- POST /authz/{id}, /chal/{id}: authorizations and dns-01 challenges
+		- POST /cert/{id}: certificate chain
+*/
+
+const (
+	defaultValidity = 90 * 24 * time.Hour
+	orderLifetime   = 24 * time.Hour
+)
+
+type Config struct {
+	Addr     string        // listen address, port 0 -> random
+	Resolver string        // host:port answering the dns-01 challenges
+	Validity time.Duration // of issued certificates, 0 -> 90 days
+}
+
+type account struct {
+	id      string
+	key     crypto.PublicKey
+	contact []string
+}
+
+type challenge struct {
+	id     string
+	token  string
+	status string
+	err    *problem
+	authz  *authorization
+}
+
+type authorization struct {
+	id         string
+	account    string
+	identifier acme.AuthzID
+	wildcard   bool
+	status     string
+	expires    time.Time
+	challenge  *challenge
+}
+
+type order struct {
+	id          string
+	account     string
+	status      string
+	expires     time.Time
+	identifiers []acme.AuthzID
+	authzs      []*authorization
+	certificate string // id of the issued certificate
+}
+
+type Server struct {
+	config   Config
+	baseURL  string
+	listener net.Listener
+	server   *http.Server
+
+	root    *x509.Certificate
+	rootKey *ecdsa.PrivateKey
+	rootPEM []byte
+
+	nonceMu sync.Mutex
+	nonces  map[string]struct{}
+
+	mu           sync.Mutex
+	accounts     map[string]*account // id -> account
+	thumbprints  map[string]string   // jwk thumbprint -> account id
+	orders       map[string]*order
+	authzs       map[string]*authorization
+	challenges   map[string]*challenge
+	certificates map[string][]byte // id -> PEM chain
+}
+
+// Start creates a root and serves the directory on Addr over https
+func Start(config Config) (*Server, error) {
+	if config.Validity == 0 {
+		config.Validity = defaultValidity
+	}
+
+	s := &Server{
+		config:       config,
+		nonces:       make(map[string]struct{}),
+		accounts:     make(map[string]*account),
+		thumbprints:  make(map[string]string),
+		orders:       make(map[string]*order),
+		authzs:       make(map[string]*authorization),
+		challenges:   make(map[string]*challenge),
+		certificates: make(map[string][]byte),
+	}
+
+	if err := s.createRoot(); err != nil {
+		return nil, err
+	}
+
+	serverCert, err := s.serverCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := tls.Listen("tcp", config.Addr, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.listener = listener
+	s.baseURL = "https://" + listener.Addr().String()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /dir", s.handleDirectory)
+	mux.HandleFunc("/nonce", s.handleNonce)
+	mux.HandleFunc("POST /account", s.handleNewAccount)
+	mux.HandleFunc("POST /account/{id}", s.handleAccount)
+	mux.HandleFunc("POST /order", s.handleNewOrder)
+	mux.HandleFunc("POST /order/{id}", s.handleOrder)
+	mux.HandleFunc("POST /finalize/{id}", s.handleFinalize)
+	mux.HandleFunc("POST /authz/{id}", s.handleAuthorization)
+	mux.HandleFunc("POST /chal/{id}", s.handleChallenge)
+	mux.HandleFunc("POST /cert/{id}", s.handleCertificate)
+
+	s.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go s.server.Serve(listener)
+
+	return s, nil
+}
+
+func (s *Server) DirectoryURL() string {
+	return s.baseURL + "/dir"
+}
+
+// RootPEM returns the root signing the issued certificates and the https listener
+func (s *Server) RootPEM() []byte {
+	return s.rootPEM
+}
+
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+func (s *Server) createRoot() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "wired test CA " + randomID()[:8]},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return err
+	}
+
+	s.root, err = x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+
+	s.rootKey = key
+	s.rootPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return nil
+}
+
+// serverCertificate issues the certificate of the https listener
+func (s *Server) serverCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, s.root, key.Public(), s.rootKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func (s *Server) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"newNonce":   s.baseURL + "/nonce",
+		"newAccount": s.baseURL + "/account",
+		"newOrder":   s.baseURL + "/order",
+		"meta": map[string]any{
+			"termsOfService":          s.baseURL + "/terms",
+			"externalAccountRequired": false,
+		},
+	})
+}
+
+func (s *Server) handleNonce(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", s.nonce())
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) handleNewAccount(w http.ResponseWriter, r *http.Request) {
+	_, payload, key, prob := s.readRequest(r, true)
+	if prob != nil {
+		s.writeProblem(w, prob)
+		return
+	}
+
+	var body struct {
+		Contact            []string `json:"contact"`
+		OnlyReturnExisting bool     `json:"onlyReturnExisting"`
+	}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		s.writeProblem(w, malformed("invalid account payload"))
+		return
+	}
+
+	thumbprint, err := acme.JWKThumbprint(key)
+	if err != nil {
+		s.writeProblem(w, malformed(err.Error()))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id, ok := s.thumbprints[thumbprint]; ok {
+		s.writeObject(w, http.StatusOK, s.baseURL+"/account/"+id, s.accountJSON(s.accounts[id]))
+		return
+	}
+
+	if body.OnlyReturnExisting {
+		s.writeProblem(w, newProblem("accountDoesNotExist", "no account for this key", http.StatusBadRequest))
+		return
+	}
+
+	acc := &account{id: randomID(), key: key, contact: body.Contact}
+	s.accounts[acc.id] = acc
+	s.thumbprints[thumbprint] = acc.id
+	s.writeObject(w, http.StatusCreated, s.baseURL+"/account/"+acc.id, s.accountJSON(acc))
+}
+
+func (s *Server) handleAccount(w http.ResponseWriter, r *http.Request) {
+	header, _, _, prob := s.readRequest(r, false)
+	if prob != nil {
+		s.writeProblem(w, prob)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc := s.accounts[r.PathValue("id")]
+	if acc == nil || header.KID != s.baseURL+"/account/"+acc.id {
+		s.writeProblem(w, unauthorized("not your account"))
+		return
+	}
+
+	s.writeObject(w, http.StatusOK, "", s.accountJSON(acc))
+}
+
+func (s *Server) handleNewOrder(w http.ResponseWriter, r *http.Request) {
+	header, payload, _, prob := s.readRequest(r, false)
+	if prob != nil {
+		s.writeProblem(w, prob)
+		return
+	}
+
+	var body struct {
+		Identifiers []acme.AuthzID `json:"identifiers"`
+	}
+	if err := json.Unmarshal(payload, &body); err != nil || len(body.Identifiers) == 0 {
+		s.writeProblem(w, malformed("invalid order payload"))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o := &order{
+		id:          randomID(),
+		account:     header.KID,
+		status:      acme.StatusPending,
+		expires:     time.Now().Add(orderLifetime),
+		identifiers: body.Identifiers,
+	}
+
+	for _, identifier := range body.Identifiers {
+		if identifier.Type != "dns" {
+			s.writeProblem(w, newProblem("unsupportedIdentifier", "only dns identifiers are supported", http.StatusBadRequest))
+			return
+		}
+
+		name := strings.ToLower(strings.TrimSuffix(identifier.Value, "."))
+		authz := &authorization{
+			id:         randomID(),
+			account:    header.KID,
+			identifier: acme.AuthzID{Type: "dns", Value: strings.TrimPrefix(name, "*.")},
+			wildcard:   strings.HasPrefix(name, "*."),
+			status:     acme.StatusPending,
+			expires:    o.expires,
+		}
+
+		authz.challenge = &challenge{id: randomID(), token: randomID(), status: acme.StatusPending, authz: authz}
+		s.authzs[authz.id] = authz
+		s.challenges[authz.challenge.id] = authz.challenge
+		o.authzs = append(o.authzs, authz)
+	}
+
+	s.orders[o.id] = o
+	s.writeObject(w, http.StatusCreated, s.baseURL+"/order/"+o.id, s.orderJSON(o))
+}
+
+func (s *Server) handleOrder(w http.ResponseWriter, r *http.Request) {
+	header, _, _, prob := s.readRequest(r, false)
+	if prob != nil {
+		s.writeProblem(w, prob)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o := s.orders[r.PathValue("id")]
+	if o == nil || o.account != header.KID {
+		s.writeProblem(w, notFound())
+		return
+	}
+
+	s.writeObject(w, http.StatusOK, "", s.orderJSON(o))
+}
+
+func (s *Server) handleAuthorization(w http.ResponseWriter, r *http.Request) {
+	header, _, _, prob := s.readRequest(r, false)
+	if prob != nil {
+		s.writeProblem(w, prob)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	authz := s.authzs[r.PathValue("id")]
+	if authz == nil || authz.account != header.KID {
+		s.writeProblem(w, notFound())
+		return
+	}
+
+	s.writeObject(w, http.StatusOK, "", s.authzJSON(authz))
+}
+
+func (s *Server) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	header, payload, _, prob := s.readRequest(r, false)
+	if prob != nil {
+		s.writeProblem(w, prob)
+		return
+	}
+
+	s.mu.Lock()
+	chal := s.challenges[r.PathValue("id")]
+	if chal == nil || chal.authz.account != header.KID {
+		s.mu.Unlock()
+		s.writeProblem(w, notFound())
+		return
+	}
+
+	// an empty payload only fetches the challenge, "{}" asks for validation
+	validate := len(payload) > 0 && chal.status == acme.StatusPending
+	if validate {
+		chal.status = acme.StatusProcessing
+	}
+
+	name := chal.authz.identifier.Value
+	token := chal.token
+	key := s.accounts[strings.TrimPrefix(header.KID, s.baseURL+"/account/")].key
+	s.mu.Unlock()
+
+	if validate {
+		err := s.validateDNS01(name, token, key)
+
+		s.mu.Lock()
+		if err != nil {
+			chal.status = acme.StatusInvalid
+			chal.err = newProblem("unauthorized", err.Error(), http.StatusForbidden)
+			chal.authz.status = acme.StatusInvalid
+		} else {
+			chal.status = acme.StatusValid
+			chal.authz.status = acme.StatusValid
+		}
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Add("Link", fmt.Sprintf(`<%s/authz/%s>;rel="up"`, s.baseURL, chal.authz.id))
+	s.writeObject(w, http.StatusOK, "", s.challengeJSON(chal))
+}
+
+// validateDNS01 looks up the _acme-challenge TXT record of a name at the resolver
+func (s *Server) validateDNS01(name, token string, key crypto.PublicKey) error {
+	thumbprint, err := acme.JWKThumbprint(key)
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256([]byte(token + "." + thumbprint))
+	expected := base64.RawURLEncoding.EncodeToString(digest[:])
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn("_acme-challenge."+name), dns.TypeTXT)
+	client := &dns.Client{Timeout: 5 * time.Second}
+	resp, _, err := client.Exchange(msg, s.config.Resolver)
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.Exchange(msg, s.config.Resolver)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to look up TXT records for %s: %w", name, err)
+	}
+
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == expected {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no matching TXT record for _acme-challenge.%s", name)
+}
+
+func (s *Server) handleFinalize(w http.ResponseWriter, r *http.Request) {
+	header, payload, _, prob := s.readRequest(r, false)
+	if prob != nil {
+		s.writeProblem(w, prob)
+		return
+	}
+
+	var body struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		s.writeProblem(w, malformed("invalid finalize payload"))
+		return
+	}
+
+	der, err := base64.RawURLEncoding.DecodeString(body.CSR)
+	if err != nil {
+		s.writeProblem(w, newProblem("badCSR", err.Error(), http.StatusBadRequest))
+		return
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		s.writeProblem(w, newProblem("badCSR", err.Error(), http.StatusBadRequest))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o := s.orders[r.PathValue("id")]
+	if o == nil || o.account != header.KID {
+		s.writeProblem(w, notFound())
+		return
+	}
+
+	if s.orderStatus(o) != acme.StatusReady {
+		s.writeProblem(w, newProblem("orderNotReady", "order is "+s.orderStatus(o), http.StatusForbidden))
+		return
+	}
+
+	names := make([]string, 0, len(o.identifiers))
+	for _, identifier := range o.identifiers {
+		names = append(names, strings.ToLower(strings.TrimSuffix(identifier.Value, ".")))
+	}
+
+	requested := slices.Clone(csr.DNSNames)
+	if csr.Subject.CommonName != "" && !slices.Contains(requested, csr.Subject.CommonName) {
+		requested = append(requested, csr.Subject.CommonName)
+	}
+
+	for i := range requested {
+		requested[i] = strings.ToLower(requested[i])
+	}
+
+	slices.Sort(names)
+	slices.Sort(requested)
+	if !slices.Equal(names, slices.Compact(requested)) {
+		s.writeProblem(w, newProblem("badCSR", "CSR names do not match the order", http.StatusBadRequest))
+		return
+	}
+
+	chain, err := s.issue(csr, names)
+	if err != nil {
+		s.writeProblem(w, newProblem("serverInternal", err.Error(), http.StatusInternalServerError))
+		return
+	}
+
+	o.certificate = randomID()
+	o.status = acme.StatusValid
+	s.certificates[o.certificate] = chain
+	s.writeObject(w, http.StatusOK, s.baseURL+"/order/"+o.id, s.orderJSON(o))
+}
+
+// issue signs a certificate for the names with the key of the CSR
+func (s *Server) issue(csr *x509.CertificateRequest, names []string) ([]byte, error) {
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(s.config.Validity),
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, s.root, csr.PublicKey, s.rootKey)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return append(chain, s.rootPEM...), nil
+}
+
+func (s *Server) handleCertificate(w http.ResponseWriter, r *http.Request) {
+	header, _, _, prob := s.readRequest(r, false)
+	if prob != nil {
+		s.writeProblem(w, prob)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := r.PathValue("id")
+	chain, ok := s.certificates[id]
+	owned := false
+	for _, o := range s.orders {
+		if o.certificate == id && o.account == header.KID {
+			owned = true
+			break
+		}
+	}
+
+	if !ok || !owned {
+		s.writeProblem(w, notFound())
+		return
+	}
+
+	w.Header().Set("Replay-Nonce", s.nonce())
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.WriteHeader(http.StatusOK)
+	w.Write(chain)
+}
+
+// readRequest verifies the JWS of a request, new accounts sign with their jwk, everything else with a kid
+func (s *Server) readRequest(r *http.Request, newAccount bool) (*jwsHeader, []byte, crypto.PublicKey, *problem) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		return nil, nil, nil, malformed(err.Error())
+	}
+
+	header, payload, signed, err := parseJWS(body)
+	if err != nil {
+		return nil, nil, nil, malformed("invalid JWS: " + err.Error())
+	}
+
+	s.nonceMu.Lock()
+	_, validNonce := s.nonces[header.Nonce]
+	delete(s.nonces, header.Nonce)
+	s.nonceMu.Unlock()
+
+	s.mu.Lock()
+	var key crypto.PublicKey
+	if !newAccount {
+		if acc := s.accounts[strings.TrimPrefix(header.KID, s.baseURL+"/account/")]; acc != nil && strings.HasPrefix(header.KID, s.baseURL+"/account/") {
+			key = acc.key
+		}
+	}
+	s.mu.Unlock()
+
+	if !validNonce {
+		return nil, nil, nil, newProblem("badNonce", "unknown or reused nonce", http.StatusBadRequest)
+	}
+
+	if header.URL != s.baseURL+r.URL.Path {
+		return nil, nil, nil, unauthorized("url does not match the request")
+	}
+
+	if newAccount {
+		if header.JWK == nil || header.KID != "" {
+			return nil, nil, nil, malformed("new accounts must sign with a jwk")
+		}
+
+		if key, err = publicKey(header.JWK); err != nil {
+			return nil, nil, nil, newProblem("badPublicKey", err.Error(), http.StatusBadRequest)
+		}
+	} else {
+		if header.KID == "" || header.JWK != nil {
+			return nil, nil, nil, malformed("requests must sign with a kid")
+		}
+
+		if key == nil {
+			return nil, nil, nil, newProblem("accountDoesNotExist", "unknown account", http.StatusBadRequest)
+		}
+	}
+
+	if err := signed.verify(header.Alg, key); err != nil {
+		return nil, nil, nil, newProblem("badSignatureAlgorithm", err.Error(), http.StatusBadRequest)
+	}
+
+	return header, payload, key, nil
+}
+
+// orderStatus advances an order by the state of its authorizations
+func (s *Server) orderStatus(o *order) string {
+	if o.status != acme.StatusPending {
+		return o.status
+	}
+
+	if time.Now().After(o.expires) {
+		o.status = acme.StatusInvalid
+		return o.status
+	}
+
+	ready := true
+	for _, authz := range o.authzs {
+		switch authz.status {
+		case acme.StatusInvalid:
+			o.status = acme.StatusInvalid
+			return o.status
+		case acme.StatusValid:
+		default:
+			ready = false
+		}
+	}
+
+	if ready {
+		o.status = acme.StatusReady
+	}
+
+	return o.status
+}
+
+func (s *Server) accountJSON(acc *account) map[string]any {
+	return map[string]any{
+		"status":  acme.StatusValid,
+		"contact": acc.contact,
+		"orders":  s.baseURL + "/account/" + acc.id + "/orders",
+	}
+}
+
+func (s *Server) orderJSON(o *order) map[string]any {
+	authzs := make([]string, 0, len(o.authzs))
+	for _, authz := range o.authzs {
+		authzs = append(authzs, s.baseURL+"/authz/"+authz.id)
+	}
+
+	obj := map[string]any{
+		"status":         s.orderStatus(o),
+		"expires":        o.expires.Format(time.RFC3339),
+		"identifiers":    o.identifiers,
+		"authorizations": authzs,
+		"finalize":       s.baseURL + "/finalize/" + o.id,
+	}
+
+	if o.certificate != "" {
+		obj["certificate"] = s.baseURL + "/cert/" + o.certificate
+	}
+
+	return obj
+}
+
+func (s *Server) authzJSON(authz *authorization) map[string]any {
+	return map[string]any{
+		"status":     authz.status,
+		"expires":    authz.expires.Format(time.RFC3339),
+		"identifier": authz.identifier,
+		"wildcard":   authz.wildcard,
+		"challenges": []any{s.challengeJSON(authz.challenge)},
+	}
+}
+
+func (s *Server) challengeJSON(chal *challenge) map[string]any {
+	obj := map[string]any{
+		"type":   "dns-01",
+		"url":    s.baseURL + "/chal/" + chal.id,
+		"token":  chal.token,
+		"status": chal.status,
+	}
+
+	if chal.err != nil {
+		obj["error"] = chal.err
+	}
+
+	return obj
+}
+
+func (s *Server) nonce() string {
+	s.nonceMu.Lock()
+	defer s.nonceMu.Unlock()
+
+	nonce := randomID()
+	s.nonces[nonce] = struct{}{}
+	return nonce
+}
+
+// writeObject writes an ACME object with a fresh nonce
+func (s *Server) writeObject(w http.ResponseWriter, status int, location string, obj any) {
+	w.Header().Set("Replay-Nonce", s.nonce())
+	if location != "" {
+		w.Header().Set("Location", location)
+	}
+
+	writeJSON(w, status, obj)
+}
+
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (s *Server) writeProblem(w http.ResponseWriter, prob *problem) {
+	w.Header().Set("Replay-Nonce", s.nonce())
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(prob.Status)
+	json.NewEncoder(w).Encode(prob)
+}
+
+func newProblem(kind, detail string, status int) *problem {
+	return &problem{Type: "urn:ietf:params:acme:error:" + kind, Detail: detail, Status: status}
+}
+
+func malformed(detail string) *problem {
+	return newProblem("malformed", detail, http.StatusBadRequest)
+}
+
+func unauthorized(detail string) *problem {
+	return newProblem("unauthorized", detail, http.StatusForbidden)
+}
+
+func notFound() *problem {
+	return newProblem("malformed", "not found", http.StatusNotFound)
+}
+
+func writeJSON(w http.ResponseWriter, status int, obj any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(obj)
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	return serial
+}
@@ -1,8 +1,12 @@
 package types
 
 import (
+	"crypto/x509"
+	"fmt"
+	"strings"
 	"time"
 
+	"github.com/fxamacker/cbor/v2"
 	"github.com/miekg/dns"
 )
 
@@ -17,9 +21,150 @@ type RecordMetadata struct {
 	Geo       bool   `json:"geo"`
 	IPCompat  bool
 	SSLInfo   SSLInfo
+	Policy    *RecordPolicy `json:"policy,omitempty"`
+	Origin    *OriginConfig `json:"origin,omitempty"`
+}
+
+const (
+	OriginVerifyFull   = "full"   // system roots, certificate must match the SNI
+	OriginVerifyStrict = "strict" // only the custom CA, certificate must match the SNI
+	OriginVerifyOff    = "off"
+)
+
+// OriginConfig describes how the reverse proxy connects to a protected record
+type OriginConfig struct {
+	Scheme string `json:"scheme,omitempty"` // http (default) or https
+	Port   int    `json:"port,omitempty"`   // defaults to 80 (http) or 443 (https)
+	SNI    string `json:"sni,omitempty"`    // https only, defaults to the record name
+	Host   string `json:"host,omitempty"`   // Host header sent to the origin, defaults to the requested host
+	Verify string `json:"verify,omitempty"` // https only: full (default), strict or off
+	CA     string `json:"ca,omitempty"`     // PEM encoded CA certificates for strict
+}
+
+// Validate normalizes the config and rejects unusable values
+func (cfg *OriginConfig) Validate() error {
+	cfg.Scheme = strings.ToLower(cfg.Scheme)
+	switch cfg.Scheme {
+	case "":
+		cfg.Scheme = "http"
+	case "http", "https":
+	default:
+		return fmt.Errorf("unknown origin scheme %q", cfg.Scheme)
+	}
+
+	if cfg.Port < 0 || cfg.Port > 65535 {
+		return fmt.Errorf("invalid origin port %d", cfg.Port)
+	}
+
+	cfg.Verify = strings.ToLower(cfg.Verify)
+	switch cfg.Verify {
+	case "":
+		cfg.Verify = OriginVerifyFull
+	case OriginVerifyFull, OriginVerifyOff:
+	case OriginVerifyStrict:
+		if !x509.NewCertPool().AppendCertsFromPEM([]byte(cfg.CA)) {
+			return fmt.Errorf("strict verification needs a PEM encoded CA")
+		}
+	default:
+		return fmt.Errorf("unknown origin verification mode %q", cfg.Verify)
+	}
+
+	return nil
+}
+
+// TargetPort returns the configured port or the default of the scheme
+func (cfg *OriginConfig) TargetPort() int {
+	if cfg.Port != 0 {
+		return cfg.Port
+	}
+
+	if cfg.Scheme == "https" {
+		return 443
+	}
+
+	return 80
+}
+
+const (
+	PolicyWeighted = "weighted"
+	PolicyFailover = "failover"
+)
+
+// RecordPolicy steers traffic across the records of one RRset
+type RecordPolicy struct {
+	Mode     string       `json:"mode"`               // weighted, failover
+	Weight   uint16       `json:"weight,omitempty"`   // weighted: relative share, 0 counts as 1
+	Priority uint16       `json:"priority,omitempty"` // failover: lowest healthy priority wins
+	Check    *HealthCheck `json:"check,omitempty"`
+}
+
+// HealthCheck probes the record's target from every node
+type HealthCheck struct {
+	Type     string `json:"type"`               // tcp, http, https
+	Port     int    `json:"port,omitempty"`     // defaults to 80 (tcp, http) or 443 (https)
+	Path     string `json:"path,omitempty"`     // http(s) only, defaults to /
+	Host     string `json:"host,omitempty"`     // http(s) Host header, defaults to the record name
+	Interval int    `json:"interval,omitempty"` // seconds, defaults to 30
+	Timeout  int    `json:"timeout,omitempty"`  // seconds, defaults to 5
+	Status   int    `json:"status,omitempty"`   // expected http status, defaults to any 2xx/3xx
+}
+
+// Validate normalizes the check and rejects unusable values
+func (check *HealthCheck) Validate() error {
+	check.Type = strings.ToLower(check.Type)
+	switch check.Type {
+	case "tcp", "http", "https":
+	default:
+		return fmt.Errorf("unknown health check type %q", check.Type)
+	}
+
+	if check.Port < 0 || check.Port > 65535 {
+		return fmt.Errorf("invalid health check port %d", check.Port)
+	}
+
+	if check.Interval < 0 || check.Timeout < 0 {
+		return fmt.Errorf("health check interval and timeout must not be negative")
+	}
+
+	return nil
 }
 
 type DNSRecord struct {
 	RR       dns.RR
 	Metadata RecordMetadata
 }
+
+// dnsRecordWire carries the RR in zone file format, cbor can't decode into the dns.RR interface
+type dnsRecordWire struct {
+	RR       string
+	Metadata RecordMetadata
+}
+
+func (r DNSRecord) MarshalCBOR() ([]byte, error) {
+	wire := dnsRecordWire{Metadata: r.Metadata}
+	if r.RR != nil {
+		wire.RR = r.RR.String()
+	}
+
+	return cbor.Marshal(wire)
+}
+
+func (r *DNSRecord) UnmarshalCBOR(data []byte) error {
+	var wire dnsRecordWire
+	if err := cbor.Unmarshal(data, &wire); err != nil {
+		return err
+	}
+
+	r.RR, r.Metadata = nil, wire.Metadata
+	if wire.RR == "" {
+		return nil
+	}
+
+	rr, err := dns.NewRR(wire.RR)
+	if err != nil {
+		return fmt.Errorf("invalid record %q: %w", wire.RR, err)
+	}
+
+	r.RR = rr
+	return nil
+}
@@ -1 +1,239 @@
 package types
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// RateLimit throttles the requests to a domain, the longest matching PathPrefix applies
+type RateLimit struct {
+	PathPrefix string  // empty -> every path
+	Key        string  // ip, prefix (/24, /56), header:<name> or cookie:<name>
+	Rate       float64 // requests per second
+	Burst      int     // bucket size, 0 -> rate
+}
+
+// Validate normalizes the limit and rejects unusable values
+func (rl *RateLimit) Validate() error {
+	if rl.Rate <= 0 {
+		return fmt.Errorf("rate must be positive")
+	}
+
+	if rl.Burst < 0 {
+		return fmt.Errorf("burst must not be negative")
+	}
+
+	if rl.PathPrefix != "" && !strings.HasPrefix(rl.PathPrefix, "/") {
+		return fmt.Errorf("path prefix %q must start with /", rl.PathPrefix)
+	}
+
+	kind, name, _ := strings.Cut(rl.Key, ":")
+	switch strings.ToLower(kind) {
+	case "", "ip":
+		rl.Key = "ip"
+	case "prefix":
+		rl.Key = "prefix"
+	case "header":
+		if name == "" {
+			return fmt.Errorf("header key needs a header name")
+		}
+
+		rl.Key = "header:" + http.CanonicalHeaderKey(name)
+	case "cookie":
+		if name == "" {
+			return fmt.Errorf("cookie key needs a cookie name")
+		}
+
+		rl.Key = "cookie:" + name
+	default:
+		return fmt.Errorf("unknown rate limit key %q", rl.Key)
+	}
+
+	return nil
+}
+
+const (
+	BalanceRoundRobin = "round_robin"
+	BalanceLeastConn  = "least_conn"
+	BalanceIPHash     = "ip_hash"
+	BalanceWeighted   = "weighted"
+)
+
+// Balancer spreads the requests to a protected name across the origins of its records
+type Balancer struct {
+	Strategy  string // round_robin (default), least_conn, ip_hash or weighted (RecordPolicy.Weight)
+	Sticky    bool   // pins clients to their first origin with a signed cookie
+	StickyTTL int    // seconds, 0 -> session cookie
+}
+
+// Validate normalizes the balancer and rejects unusable values
+func (b *Balancer) Validate() error {
+	b.Strategy = strings.ToLower(b.Strategy)
+	switch b.Strategy {
+	case "":
+		b.Strategy = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConn, BalanceIPHash, BalanceWeighted:
+	default:
+		return fmt.Errorf("unknown balancing strategy %q", b.Strategy)
+	}
+
+	if b.StickyTTL < 0 {
+		return fmt.Errorf("sticky ttl must not be negative")
+	}
+
+	return nil
+}
+
+const (
+	TimeoutsDefault   = "default"
+	TimeoutsStreaming = "streaming"
+	TimeoutsLong      = "long"
+
+	MaxResponseHeaderTimeout = 120 // seconds
+	maxTimeout               = 3600
+)
+
+// ProxyTimeouts limits how long the reverse proxy waits for the clients and origins
+// of a domain, fields left at 0 come from the profile
+type ProxyTimeouts struct {
+	Profile        string // default, streaming or long
+	ResponseHeader int    // seconds until the origin starts its response
+	Response       int    // seconds for the whole response, -1 -> unlimited as long as data flows within Idle
+	Idle           int    // seconds without traffic on streamed responses and upgraded connections
+	Read           int    // seconds to read the request body
+}
+
+var TimeoutProfiles = map[string]ProxyTimeouts{
+	TimeoutsDefault:   {Profile: TimeoutsDefault, ResponseHeader: 5, Response: 10, Idle: 60, Read: 2},
+	TimeoutsStreaming: {Profile: TimeoutsStreaming, ResponseHeader: 30, Response: -1, Idle: 120, Read: 30},
+	TimeoutsLong:      {Profile: TimeoutsLong, ResponseHeader: 120, Response: 600, Idle: 120, Read: 300},
+}
+
+// Validate normalizes the timeouts and rejects unusable values
+func (t *ProxyTimeouts) Validate() error {
+	t.Profile = strings.ToLower(t.Profile)
+	if t.Profile == "" {
+		t.Profile = TimeoutsDefault
+	}
+
+	if _, ok := TimeoutProfiles[t.Profile]; !ok {
+		return fmt.Errorf("unknown timeout profile %q", t.Profile)
+	}
+
+	if t.ResponseHeader < 0 || t.ResponseHeader > MaxResponseHeaderTimeout {
+		return fmt.Errorf("response header timeout must be between 0 and %d", MaxResponseHeaderTimeout)
+	}
+
+	if t.Response < -1 || t.Response > maxTimeout {
+		return fmt.Errorf("response timeout must be between -1 and %d", maxTimeout)
+	}
+
+	if t.Idle < 0 || t.Idle > maxTimeout || t.Read < 0 || t.Read > maxTimeout {
+		return fmt.Errorf("idle and read timeouts must be between 0 and %d", maxTimeout)
+	}
+
+	return nil
+}
+
+// Resolve fills the unset fields from the profile
+func (t ProxyTimeouts) Resolve() ProxyTimeouts {
+	profile, ok := TimeoutProfiles[t.Profile]
+	if !ok {
+		profile = TimeoutProfiles[TimeoutsDefault]
+	}
+
+	if t.ResponseHeader == 0 {
+		t.ResponseHeader = profile.ResponseHeader
+	}
+
+	if t.Response == 0 {
+		t.Response = profile.Response
+	}
+
+	if t.Idle == 0 {
+		t.Idle = profile.Idle
+	}
+
+	if t.Read == 0 {
+		t.Read = profile.Read
+	}
+
+	t.Profile = profile.Profile
+	return t
+}
+
+const (
+	EncodingBrotli = "br"
+	EncodingZstd   = "zstd"
+	EncodingGzip   = "gzip"
+
+	DefaultCompressionMinSize = 1024 // bytes
+)
+
+// Encodings the reverse proxy can compress with, in order of preference
+var Encodings = []string{EncodingBrotli, EncodingZstd, EncodingGzip}
+
+// Compression enables on the fly compression of proxied responses
+type Compression struct {
+	Enabled   bool
+	MinSize   int      // bytes, responses of known smaller length are sent as they are, 0 -> 1024
+	Encodings []string // subset of br, zstd and gzip, empty -> all
+}
+
+// Validate normalizes the compression settings and rejects unusable values
+func (c *Compression) Validate() error {
+	if c.MinSize < 0 {
+		return fmt.Errorf("minimum size must not be negative")
+	}
+
+	encodings := make([]string, 0, len(c.Encodings))
+	for _, encoding := range c.Encodings {
+		encoding = strings.ToLower(encoding)
+		if !slices.Contains(Encodings, encoding) {
+			return fmt.Errorf("unknown encoding %q", encoding)
+		}
+
+		if !slices.Contains(encodings, encoding) {
+			encodings = append(encodings, encoding)
+		}
+	}
+
+	c.Encodings = encodings
+	return nil
+}
+
+const (
+	MetadataExif    = "exif"
+	MetadataXMP     = "xmp"
+	MetadataIPTC    = "iptc"
+	MetadataComment = "comment"
+)
+
+// MetadataTypes the reverse proxy can strip from images
+var MetadataTypes = []string{MetadataExif, MetadataXMP, MetadataIPTC, MetadataComment}
+
+// ImageMetadata strips metadata from proxied JPEG, PNG, WebP, GIF and AVIF/HEIF images
+type ImageMetadata struct {
+	Enabled bool
+	Strip   []string // subset of exif, xmp, iptc and comment, empty -> all
+}
+
+// Validate normalizes the metadata settings and rejects unknown types
+func (m *ImageMetadata) Validate() error {
+	strip := make([]string, 0, len(m.Strip))
+	for _, metadataType := range m.Strip {
+		metadataType = strings.ToLower(metadataType)
+		if !slices.Contains(MetadataTypes, metadataType) {
+			return fmt.Errorf("unknown metadata type %q", metadataType)
+		}
+
+		if !slices.Contains(strip, metadataType) {
+			strip = append(strip, metadataType)
+		}
+	}
+
+	m.Strip = strip
+	return nil
+}
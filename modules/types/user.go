@@ -11,5 +11,6 @@ type User struct {
 	Avatar        string // `json:"avatar"`
 	WorkerScripts []workers.WorkerScript
 	ErrorPages    map[int]string
+	WAFRules      map[string]string // domain -> rule source
 	CreatedAt     time.Time
 }
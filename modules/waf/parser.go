@@ -0,0 +1,517 @@
+package waf
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNewline
+	tokWord
+	tokString
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+	tokComma
+	tokEq
+	tokNeq
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	line int
+	col  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of input"
+	case tokNewline:
+		return "end of line"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+
+	return fmt.Sprintf("%q", t.text)
+}
+
+// ParseError points at the offending position of the rule source
+type ParseError struct {
+	Line int
+	Col  int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Col, e.Msg)
+}
+
+func errorAt(t token, format string, a ...any) *ParseError {
+	return &ParseError{Line: t.line, Col: t.col, Msg: fmt.Sprintf(format, a...)}
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_.:/-", r)
+}
+
+// lex splits the source into tokens, newlines inside () and [] are skipped
+func lex(src string) ([]token, error) {
+	var (
+		tokens []token
+		depth  int
+		line   = 1
+		col    = 1
+		runes  = []rune(src)
+	)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := token{line: line, col: col}
+
+		switch {
+		case r == '\n':
+			if depth == 0 {
+				start.kind = tokNewline
+				tokens = append(tokens, start)
+			}
+
+			i++
+			line++
+			col = 1
+			continue
+		case unicode.IsSpace(r):
+			i++
+			col++
+			continue
+		case r == '#':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			continue
+		case r == '"':
+			j := i + 1
+			for j < len(runes) && runes[j] != '"' {
+				if runes[j] == '\\' {
+					j++
+				}
+
+				if j < len(runes) && runes[j] == '\n' {
+					break
+				}
+
+				j++
+			}
+
+			if j >= len(runes) || runes[j] != '"' {
+				return nil, &ParseError{Line: line, Col: col, Msg: "unterminated string"}
+			}
+
+			text, err := strconv.Unquote(string(runes[i : j+1]))
+			if err != nil {
+				return nil, &ParseError{Line: line, Col: col, Msg: "invalid escape sequence in string"}
+			}
+
+			start.kind, start.text = tokString, text
+			tokens = append(tokens, start)
+			col += j + 1 - i
+			i = j + 1
+			continue
+		case r == '=' || r == '!':
+			if i+1 >= len(runes) || runes[i+1] != '=' {
+				return nil, &ParseError{Line: line, Col: col, Msg: fmt.Sprintf("unexpected %q, did you mean %q?", string(r), string(r)+"=")}
+			}
+
+			start.kind, start.text = tokEq, "=="
+			if r == '!' {
+				start.kind, start.text = tokNeq, "!="
+			}
+
+			tokens = append(tokens, start)
+			i += 2
+			col += 2
+			continue
+		case strings.ContainsRune("()[],", r):
+			start.text = string(r)
+			switch r {
+			case '(':
+				start.kind = tokLParen
+				depth++
+			case ')':
+				start.kind = tokRParen
+				depth = max(0, depth-1)
+			case '[':
+				start.kind = tokLBracket
+				depth++
+			case ']':
+				start.kind = tokRBracket
+				depth = max(0, depth-1)
+			case ',':
+				start.kind = tokComma
+			}
+
+			tokens = append(tokens, start)
+			i++
+			col++
+			continue
+		case isWordRune(r):
+			j := i
+			for j < len(runes) && isWordRune(runes[j]) {
+				j++
+			}
+
+			start.kind, start.text = tokWord, string(runes[i:j])
+			tokens = append(tokens, start)
+			col += j - i
+			i = j
+			continue
+		}
+
+		return nil, &ParseError{Line: line, Col: col, Msg: fmt.Sprintf("unexpected character %q", string(r))}
+	}
+
+	return append(tokens, token{kind: tokEOF, line: line, col: col}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	set    *RuleSet
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+func (p *parser) skipNewlines() {
+	for p.peek().kind == tokNewline {
+		p.next()
+	}
+}
+
+func (p *parser) isWord(text string) bool {
+	t := p.peek()
+	return t.kind == tokWord && strings.EqualFold(t.text, text)
+}
+
+// Parse compiles a rule set, every rule is "<action> if <condition>" on its own line
+func Parse(src string) (*RuleSet, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens, set: &RuleSet{Source: src}}
+	for {
+		p.skipNewlines()
+		if p.peek().kind == tokEOF {
+			return p.set, nil
+		}
+
+		rule, err := p.parseRule()
+		if err != nil {
+			return nil, err
+		}
+
+		p.set.Rules = append(p.set.Rules, rule)
+	}
+}
+
+func (p *parser) parseRule() (*Rule, error) {
+	t := p.next()
+	action, ok := actions[strings.ToLower(t.text)]
+	if t.kind != tokWord || !ok {
+		return nil, errorAt(t, "expected an action (block, challenge, log, allow), found %s", t)
+	}
+
+	if !p.isWord("if") {
+		return nil, errorAt(p.peek(), "expected \"if\" after %q, found %s", t.text, p.peek())
+	}
+	p.next()
+
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if end := p.peek(); end.kind != tokNewline && end.kind != tokEOF {
+		return nil, errorAt(end, "expected \"and\", \"or\" or the end of the rule, found %s", end)
+	}
+
+	return &Rule{Line: t.line, Action: action, Condition: cond}, nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isWord("or") {
+		p.next()
+		p.skipNewlines()
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &orNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isWord("and") {
+		p.next()
+		p.skipNewlines()
+
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &andNode{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.isWord("not") {
+		p.next()
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		return &notNode{inner}, nil
+	}
+
+	if p.peek().kind == tokLParen {
+		p.next()
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if t := p.next(); t.kind != tokRParen {
+			return nil, errorAt(t, "expected \")\", found %s", t)
+		}
+
+		return inner, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	t := p.next()
+	if t.kind != tokWord {
+		return nil, errorAt(t, "expected a field (%s), found %s", fieldNames, t)
+	}
+
+	f, ok := fields[strings.ToLower(t.text)]
+	if !ok {
+		return nil, errorAt(t, "unknown field %q, expected one of %s", t.text, fieldNames)
+	}
+
+	cmp := &comparison{field: f}
+	if f.keyed {
+		if p.peek().kind != tokLBracket {
+			return nil, errorAt(p.peek(), "field %q needs a name, e.g. %s[\"name\"]", f.name, f.name)
+		}
+		p.next()
+
+		key := p.next()
+		if key.kind != tokString {
+			return nil, errorAt(key, "expected a quoted name for %s[...], found %s", f.name, key)
+		}
+
+		if end := p.next(); end.kind != tokRBracket {
+			return nil, errorAt(end, "expected \"]\", found %s", end)
+		} else if f.name == "header" {
+			cmp.key = strings.ToLower(key.text)
+		} else {
+			cmp.key = key.text
+		}
+	} else if f.name == "query" && p.peek().kind == tokLBracket {
+		return nil, errorAt(p.peek(), "query is the whole query string, use param[\"name\"] for a single parameter")
+	}
+
+	p.set.uses |= f.uses
+
+	opToken := p.next()
+	op, err := parseOperator(opToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if !f.supports(op) {
+		return nil, errorAt(opToken, "operator %q is not supported for field %q", opToken.text, f.name)
+	}
+
+	cmp.op = op
+	valueToken := p.peek()
+	if op == opIn {
+		values, err := p.parseList(f)
+		if err != nil {
+			return nil, err
+		}
+
+		cmp.values = values
+		return cmp, nil
+	}
+
+	v, err := p.parseValue(f, op)
+	if err != nil {
+		return nil, err
+	}
+
+	if op == opMatches {
+		re, err := regexp.Compile(v.str)
+		if err != nil {
+			return nil, errorAt(valueToken, "invalid regular expression: %v", err)
+		}
+
+		v.re = re
+	}
+
+	cmp.values = []value{v}
+	return cmp, nil
+}
+
+func parseOperator(t token) (operator, error) {
+	switch t.kind {
+	case tokEq:
+		return opEq, nil
+	case tokNeq:
+		return opNeq, nil
+	case tokWord:
+		if op, ok := wordOperators[strings.ToLower(t.text)]; ok {
+			return op, nil
+		}
+	}
+
+	return 0, errorAt(t, "expected an operator (==, !=, contains, starts_with, ends_with, matches, in), found %s", t)
+}
+
+// parseList parses [v, v, ...], a single value is accepted as a list of one
+func (p *parser) parseList(f *field) ([]value, error) {
+	if p.peek().kind != tokLBracket {
+		v, err := p.parseValue(f, opIn)
+		if err != nil {
+			return nil, err
+		}
+
+		return []value{v}, nil
+	}
+
+	open := p.next()
+	var values []value
+	for {
+		if p.peek().kind == tokRBracket {
+			p.next()
+			break
+		}
+
+		if p.peek().kind == tokEOF {
+			return nil, errorAt(open, "unclosed \"[\"")
+		}
+
+		v, err := p.parseValue(f, opIn)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, v)
+
+		t := p.peek()
+		if t.kind == tokComma {
+			p.next()
+			continue
+		}
+
+		if t.kind != tokRBracket {
+			return nil, errorAt(t, "expected \",\" or \"]\" in list, found %s", t)
+		}
+	}
+
+	if len(values) == 0 {
+		return nil, errorAt(open, "empty list")
+	}
+
+	return values, nil
+}
+
+func (p *parser) parseValue(f *field, op operator) (value, error) {
+	t := p.next()
+	if t.kind != tokString && t.kind != tokWord {
+		return value{}, errorAt(t, "expected a value for %q, found %s", f.name, t)
+	}
+
+	switch f.kind {
+	case kindIP:
+		if op == opIn {
+			if _, network, err := net.ParseCIDR(t.text); err == nil {
+				return value{network: network}, nil
+			}
+		}
+
+		ip := net.ParseIP(t.text)
+		if ip == nil {
+			if op == opIn {
+				return value{}, errorAt(t, "%s is not an IP address or CIDR", t)
+			}
+
+			return value{}, errorAt(t, "%s is not an IP address", t)
+		}
+
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+
+		return value{network: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}, nil
+	case kindNumber:
+		n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(t.text), "AS"), 10, 32)
+		if err != nil {
+			return value{}, errorAt(t, "%s is not a number", t)
+		}
+
+		return value{num: uint(n)}, nil
+	}
+
+	if t.kind != tokString {
+		return value{}, errorAt(t, "expected a quoted string for %q, found %s", f.name, t)
+	}
+
+	// regular expressions are used as written, (?i) makes them case insensitive
+	if op == opMatches {
+		return value{str: t.text}, nil
+	}
+
+	return value{str: f.normalize(t.text)}, nil
+}
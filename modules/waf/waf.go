@@ -0,0 +1,298 @@
+package waf
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+	Web application firewall rules
+
+	# one rule per line, evaluated top to bottom
+	allow if ip in [10.0.0.0/8, 192.168.0.0/16]
+	block if path starts_with "/wp-admin" and not country in ["NL", "BE"]
+	challenge if header["user-agent"] matches "(?i)curl|python" or asn == 14061
+	log if method == "POST" and body contains "<script"
+
+	block and challenge stop the evaluation, allow stops it without an action and
+	log records the match and continues with the next rule.
+*/
+
+type Action int
+
+const (
+	ActionNone Action = iota
+	ActionBlock
+	ActionChallenge
+	ActionLog
+	ActionAllow
+)
+
+var actions = map[string]Action{
+	"block":     ActionBlock,
+	"challenge": ActionChallenge,
+	"log":       ActionLog,
+	"allow":     ActionAllow,
+}
+
+func (a Action) String() string {
+	for name, action := range actions {
+		if action == a {
+			return name
+		}
+	}
+
+	return "none"
+}
+
+// Request is the part of an HTTP request the rules can look at
+type Request struct {
+	Method  string
+	Host    string
+	Path    string
+	Query   url.Values
+	Header  http.Header
+	IP      net.IP
+	Country string
+	ASN     uint
+	Body    []byte
+}
+
+type Rule struct {
+	Line      int
+	Action    Action
+	Condition node
+}
+
+type RuleSet struct {
+	Source string
+	Rules  []*Rule
+	uses   uses
+}
+
+type uses int
+
+const (
+	usesBody uses = 1 << iota
+	usesCountry
+	usesASN
+)
+
+// UsesBody reports whether the request body has to be read before evaluating
+func (s *RuleSet) UsesBody() bool { return s.uses&usesBody != 0 }
+
+func (s *RuleSet) UsesCountry() bool { return s.uses&usesCountry != 0 }
+
+func (s *RuleSet) UsesASN() bool { return s.uses&usesASN != 0 }
+
+// UsesChallenge reports whether a rule challenges the client
+func (s *RuleSet) UsesChallenge() bool {
+	for _, rule := range s.Rules {
+		if rule.Action == ActionChallenge {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Evaluate returns the terminating action and its rule, logged matches are passed to onLog
+func (s *RuleSet) Evaluate(req *Request, onLog func(*Rule)) (Action, *Rule) {
+	for _, rule := range s.Rules {
+		if !rule.Condition.eval(req) {
+			continue
+		}
+
+		if rule.Action == ActionLog {
+			if onLog != nil {
+				onLog(rule)
+			}
+			continue
+		}
+
+		return rule.Action, rule
+	}
+
+	return ActionNone, nil
+}
+
+type node interface {
+	eval(req *Request) bool
+}
+
+type andNode struct{ left, right node }
+
+func (n *andNode) eval(req *Request) bool { return n.left.eval(req) && n.right.eval(req) }
+
+type orNode struct{ left, right node }
+
+func (n *orNode) eval(req *Request) bool { return n.left.eval(req) || n.right.eval(req) }
+
+type notNode struct{ inner node }
+
+func (n *notNode) eval(req *Request) bool { return !n.inner.eval(req) }
+
+type operator int
+
+const (
+	opEq operator = iota
+	opNeq
+	opContains
+	opStartsWith
+	opEndsWith
+	opMatches
+	opIn
+)
+
+var wordOperators = map[string]operator{
+	"contains":    opContains,
+	"starts_with": opStartsWith,
+	"ends_with":   opEndsWith,
+	"matches":     opMatches,
+	"in":          opIn,
+}
+
+type fieldKind int
+
+const (
+	kindString fieldKind = iota
+	kindIP
+	kindNumber
+)
+
+type field struct {
+	name  string
+	kind  fieldKind
+	keyed bool
+	lower bool // compared case insensitively
+	upper bool
+	uses  uses
+	get   func(req *Request, key string) string
+}
+
+func (f *field) supports(op operator) bool {
+	if f.kind == kindString {
+		return true
+	}
+
+	return op == opEq || op == opNeq || op == opIn
+}
+
+func (f *field) normalize(s string) string {
+	switch {
+	case f.lower:
+		return strings.ToLower(s)
+	case f.upper:
+		return strings.ToUpper(s)
+	}
+
+	return s
+}
+
+var fields = map[string]*field{
+	"method": {name: "method", upper: true, get: func(req *Request, _ string) string { return strings.ToUpper(req.Method) }},
+	"host":   {name: "host", lower: true, get: func(req *Request, _ string) string { return strings.ToLower(req.Host) }},
+	"path":   {name: "path", get: func(req *Request, _ string) string { return req.Path }},
+	"query": {name: "query", get: func(req *Request, _ string) string {
+		return req.Query.Encode()
+	}},
+	"param": {name: "param", keyed: true, get: func(req *Request, key string) string {
+		return req.Query.Get(key)
+	}},
+	"header": {name: "header", keyed: true, get: func(req *Request, key string) string {
+		return strings.Join(req.Header.Values(key), ", ")
+	}},
+	"body":    {name: "body", uses: usesBody, get: func(req *Request, _ string) string { return string(req.Body) }},
+	"country": {name: "country", upper: true, uses: usesCountry, get: func(req *Request, _ string) string { return strings.ToUpper(req.Country) }},
+	"ip":      {name: "ip", kind: kindIP},
+	"asn":     {name: "asn", kind: kindNumber, uses: usesASN},
+}
+
+var fieldNames = func() string {
+	names := make([]string, 0, len(fields))
+	for name, f := range fields {
+		if f.keyed {
+			name += "[...]"
+		}
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}()
+
+type value struct {
+	str     string
+	num     uint
+	network *net.IPNet
+	re      *regexp.Regexp
+}
+
+type comparison struct {
+	field  *field
+	key    string
+	op     operator
+	values []value
+}
+
+func (c *comparison) eval(req *Request) bool {
+	switch c.field.kind {
+	case kindIP:
+		if req.IP == nil {
+			return false
+		}
+
+		matched := false
+		for _, v := range c.values {
+			if v.network.Contains(req.IP) {
+				matched = true
+				break
+			}
+		}
+
+		return matched != (c.op == opNeq)
+	case kindNumber:
+		// an unknown ASN never matches
+		if req.ASN == 0 {
+			return false
+		}
+
+		matched := false
+		for _, v := range c.values {
+			if v.num == req.ASN {
+				matched = true
+				break
+			}
+		}
+
+		return matched != (c.op == opNeq)
+	}
+
+	actual := c.field.get(req, c.key)
+	switch c.op {
+	case opEq:
+		return actual == c.values[0].str
+	case opNeq:
+		return actual != c.values[0].str
+	case opContains:
+		return strings.Contains(actual, c.values[0].str)
+	case opStartsWith:
+		return strings.HasPrefix(actual, c.values[0].str)
+	case opEndsWith:
+		return strings.HasSuffix(actual, c.values[0].str)
+	case opMatches:
+		return c.values[0].re.MatchString(actual)
+	case opIn:
+		for _, v := range c.values {
+			if actual == v.str {
+				return true
+			}
+		}
+	}
+
+	return false
+}
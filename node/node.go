@@ -80,6 +80,11 @@ func main() {
 		log.Fatal("Failed to connect to users DB: ", err)
 	}
 
+	err = postgresql.Manager.InitDB("logs")
+	if err != nil {
+		logger.Println("Failed to connect to logs DB, query logs are discarded: ", err)
+	}
+
 	wired_dns.DNSEventBus.Sub(event.Event_DNSDataBuilt, wired_dns.DNSEventChannel, func() { wired_dns.Start(ctx) })
 	wired_dns.DNSEventBus.Sub(event.Event_DNSServiceInitialized, wired_dns.DNSEventChannel, func() { dnsInitHandler(ctx, wired_dns.DNSEventChannel) })
 
@@ -109,6 +114,7 @@ func initNode(ctx context.Context) {
 	}
 
 	protocol.MasterConn = conn
+	defer protocol.DropBinaryTransfers(conn)
 
 	go func() {
 		<-ctx.Done()
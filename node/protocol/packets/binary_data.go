@@ -0,0 +1,34 @@
+package packets
+
+import (
+	"wired/modules/certstore"
+	"wired/modules/logger"
+	"wired/modules/protocol"
+	"wired/modules/ssl"
+)
+
+type BinaryDataHandler struct{}
+
+func (h *BinaryDataHandler) Handle(conn *protocol.Conn, p *protocol.Packet) {
+	if err := protocol.ReceiveBinaryChunk(conn, p); err != nil {
+		logger.Println("Failed to receive binary data from master:", err)
+	}
+}
+
+type BinaryDataEndHandler struct{}
+
+func (h *BinaryDataEndHandler) Handle(conn *protocol.Conn, p *protocol.Packet) {
+	kind, payload, err := protocol.FinishBinary(conn, p)
+	if err != nil {
+		logger.Println("Failed to receive binary data from master:", err)
+		return
+	}
+
+	switch kind {
+	case certstore.BundleKind:
+		// reloading the certificates takes a while, keep reading packets
+		go ssl.ReceiveBundle(payload)
+	default:
+		logger.Printf("Unknown binary data kind %q from master\n", kind)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	packet "wired/modules/packets"
 	"wired/modules/pgp"
 	"wired/modules/protocol"
+	"wired/modules/ssl"
 	"wired/modules/utils"
 )
 
@@ -54,4 +55,11 @@ func (h *ChallengeFinishHandler) Handle(conn *protocol.Conn, p *protocol.Packet)
 	utils.NodesMux.Unlock()
 
 	utils.AuthenticationFinished = true
+
+	// catch up on certificates issued while we were disconnected
+	go func() {
+		if err := ssl.RequestCertificates(nil); err != nil {
+			logger.Println("Failed to request certificates:", err)
+		}
+	}()
 }
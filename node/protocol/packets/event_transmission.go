@@ -29,6 +29,7 @@ func (h *EventTransmissionHandler) Handle(conn *protocol.Conn, p *protocol.Packe
 		return
 	}
 
-	eventBus.Pub(txEvent.Event)
-	PacketEventBus.Pub(txEvent.Event)
+	// sending it back would have the master forward it again
+	eventBus.PubLocal(txEvent.Event)
+	PacketEventBus.PubLocal(txEvent.Event)
 }
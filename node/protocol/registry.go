@@ -12,6 +12,8 @@ var handlers = map[globals.VarInt]PacketHandler{
 	globals.Packet.ID_EventTransmission: &packets.EventTransmissionHandler{},
 	globals.Packet.ID_NodeAttached:      &packets.NodeAttachedHandler{},
 	globals.Packet.ID_NodeDetached:      &packets.NodeDetachedHandler{},
+	globals.Packet.ID_BinaryData:        &packets.BinaryDataHandler{},
+	globals.Packet.ID_BinaryDataEnd:     &packets.BinaryDataEndHandler{},
 }
 
 func GetHandler(id globals.VarInt) PacketHandler {
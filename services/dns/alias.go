@@ -0,0 +1,337 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"wired/modules/env"
+	"wired/modules/logger"
+	"wired/modules/types"
+
+	"github.com/miekg/dns"
+)
+
+/*
+	ALIAS / ANAME flattening
+
+	example.com. 300 IN ALIAS lb.provider.net.
+
+	A and AAAA queries for the owner are answered with the addresses of the target.
+	Targets in zones of the same user are resolved from our own zones, protected
+	records answered with the nearest node like direct queries. Other targets,
+	including zones of other users, go through the upstream resolvers in
+	DNS_ALIAS_UPSTREAM (comma separated, default 1.1.1.1:53).
+	Upstream answers are cached by TTL and per client subnet when ECS is sent,
+	up to aliasCacheMax entries. Expired ones are pruned periodically.
+*/
+
+const (
+	TypeALIAS uint16 = 0xFF59 // private use range
+
+	aliasMaxDepth    = 8
+	aliasNegativeTTL = 30
+	aliasMaxTTL      = 3600
+	aliasTimeout     = 2 * time.Second
+	aliasCacheMax    = 10000 // clients pick their ECS subnet, the cache must not grow with them
+)
+
+type ALIAS struct {
+	Target string
+}
+
+func init() {
+	dns.PrivateHandle("ALIAS", TypeALIAS, func() dns.PrivateRdata { return new(ALIAS) })
+}
+
+func (rd *ALIAS) String() string { return rd.Target }
+
+func (rd *ALIAS) Parse(txt []string) error {
+	if len(txt) != 1 {
+		return fmt.Errorf("ALIAS expects exactly one target")
+	}
+
+	if _, ok := dns.IsDomainName(txt[0]); !ok {
+		return fmt.Errorf("invalid ALIAS target %q", txt[0])
+	}
+
+	rd.Target = dns.CanonicalName(txt[0])
+	return nil
+}
+
+func (rd *ALIAS) Pack(buf []byte) (int, error) {
+	return dns.PackDomainName(rd.Target, buf, 0, nil, false)
+}
+
+func (rd *ALIAS) Unpack(buf []byte) (int, error) {
+	target, off, err := dns.UnpackDomainName(buf, 0)
+	if err != nil {
+		return off, err
+	}
+
+	rd.Target = target
+	return off, nil
+}
+
+func (rd *ALIAS) Copy(dest dns.PrivateRdata) error {
+	alias, ok := dest.(*ALIAS)
+	if !ok {
+		return dns.ErrRdata
+	}
+
+	alias.Target = rd.Target
+	return nil
+}
+
+func (rd *ALIAS) Len() int { return len(rd.Target) + 1 }
+
+func aliasTarget(rr dns.RR) (string, bool) {
+	private, ok := rr.(*dns.PrivateRR)
+	if !ok || rr.Header().Rrtype != TypeALIAS {
+		return "", false
+	}
+
+	alias, ok := private.Data.(*ALIAS)
+	if !ok {
+		return "", false
+	}
+
+	return alias.Target, true
+}
+
+type aliasCacheEntry struct {
+	records []dns.RR
+	expires time.Time
+}
+
+var (
+	aliasCache   = make(map[string]aliasCacheEntry) // qtype/target/subnet -> addresses
+	aliasCacheMu sync.RWMutex
+)
+
+// resolveAlias returns the addresses of an ALIAS record renamed to qname, with the TTL capped by the ALIAS TTL
+func resolveAlias(record *types.DNSRecord, qname string, qtype uint16, client queryClient) []dns.RR {
+	target, ok := aliasTarget(record.RR)
+	if !ok || (qtype != dns.TypeA && qtype != dns.TypeAAAA) {
+		return nil
+	}
+
+	// zones of other users are resolved like any other name, their protected origins stay hidden
+	var answers []dns.RR
+	if owner := zoneOwner(record.RR.Header().Name); owner != "" && zoneOwner(target) == owner {
+		answers = resolveInternalAlias(target, qtype, owner, client)
+	} else {
+		answers = resolveExternalAlias(target, qtype, client.ecs)
+	}
+
+	ttl := record.RR.Header().Ttl
+	for i, answer := range answers {
+		answers[i] = dns.Copy(answer)
+		answers[i].Header().Name = qname
+		answers[i].Header().Ttl = min(answer.Header().Ttl, ttl)
+	}
+
+	return answers
+}
+
+// zoneOwner returns the user owning the zone of a name, empty when it isn't ours
+func zoneOwner(name string) string {
+	apex := FindApex(name)
+	if apex == "" {
+		return ""
+	}
+
+	if domainData := DomainDataIndexName[apex]; domainData != nil {
+		return domainData.Owner
+	}
+
+	return ""
+}
+
+// resolveInternalAlias follows the target through the zones of owner, protected records are answered like direct queries
+func resolveInternalAlias(target string, qtype uint16, owner string, client queryClient) []dns.RR {
+	for depth := 0; depth < aliasMaxDepth; depth++ {
+		var (
+			answers []dns.RR
+			next    string
+		)
+
+		for _, record := range steerRecords(LookupName(target).Records, qtype) {
+			switch record.RR.Header().Rrtype {
+			case qtype:
+				answer, err := clientAnswer(record, client)
+				if err != nil {
+					continue
+				}
+
+				answers = append(answers, answer)
+			case dns.TypeCNAME:
+				next = dns.CanonicalName(record.RR.(*dns.CNAME).Target)
+			case TypeALIAS:
+				next, _ = aliasTarget(record.RR)
+			}
+		}
+
+		if len(answers) > 0 || next == "" {
+			return answers
+		}
+
+		if zoneOwner(next) != owner {
+			return resolveExternalAlias(next, qtype, client.ecs)
+		}
+
+		target = next
+	}
+
+	return nil
+}
+
+func resolveExternalAlias(target string, qtype uint16, ecs *dns.EDNS0_SUBNET) []dns.RR {
+	key := aliasCacheKey(target, qtype, ecs)
+
+	aliasCacheMu.RLock()
+	entry, ok := aliasCache[key]
+	aliasCacheMu.RUnlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return aliasRemainingTTL(entry)
+	}
+
+	records, ttl, err := queryUpstream(target, qtype, ecs)
+	if err != nil {
+		logger.Printf("Failed to resolve ALIAS target %s: %v\n", target, err)
+		if ok {
+			// serve stale rather than nothing
+			return entry.records
+		}
+
+		ttl = aliasNegativeTTL
+	}
+
+	entry = aliasCacheEntry{records: records, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+
+	aliasCacheMu.Lock()
+	if _, ok := aliasCache[key]; ok || len(aliasCache) < aliasCacheMax {
+		aliasCache[key] = entry
+	}
+	aliasCacheMu.Unlock()
+
+	return records
+}
+
+// pruneAliasCache drops expired upstream answers
+func pruneAliasCache() {
+	aliasCacheMu.Lock()
+	defer aliasCacheMu.Unlock()
+
+	now := time.Now()
+	for key, entry := range aliasCache {
+		if now.After(entry.expires) {
+			delete(aliasCache, key)
+		}
+	}
+}
+
+func aliasRemainingTTL(entry aliasCacheEntry) []dns.RR {
+	remaining := uint32(time.Until(entry.expires).Seconds())
+	records := make([]dns.RR, 0, len(entry.records))
+	for _, record := range entry.records {
+		c := dns.Copy(record)
+		c.Header().Ttl = min(c.Header().Ttl, remaining)
+		records = append(records, c)
+	}
+
+	return records
+}
+
+func aliasCacheKey(target string, qtype uint16, ecs *dns.EDNS0_SUBNET) string {
+	key := dns.TypeToString[qtype] + "/" + target
+	if ecs == nil {
+		return key
+	}
+
+	bits := 32
+	if ecs.Family == 2 {
+		bits = 128
+	}
+
+	network := ecs.Address.Mask(net.CIDRMask(int(ecs.SourceNetmask), bits))
+	return fmt.Sprintf("%s/%s/%d", key, network, ecs.SourceNetmask)
+}
+
+// queryUpstream resolves target at the upstream resolvers, following the CNAME chain they return
+func queryUpstream(target string, qtype uint16, ecs *dns.EDNS0_SUBNET) ([]dns.RR, uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(target, qtype)
+	m.RecursionDesired = true
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	if ecs != nil {
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        ecs.Family,
+			SourceNetmask: ecs.SourceNetmask,
+			Address:       ecs.Address,
+		})
+	}
+
+	var lastErr error
+	for _, upstream := range strings.Split(env.GetEnv("DNS_ALIAS_UPSTREAM", "1.1.1.1:53"), ",") {
+		upstream = strings.TrimSpace(upstream)
+		if upstream == "" {
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			upstream = net.JoinHostPort(upstream, "53")
+		}
+
+		resp, err := exchangeUpstream(m, upstream)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("upstream %s answered %s", upstream, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+
+		var (
+			records []dns.RR
+			ttl     uint32 = aliasMaxTTL
+		)
+
+		for _, answer := range resp.Answer {
+			ttl = min(ttl, answer.Header().Ttl)
+			if answer.Header().Rrtype == qtype {
+				records = append(records, answer)
+			}
+		}
+
+		if len(records) == 0 {
+			ttl = aliasNegativeTTL
+		}
+
+		return records, ttl, nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no upstream resolver configured")
+	}
+
+	return nil, 0, lastErr
+}
+
+func exchangeUpstream(m *dns.Msg, upstream string) (*dns.Msg, error) {
+	client := &dns.Client{Net: "udp", Timeout: aliasTimeout}
+	resp, _, err := client.Exchange(m, upstream)
+	if err == nil && !resp.Truncated {
+		return resp, nil
+	}
+
+	client.Net = "tcp"
+	resp, _, err = client.Exchange(m, upstream)
+	return resp, err
+}
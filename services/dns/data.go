@@ -24,9 +24,12 @@ func GetUserDomains(userId string) []DomainData {
 	return result
 }
 
+// GetAllRecords returns the records of every zone, the slice is a copy safe to use without ZonesMutex
 func GetAllRecords() []*types.DNSRecord {
-	var records []*types.DNSRecord
+	ZonesMutex.RLock()
+	defer ZonesMutex.RUnlock()
 
+	records := make([]*types.DNSRecord, 0, len(ZoneIndexId))
 	for _, indexed := range ZoneIndexId {
 		if indexed != nil && indexed.Record != nil {
 			records = append(records, indexed.Record)
@@ -35,3 +38,11 @@ func GetAllRecords() []*types.DNSRecord {
 
 	return records
 }
+
+// GetIndexedRecord looks up a record by its id, nil if it does not exist
+func GetIndexedRecord(recordId string) *IndexedRecord {
+	ZonesMutex.RLock()
+	defer ZonesMutex.RUnlock()
+
+	return ZoneIndexId[recordId]
+}
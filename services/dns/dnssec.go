@@ -0,0 +1,331 @@
+package dns
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"wired/modules/logger"
+
+	"github.com/miekg/dns"
+)
+
+/*
+	Online signing, keys live in zonekeys/ next to zonefiles/
+
+	<zone>+ksk.key / <zone>+ksk.private -> key signing key (DNSKEY flags 257)
+	<zone>+zsk.key / <zone>+zsk.private -> zone signing key (DNSKEY flags 256)
+
+	Denial of existence uses minimally covering NSEC records (RFC 4470 "white lies"),
+	so the zone never has to be walked or pre-signed.
+*/
+
+const (
+	dnssecAlgorithm = dns.ECDSAP256SHA256
+	dnssecKeyDir    = "zonekeys"
+	dnssecKeyTTL    = 3600
+
+	signatureInception = 1 * time.Hour
+	signatureValidity  = 7 * 24 * time.Hour
+)
+
+type ZoneKeys struct {
+	KSK *dns.DNSKEY
+	ZSK *dns.DNSKEY
+
+	kskSigner crypto.Signer
+	zskSigner crypto.Signer
+}
+
+var (
+	zoneKeys   = make(map[string]*ZoneKeys) // zone -> ZoneKeys
+	zoneKeysMu sync.Mutex
+)
+
+// GetZoneKeys returns the signing keys of a zone, generating and storing them on first use
+func GetZoneKeys(zone string) (*ZoneKeys, error) {
+	zone = dns.CanonicalName(zone)
+
+	zoneKeysMu.Lock()
+	defer zoneKeysMu.Unlock()
+
+	if keys, ok := zoneKeys[zone]; ok {
+		return keys, nil
+	}
+
+	ksk, kskSigner, err := loadOrCreateKey(zone, "ksk", 257)
+	if err != nil {
+		return nil, err
+	}
+
+	zsk, zskSigner, err := loadOrCreateKey(zone, "zsk", 256)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := &ZoneKeys{
+		KSK:       ksk,
+		ZSK:       zsk,
+		kskSigner: kskSigner,
+		zskSigner: zskSigner,
+	}
+
+	zoneKeys[zone] = keys
+	return keys, nil
+}
+
+// DS returns the delegation signer record that has to be published at the registrar
+func (keys *ZoneKeys) DS() *dns.DS {
+	return keys.KSK.ToDS(dns.SHA256)
+}
+
+func loadOrCreateKey(zone, role string, flags uint16) (*dns.DNSKEY, crypto.Signer, error) {
+	base := filepath.Join(dnssecKeyDir, strings.TrimSuffix(zone, ".")+"+"+role)
+	pubFile, privFile := base+".key", base+".private"
+
+	if pubData, err := os.ReadFile(pubFile); err == nil {
+		rr, err := dns.NewRR(string(pubData))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse %s: %w", pubFile, err)
+		}
+
+		key, ok := rr.(*dns.DNSKEY)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s does not contain a DNSKEY", pubFile)
+		}
+
+		privReader, err := os.Open(privFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer privReader.Close()
+
+		priv, err := key.ReadPrivateKey(privReader, privFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s: %w", privFile, err)
+		}
+
+		signer, ok := priv.(crypto.Signer)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s is not a signing key", privFile)
+		}
+
+		return key, signer, nil
+	}
+
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: dnssecKeyTTL},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dnssecAlgorithm,
+	}
+
+	priv, err := key.Generate(256)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("generated %s for %s is not a signing key", role, zone)
+	}
+
+	if err := os.MkdirAll(dnssecKeyDir, 0700); err != nil {
+		return nil, nil, err
+	}
+
+	if err := os.WriteFile(privFile, []byte(key.PrivateKeyString(priv)), 0600); err != nil {
+		return nil, nil, err
+	}
+
+	if err := os.WriteFile(pubFile, []byte(key.String()+"\n"), 0644); err != nil {
+		os.Remove(privFile)
+		return nil, nil, err
+	}
+
+	logger.Printf("Generated DNSSEC %s for %s (key tag %d)\n", strings.ToUpper(role), zone, key.KeyTag())
+	return key, signer, nil
+}
+
+func dnssecOK(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// dnskeyAnswer returns the DNSKEY RRset of a zone apex
+func dnskeyAnswer(zone string) []dns.RR {
+	keys, err := GetZoneKeys(zone)
+	if err != nil {
+		logger.Println("Failed to get DNSSEC keys for", zone, ":", err)
+		return nil
+	}
+
+	return []dns.RR{dns.Copy(keys.KSK), dns.Copy(keys.ZSK)}
+}
+
+// signSection appends an RRSIG for every RRset inside the given section
+func signSection(rrs []dns.RR) []dns.RR {
+	type setKey struct {
+		name  string
+		rtype uint16
+	}
+
+	var order []setKey
+	sets := make(map[setKey][]dns.RR)
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeRRSIG || hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		key := setKey{name: dns.CanonicalName(hdr.Name), rtype: hdr.Rrtype}
+		if _, ok := sets[key]; !ok {
+			order = append(order, key)
+		}
+
+		sets[key] = append(sets[key], rr)
+	}
+
+	for _, key := range order {
+		zone := FindApex(key.name)
+		if zone == "" {
+			continue
+		}
+
+		sig, err := signRRset(zone, sets[key])
+		if err != nil {
+			logger.Printf("Failed to sign %s %s: %v\n", key.name, dns.TypeToString[key.rtype], err)
+			continue
+		}
+
+		rrs = append(rrs, sig)
+	}
+
+	return rrs
+}
+
+func signRRset(zone string, rrset []dns.RR) (*dns.RRSIG, error) {
+	keys, err := GetZoneKeys(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	key, signer := keys.ZSK, keys.zskSigner
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		key, signer = keys.KSK, keys.kskSigner
+	}
+
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Algorithm:  key.Algorithm,
+		OrigTtl:    rrset[0].Header().Ttl,
+		Inception:  uint32(now.Add(-signatureInception).Unix()),
+		Expiration: uint32(now.Add(signatureValidity).Unix()),
+		KeyTag:     key.KeyTag(),
+		SignerName: zone,
+	}
+
+	if err := sig.Sign(signer, rrset); err != nil {
+		return nil, err
+	}
+
+	return sig, nil
+}
+
+// denialNSEC builds minimally covering NSEC records for NXDOMAIN (qname and the wildcard
+// below its closest encloser) and an exact match NSEC listing the existing types for NODATA answers
+func denialNSEC(qname, zone, encloser string, nxdomain bool, types []uint16, ttl uint32) []dns.RR {
+	qname = dns.CanonicalName(qname)
+	if !nxdomain {
+		types = append(types, dns.TypeRRSIG, dns.TypeNSEC)
+		if qname == zone {
+			types = append(types, dns.TypeSOA, dns.TypeDNSKEY)
+		}
+
+		return []dns.RR{makeNSEC(qname, successorName(qname), types, ttl)}
+	}
+
+	if encloser == "" {
+		encloser = zone
+	}
+
+	wildcard := "*." + dns.CanonicalName(encloser)
+	return []dns.RR{
+		makeNSEC(predecessorName(qname, zone), successorName(qname), []uint16{dns.TypeRRSIG, dns.TypeNSEC}, ttl),
+		makeNSEC(predecessorName(wildcard, zone), successorName(wildcard), []uint16{dns.TypeRRSIG, dns.TypeNSEC}, ttl),
+	}
+}
+
+func makeNSEC(owner, next string, types []uint16, ttl uint32) *dns.NSEC {
+	seen := make(map[uint16]bool)
+	bitmap := make([]uint16, 0, len(types))
+	for _, t := range types {
+		if !seen[t] {
+			seen[t] = true
+			bitmap = append(bitmap, t)
+		}
+	}
+
+	sort.Slice(bitmap, func(i, j int) bool { return bitmap[i] < bitmap[j] })
+
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+		NextDomain: next,
+		TypeBitMap: bitmap,
+	}
+}
+
+// successorName returns the immediate canonical successor of name ("\000.name")
+func successorName(name string) string {
+	return "\\000." + name
+}
+
+// predecessorName returns a name that sorts right before name without covering any existing name
+func predecessorName(name, zone string) string {
+	if name == zone {
+		return zone
+	}
+
+	labels := dns.SplitDomainName(name)
+	parent := strings.Join(labels[1:], ".") + "."
+	first := []byte(labels[0])
+	last := first[len(first)-1]
+
+	if last == 0 {
+		first = first[:len(first)-1]
+	} else {
+		// pad with the highest octet, bounded by the label and name length limits
+		first[len(first)-1] = last - 1
+		for len(first) < 63 && len(first)+len(parent) < 250 {
+			first = append(first, 0xff)
+		}
+	}
+
+	if len(first) == 0 {
+		return parent
+	}
+
+	return escapeLabel(first) + "." + parent
+}
+
+func escapeLabel(label []byte) string {
+	var sb strings.Builder
+	for _, b := range label {
+		switch {
+		case b == '.' || b == '\\' || b == '(' || b == ')' || b == ';' || b == ' ' || b == '@' || b == '"':
+			sb.WriteByte('\\')
+			sb.WriteByte(b)
+		case b < '!' || b > '~':
+			fmt.Fprintf(&sb, "\\%03d", b)
+		default:
+			sb.WriteByte(b)
+		}
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,151 @@
+package dns
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+/*
+	DNS over HTTPS (RFC 8484)
+
+	GET  /dns-query?dns=<base64url message>
+	POST /dns-query with an application/dns-message body
+
+	Served by the http service, the query goes through the same handleQuery
+	as UDP, TCP and DoT so geo steering answers the same on every transport.
+*/
+
+const dohMessageType = "application/dns-message"
+
+var errNoTsig = errors.New("TSIG is not supported over DoH")
+
+// dohWriter captures the reply of handleRequest for a single DoH request
+type dohWriter struct {
+	local  net.Addr
+	remote net.Addr
+	reply  []byte
+}
+
+func (w *dohWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *dohWriter) Close() error         { return nil }
+func (w *dohWriter) TsigStatus() error    { return errNoTsig }
+func (w *dohWriter) TsigTimersOnly(bool)  {}
+func (w *dohWriter) Hijack()              {}
+
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	packed, err := m.Pack()
+	if err != nil {
+		return err
+	}
+
+	w.reply = packed
+	return nil
+}
+
+func (w *dohWriter) Write(b []byte) (int, error) {
+	w.reply = append([]byte(nil), b...)
+	return len(b), nil
+}
+
+// ServeDoH answers a RFC 8484 request
+func ServeDoH(w http.ResponseWriter, r *http.Request) {
+	var (
+		raw []byte
+		err error
+	)
+
+	switch r.Method {
+	case http.MethodGet:
+		raw, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(r.URL.Query().Get("dns"), "="))
+	case http.MethodPost:
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), dohMessageType) {
+			http.Error(w, "Unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		raw, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err != nil || len(raw) == 0 || req.Unpack(raw) != nil || len(req.Question) != 1 {
+		http.Error(w, "Invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	writer := &dohWriter{remote: httpRemoteAddr(r)}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		writer.local = local
+	}
+
+	// transfers need a stream of messages, DoH can carry only one
+	if qtype := req.Question[0].Qtype; qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeRefused)
+		writer.WriteMsg(m)
+	} else {
+		handleQuery(writer, req)
+	}
+
+	if writer.reply == nil {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		writer.WriteMsg(m)
+	}
+
+	w.Header().Set("Content-Type", dohMessageType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(writer.reply)))
+	if reply := new(dns.Msg); reply.Unpack(writer.reply) == nil {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(dohMaxAge(reply)), 10))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(writer.reply)
+}
+
+// dohMaxAge is the smallest TTL of the reply, negative answers use their SOA (RFC 8484 section 5.1)
+func dohMaxAge(m *dns.Msg) uint32 {
+	if m.Rcode == dns.RcodeServerFailure {
+		return 0
+	}
+
+	records := m.Answer
+	if len(records) == 0 {
+		records = m.Ns
+	}
+
+	var maxAge uint32
+	for i, rr := range records {
+		ttl := rr.Header().Ttl
+		if soa, ok := rr.(*dns.SOA); ok && len(m.Answer) == 0 {
+			ttl = min(ttl, soa.Minttl)
+		}
+
+		if i == 0 || ttl < maxAge {
+			maxAge = ttl
+		}
+	}
+
+	return maxAge
+}
+
+func httpRemoteAddr(r *http.Request) net.Addr {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
@@ -5,86 +5,106 @@ import (
 	"wired/modules/event"
 	event_data "wired/modules/event/events"
 	"wired/modules/logger"
-	"wired/modules/postgresql"
-	"wired/modules/types"
 )
 
 func init() {
-	eventChan := make(chan event.Event)
-	DNSEventBus.Sub(event.Event_AddRecord, eventChan, func() { addRecordEventHandler(eventChan) })
-	DNSEventBus.Sub(event.Event_RemoveRecord, eventChan, func() { removeRecordEventHandler(eventChan) })
+	// one channel each, a shared one would hand events to the handler of the other type
+	addChan := make(chan event.Event)
+	DNSEventBus.Sub(event.Event_AddRecord, addChan, func() { addRecordEventHandler(addChan) })
+
+	removeChan := make(chan event.Event)
+	DNSEventBus.Sub(event.Event_RemoveRecord, removeChan, func() { removeRecordEventHandler(removeChan) })
+
+	settingChan := make(chan event.Event)
+	DNSEventBus.Sub(event.Event_DomainSettingChanged, settingChan, func() { domainSettingChangedEventHandler(settingChan) })
+
+	healthChan := make(chan event.Event)
+	DNSEventBus.Sub(event.Event_HealthReport, healthChan, func() { healthReportEventHandler(healthChan) })
 }
 
-func addRecordEventHandler(eventChan <-chan event.Event) {
-	for event := range eventChan {
-		if event.FiredBy == env.GetEnv("NODE_KEY", "node-key") {
+func healthReportEventHandler(eventChan <-chan event.Event) {
+	for e := range eventChan {
+		if e.FiredBy == env.GetEnv("NODE_KEY", "node-key") {
 			continue
 		}
 
-		if event.Type != 1 {
+		data, ok := event.DecodeData[event_data.HealthReportData](e)
+		if !ok {
+			logger.Println("Invalid event data for HealthReport")
 			continue
 		}
 
-		data, ok := event.Data.(event_data.AddRecordData)
-		if !ok {
-			logger.Println("Invalid event data for AddRecord")
-			continue
+		for _, result := range data.Results {
+			storeHealthReport(data.Node, result)
 		}
+	}
+}
 
-		owner := postgresql.Users[data.OwnerId]
-		if owner == nil {
-			postgresql.Users[data.OwnerId] = &types.User{
-				Id: data.OwnerId,
-			}
+// addRecordEventHandler applies records created on other nodes
+func addRecordEventHandler(eventChan <-chan event.Event) {
+	for e := range eventChan {
+		if e.FiredBy == env.GetEnv("NODE_KEY", "node-key") {
+			continue
 		}
 
-		err := postgresql.GetUser(owner)
-		if err != nil {
-			logger.Println("Failed to get user: ", err)
+		data, ok := event.DecodeData[event_data.AddRecordData](e)
+		if !ok || data.Record == nil || data.Record.RR == nil {
+			logger.Println("Invalid event data for AddRecord")
 			continue
 		}
 
-		_, err = CreateRecord(owner, data.DomainId, data.Record)
-		if err != nil {
-			logger.Println("Failed to create record: ", err)
+		domainData := DomainDataIndexId[data.DomainId]
+		if domainData == nil || domainData.Owner != data.OwnerId {
+			logger.Println("Failed to add replicated record: domain not found or not owned by user")
 			continue
 		}
+
+		if err := addRecord(domainData, data.Record, false); err != nil {
+			logger.Println("Failed to add replicated record: ", err)
+		}
 	}
 }
 
+// removeRecordEventHandler applies records deleted on other nodes
 func removeRecordEventHandler(eventChan <-chan event.Event) {
-	for event := range eventChan {
-		if event.FiredBy == env.GetEnv("NODE_KEY", "node-key") {
+	for e := range eventChan {
+		if e.FiredBy == env.GetEnv("NODE_KEY", "node-key") {
 			continue
 		}
 
-		if event.Type != 2 {
-			continue
-		}
-
-		data, ok := event.Data.(event_data.RemoveRecordData)
+		data, ok := event.DecodeData[event_data.RemoveRecordData](e)
 		if !ok {
 			logger.Println("Invalid event data for RemoveRecord")
 			continue
 		}
 
-		owner := postgresql.Users[data.OwnerId]
-		if owner == nil {
-			postgresql.Users[data.OwnerId] = &types.User{
-				Id: data.OwnerId,
-			}
+		if err := removeRecord(data.Id, false); err != nil {
+			logger.Println("Failed to remove replicated record: ", err)
 		}
+	}
+}
 
-		err := postgresql.GetUser(owner)
-		if err != nil {
-			logger.Println("Failed to get user: ", err)
+// domainSettingChangedEventHandler applies settings changed on other nodes
+func domainSettingChangedEventHandler(eventChan <-chan event.Event) {
+	for e := range eventChan {
+		if e.FiredBy == env.GetEnv("NODE_KEY", "node-key") {
 			continue
 		}
 
-		err = DeleteRecord(owner, data.Id)
-		if err != nil {
-			logger.Println("Failed to delete record: ", err)
+		data, ok := event.DecodeData[event_data.DomainSettingChangedData](e)
+		if !ok {
+			logger.Println("Invalid event data for DomainSettingChanged")
+			continue
+		}
+
+		domainData := DomainDataIndexId[data.DomainId]
+		if domainData == nil || domainData.Owner != data.OwnerId {
+			logger.Println("Failed to apply replicated domain setting: domain not found or not owned by user")
 			continue
 		}
+
+		if err := applyDomainSetting(domainData, data.Setting, data.Host, data.Value); err != nil {
+			logger.Printf("Failed to apply replicated %s setting of %s: %v\n", data.Setting, domainData.Domain, err)
+		}
 	}
 }
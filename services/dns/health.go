@@ -0,0 +1,345 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"wired/modules/env"
+	"wired/modules/event"
+	event_data "wired/modules/event/events"
+	"wired/modules/logger"
+	"wired/modules/types"
+
+	"github.com/miekg/dns"
+)
+
+/*
+	Origin health checks
+
+	Every node probes the targets of records with a health check and publishes its
+	results on the DNS event bus, the master relays them to all other nodes.
+	A target counts as unhealthy once the majority of fresh reports say so,
+	which makes every node steer the same way.
+*/
+
+const (
+	healthTick            = 5 * time.Second
+	defaultCheckInterval  = 30
+	defaultCheckTimeout   = 5
+	healthReportFreshness = 3 // intervals
+)
+
+type healthReport struct {
+	healthy   bool
+	checkedAt time.Time
+	interval  time.Duration
+}
+
+var (
+	healthReports   = make(map[string]map[string]healthReport) // target -> node -> report
+	healthReportsMu sync.RWMutex
+
+	lastChecks = make(map[string]time.Time) // target -> last probe of this node
+)
+
+// HealthTarget identifies a probe across nodes, e.g. "http://203.0.113.7:80/health"
+func HealthTarget(record *types.DNSRecord) string {
+	if record.Metadata.Policy == nil || record.Metadata.Policy.Check == nil {
+		return ""
+	}
+
+	ip := recordIP(record.RR)
+	if ip == nil {
+		return ""
+	}
+
+	check := record.Metadata.Policy.Check
+	target := check.Type + "://" + net.JoinHostPort(ip.String(), strconv.Itoa(checkPort(check)))
+	if check.Type != "tcp" {
+		target += checkPath(check)
+	}
+
+	return target
+}
+
+// IsHealthy reports the shared health of a record, records without a check are always healthy
+func IsHealthy(record *types.DNSRecord) bool {
+	target := HealthTarget(record)
+	if target == "" {
+		return true
+	}
+
+	healthReportsMu.RLock()
+	defer healthReportsMu.RUnlock()
+
+	var up, down int
+	for _, report := range healthReports[target] {
+		interval := report.interval
+		if interval <= 0 {
+			interval = defaultCheckInterval * time.Second
+		}
+
+		if time.Since(report.checkedAt) > healthReportFreshness*interval {
+			continue
+		}
+
+		if report.healthy {
+			up++
+		} else {
+			down++
+		}
+	}
+
+	return down <= up
+}
+
+func storeHealthReport(node string, result event_data.HealthResult) {
+	healthReportsMu.Lock()
+	defer healthReportsMu.Unlock()
+
+	if _, ok := healthReports[result.Target]; !ok {
+		healthReports[result.Target] = make(map[string]healthReport)
+	}
+
+	previous, known := healthReports[result.Target][node]
+	healthReports[result.Target][node] = healthReport{
+		healthy:   result.Healthy,
+		checkedAt: result.CheckedAt,
+		interval:  result.Interval,
+	}
+
+	if known && previous.healthy != result.Healthy {
+		state := "healthy"
+		if !result.Healthy {
+			state = "unhealthy: " + result.Error
+		}
+
+		logger.Printf("Health of %s reported by %s changed to %s\n", result.Target, node, state)
+	}
+}
+
+// pruneHealthReports forgets targets of removed records and reports of nodes that stopped reporting
+func pruneHealthReports(targets map[string]bool) {
+	for target := range lastChecks {
+		if !targets[target] {
+			delete(lastChecks, target)
+		}
+	}
+
+	healthReportsMu.Lock()
+	defer healthReportsMu.Unlock()
+
+	for target, reports := range healthReports {
+		if !targets[target] {
+			delete(healthReports, target)
+			continue
+		}
+
+		for node, report := range reports {
+			interval := report.interval
+			if interval <= 0 {
+				interval = defaultCheckInterval * time.Second
+			}
+
+			// stale reports are ignored by IsHealthy already
+			if time.Since(report.checkedAt) > healthReportFreshness*interval {
+				delete(reports, node)
+			}
+		}
+
+		if len(reports) == 0 {
+			delete(healthReports, target)
+		}
+	}
+}
+
+func startHealthChecker(ctx context.Context) {
+	ticker := time.NewTicker(healthTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			runHealthChecks()
+		}
+	}
+}
+
+func runHealthChecks() {
+	due := make(map[string]*types.HealthCheck)
+	hosts := make(map[string]string)
+	targets := make(map[string]bool)
+	for _, record := range GetAllRecords() {
+		target := HealthTarget(record)
+		if target == "" {
+			continue
+		}
+
+		targets[target] = true
+
+		check := record.Metadata.Policy.Check
+		if time.Since(lastChecks[target]) < checkInterval(check) {
+			continue
+		}
+
+		due[target] = check
+		hosts[target] = strings.TrimSuffix(record.RR.Header().Name, ".")
+	}
+
+	pruneHealthReports(targets)
+
+	if len(due) == 0 {
+		return
+	}
+
+	node := env.GetEnv("NODE_KEY", "node-key")
+	results := make([]event_data.HealthResult, 0, len(due))
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+
+	for target, check := range due {
+		lastChecks[target] = time.Now()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := probe(target, hosts[target], check)
+			result := event_data.HealthResult{
+				Target:    target,
+				Healthy:   err == nil,
+				CheckedAt: time.Now(),
+				Interval:  checkInterval(check),
+			}
+
+			if err != nil {
+				result.Error = err.Error()
+			}
+
+			storeHealthReport(node, result)
+
+			mu.Lock()
+			results = append(results, result)
+			mu.Unlock()
+		}()
+	}
+
+	wg.Wait()
+
+	DNSEventBus.Pub(event.Event{
+		Type:    event.Event_HealthReport,
+		FiredAt: time.Now(),
+		FiredBy: node,
+		Data:    event_data.HealthReportData{Node: node, Results: results},
+	})
+}
+
+func probe(target, host string, check *types.HealthCheck) error {
+	timeout := time.Duration(check.Timeout) * time.Second
+	if check.Timeout <= 0 {
+		timeout = defaultCheckTimeout * time.Second
+	}
+
+	scheme, rest, _ := strings.Cut(target, "://")
+	addr, _, _ := strings.Cut(rest, "/")
+
+	if scheme == "tcp" {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return err
+		}
+
+		return conn.Close()
+	}
+
+	if check.Host != "" {
+		host = check.Host
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{ServerName: host, InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Host = host
+	req.Header.Set("User-Agent", "wired-healthcheck")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if check.Status != 0 && resp.StatusCode != check.Status {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	if check.Status == 0 && resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func checkInterval(check *types.HealthCheck) time.Duration {
+	if check.Interval <= 0 {
+		return defaultCheckInterval * time.Second
+	}
+
+	return time.Duration(check.Interval) * time.Second
+}
+
+func checkPort(check *types.HealthCheck) int {
+	if check.Port > 0 {
+		return check.Port
+	}
+
+	if check.Type == "https" {
+		return 443
+	}
+
+	return 80
+}
+
+func checkPath(check *types.HealthCheck) string {
+	if check.Path == "" {
+		return "/"
+	}
+
+	if !strings.HasPrefix(check.Path, "/") {
+		return "/" + check.Path
+	}
+
+	return check.Path
+}
+
+func recordIP(rr dns.RR) net.IP {
+	switch r := rr.(type) {
+	case *dns.A:
+		return r.A
+	case *dns.AAAA:
+		return r.AAAA
+	}
+
+	return nil
+}
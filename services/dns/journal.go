@@ -0,0 +1,256 @@
+package dns
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"wired/modules/logger"
+	"wired/modules/types"
+
+	"github.com/miekg/dns"
+)
+
+/*
+	Per-zone journal of record changes, one JSON entry per line in journals/<zone>.txt
+
+	The journal is the source of truth for the SOA serial, every CreateRecord/DeleteRecord
+	bumps it (unixtime policy, strictly increasing) and IXFR answers are built from it.
+*/
+
+const (
+	journalDir     = "journals"
+	journalEntries = 100
+)
+
+type journalEntry struct {
+	From    uint32   `json:"from"`
+	To      uint32   `json:"to"`
+	Removed []string `json:"removed,omitempty"`
+	Added   []string `json:"added,omitempty"`
+}
+
+type zoneJournal struct {
+	serial  uint32
+	entries []journalEntry
+}
+
+var (
+	journals   = make(map[string]*zoneJournal) // zone -> zoneJournal
+	journalsMu sync.Mutex
+)
+
+func journalPath(zone string) string {
+	return filepath.Join(journalDir, strings.TrimSuffix(zone, ".")+".txt")
+}
+
+// getJournal returns the journal of a zone, loading it from disk on first use (journalsMu must be held)
+func getJournal(zone string) *zoneJournal {
+	if journal, ok := journals[zone]; ok {
+		return journal
+	}
+
+	journal := &zoneJournal{}
+	if file, err := os.Open(journalPath(zone)); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var entry journalEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue
+			}
+
+			journal.entries = append(journal.entries, entry)
+			journal.serial = entry.To
+		}
+
+		file.Close()
+	}
+
+	if journal.serial == 0 {
+		// no changes recorded yet, derive a stable initial serial from the zonefile
+		journal.serial = uint32(time.Now().Unix())
+		if stat, err := os.Stat(filepath.Join("zonefiles", zone+".txt")); err == nil {
+			journal.serial = uint32(stat.ModTime().Unix())
+		}
+	}
+
+	if len(journal.entries) > journalEntries {
+		journal.entries = journal.entries[len(journal.entries)-journalEntries:]
+	}
+
+	journals[zone] = journal
+	return journal
+}
+
+func zoneSerial(zone string) uint32 {
+	journalsMu.Lock()
+	defer journalsMu.Unlock()
+
+	return getJournal(zone).serial
+}
+
+// recordChange bumps the serial of a zone and appends the change to its journal,
+// records secondaries never get leave the zone as they see it unchanged
+func recordChange(zone string, removed, added []*types.DNSRecord) uint32 {
+	journalsMu.Lock()
+	defer journalsMu.Unlock()
+
+	journal := getJournal(zone)
+	removedRRs, addedRRs := journalRRs(removed), journalRRs(added)
+	if len(removedRRs) == 0 && len(addedRRs) == 0 {
+		return journal.serial
+	}
+
+	next := uint32(time.Now().Unix())
+	if !serialBefore(journal.serial, next) {
+		next = journal.serial + 1
+	}
+
+	entry := journalEntry{
+		From:    journal.serial,
+		To:      next,
+		Removed: removedRRs,
+		Added:   addedRRs,
+	}
+
+	journal.serial = next
+	journal.entries = append(journal.entries, entry)
+
+	if len(journal.entries) > journalEntries*2 {
+		journal.entries = journal.entries[len(journal.entries)-journalEntries:]
+		if err := rewriteJournal(zone, journal.entries); err != nil {
+			logger.Println("Failed to compact journal of", zone, ":", err)
+		}
+
+		return next
+	}
+
+	if err := appendJournal(zone, entry); err != nil {
+		logger.Println("Failed to write journal of", zone, ":", err)
+	}
+
+	return next
+}
+
+// journalSince returns the continuous chain of changes from serial up to the current one
+func journalSince(zone string, serial uint32) ([]journalEntry, bool) {
+	journalsMu.Lock()
+	defer journalsMu.Unlock()
+
+	journal := getJournal(zone)
+	for i, entry := range journal.entries {
+		if entry.From != serial {
+			continue
+		}
+
+		chain := make([]journalEntry, len(journal.entries)-i)
+		copy(chain, journal.entries[i:])
+		return chain, true
+	}
+
+	return nil, false
+}
+
+func appendJournal(zone string, entry journalEntry) error {
+	if err := os.MkdirAll(journalDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(journalPath(zone), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+func rewriteJournal(zone string, entries []journalEntry) error {
+	if err := os.MkdirAll(journalDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		sb.Write(data)
+		sb.WriteByte('\n')
+	}
+
+	return os.WriteFile(journalPath(zone), []byte(sb.String()), 0644)
+}
+
+// journalRRs returns the transferred records as journal lines, the same ones AXFR sends
+func journalRRs(records []*types.DNSRecord) []string {
+	lines := make([]string, 0, len(records))
+	for _, record := range records {
+		if transferred(record) {
+			lines = append(lines, record.RR.String())
+		}
+	}
+
+	return lines
+}
+
+func parseJournalRRs(lines []string) []dns.RR {
+	rrs := make([]dns.RR, 0, len(lines))
+	for _, line := range lines {
+		rr, err := dns.NewRR(line)
+		if err != nil || rr == nil {
+			continue
+		}
+
+		rrs = append(rrs, rr)
+	}
+
+	return rrs
+}
+
+// zoneSOA returns the SOA of a zone with the journal serial, synthesized if the zone has none stored
+func zoneSOA(zone string) *dns.SOA {
+	zone = dns.CanonicalName(zone)
+	serial := zoneSerial(zone)
+
+	var ns string
+	for _, record := range findZone(zone) {
+		switch rr := record.RR.(type) {
+		case *dns.SOA:
+			soa := dns.Copy(rr).(*dns.SOA)
+			soa.Serial = serial
+			return soa
+		case *dns.NS:
+			if ns == "" {
+				ns = dns.Fqdn(rr.Ns)
+			}
+		}
+	}
+
+	if ns == "" {
+		ns = "woof.ns.wired.rip."
+	}
+
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:      ns,
+		Mbox:    "hostmaster.wired.rip.",
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  1209600,
+		Minttl:  300,
+	}
+}
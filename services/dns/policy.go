@@ -0,0 +1,121 @@
+package dns
+
+import (
+	"math/rand"
+	"wired/modules/types"
+)
+
+// steerRecords applies the traffic steering policies to the records of qtype,
+// records of other types are passed through untouched
+func steerRecords(records []*types.DNSRecord, qtype uint16) []*types.DNSRecord {
+	var (
+		result    []*types.DNSRecord
+		rrset     []*types.DNSRecord
+		hasPolicy bool
+	)
+
+	for _, record := range records {
+		if record.RR.Header().Rrtype != qtype {
+			result = append(result, record)
+			continue
+		}
+
+		rrset = append(rrset, record)
+		hasPolicy = hasPolicy || record.Metadata.Policy != nil
+	}
+
+	if !hasPolicy {
+		return records
+	}
+
+	return append(result, selectRecords(rrset)...)
+}
+
+func selectRecords(rrset []*types.DNSRecord) []*types.DNSRecord {
+	healthy := make([]*types.DNSRecord, 0, len(rrset))
+	for _, record := range rrset {
+		if IsHealthy(record) {
+			healthy = append(healthy, record)
+		}
+	}
+
+	// fail open, answering with unhealthy targets beats answering with nothing
+	if len(healthy) == 0 {
+		healthy = rrset
+	}
+
+	var failover, weighted bool
+	for _, record := range healthy {
+		if record.Metadata.Policy == nil {
+			continue
+		}
+
+		switch record.Metadata.Policy.Mode {
+		case types.PolicyFailover:
+			failover = true
+		case types.PolicyWeighted:
+			weighted = true
+		}
+	}
+
+	if failover {
+		healthy = lowestPriority(healthy)
+	}
+
+	if weighted && len(healthy) > 1 {
+		return []*types.DNSRecord{pickWeighted(healthy)}
+	}
+
+	return healthy
+}
+
+func lowestPriority(records []*types.DNSRecord) []*types.DNSRecord {
+	lowest := -1
+	for _, record := range records {
+		if p := int(priority(record)); lowest == -1 || p < lowest {
+			lowest = p
+		}
+	}
+
+	var result []*types.DNSRecord
+	for _, record := range records {
+		if int(priority(record)) == lowest {
+			result = append(result, record)
+		}
+	}
+
+	return result
+}
+
+func pickWeighted(records []*types.DNSRecord) *types.DNSRecord {
+	total := 0
+	for _, record := range records {
+		total += weight(record)
+	}
+
+	n := rand.Intn(total)
+	for _, record := range records {
+		n -= weight(record)
+		if n < 0 {
+			return record
+		}
+	}
+
+	return records[len(records)-1]
+}
+
+func priority(record *types.DNSRecord) uint16 {
+	if record.Metadata.Policy == nil {
+		return 0
+	}
+
+	return record.Metadata.Policy.Priority
+}
+
+func weight(record *types.DNSRecord) int {
+	if record.Metadata.Policy == nil || record.Metadata.Policy.Weight == 0 {
+		return 1
+	}
+
+	return int(record.Metadata.Policy.Weight)
+}
@@ -0,0 +1,179 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+	"wired/modules/env"
+	"wired/modules/geo"
+	"wired/modules/logger"
+	"wired/modules/postgresql"
+
+	"github.com/miekg/dns"
+)
+
+/*
+	Query logging into postgresql.DNSRequestLog
+
+	Every answered query is queued without blocking, a single worker resolves
+	the client country and copies batches into the logs DB. When the queue is
+	full (slow or missing DB) new entries are dropped and counted instead of
+	stalling answers. Domains can sample or opt out through DomainData.QueryLog.
+*/
+
+const (
+	queryLogQueueSize = 16384
+	queryLogBatchSize = 1000
+	queryLogFlush     = 2 * time.Second
+	queryLogTimeout   = 10 * time.Second
+)
+
+type QueryLogConfig struct {
+	Disabled   bool    // opt-out, nothing is logged for the domain
+	SampleRate float64 // fraction of queries logged, 0 -> all
+}
+
+type queryLogEntry struct {
+	log postgresql.DNSRequestLog
+	ip  net.IP
+}
+
+var (
+	queryLogQueue   = make(chan queryLogEntry, queryLogQueueSize)
+	queryLogDropped atomic.Uint64
+)
+
+// queryLogWriter remembers the reply written by handleRequest
+type queryLogWriter struct {
+	dns.ResponseWriter
+	reply *dns.Msg
+}
+
+func (w *queryLogWriter) WriteMsg(m *dns.Msg) error {
+	if w.reply == nil {
+		w.reply = m
+	}
+
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// handleQuery answers a query and queues its log entry, every transport enters here
+func handleQuery(w dns.ResponseWriter, r *dns.Msg) {
+	start := time.Now()
+	lw := &queryLogWriter{ResponseWriter: w}
+	handleRequest(lw, r)
+
+	if len(r.Question) == 0 {
+		return
+	}
+
+	q := r.Question[0]
+	qname := dns.CanonicalName(q.Name)
+	zone := FindApex(qname)
+	if !queryLogSampled(zone) {
+		return
+	}
+
+	entry := queryLogEntry{
+		log: postgresql.DNSRequestLog{
+			QueryTime:    start.UnixMilli(),
+			QueryName:    qname,
+			QueryType:    dns.TypeToString[q.Qtype],
+			QueryClass:   dns.ClassToString[q.Qclass],
+			Zone:         zone,
+			ResponseCode: "DROPPED",
+			ResponseTime: time.Since(start).Microseconds(),
+			Node:         env.GetEnv("NODE_KEY", "node-key"),
+		},
+	}
+
+	if lw.reply != nil {
+		entry.log.ResponseCode = dns.RcodeToString[lw.reply.Rcode]
+		entry.log.IsSuccessful = lw.reply.Rcode == dns.RcodeSuccess
+	}
+
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		entry.ip = addr.IP
+	case *net.TCPAddr:
+		entry.ip = addr.IP
+	}
+
+	entry.log.ClientIP = entry.ip.String()
+	if ecs := getECS(r); ecs != nil {
+		entry.log.ECSSubnet = fmt.Sprintf("%s/%d", ecs.Address, ecs.SourceNetmask)
+		entry.ip = ecs.Address
+	}
+
+	select {
+	case queryLogQueue <- entry:
+	default:
+		queryLogDropped.Add(1)
+	}
+}
+
+func queryLogSampled(zone string) bool {
+	domainData := DomainDataIndexName[zone]
+	if domainData == nil || domainData.QueryLog == nil {
+		return true
+	}
+
+	cfg := domainData.QueryLog
+	if cfg.Disabled {
+		return false
+	}
+
+	return cfg.SampleRate <= 0 || cfg.SampleRate >= 1 || rand.Float64() < cfg.SampleRate
+}
+
+func startQueryLogger(ctx context.Context) {
+	ticker := time.NewTicker(queryLogFlush)
+	defer ticker.Stop()
+
+	batch := make([]postgresql.DNSRequestLog, 0, queryLogBatchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			flushQueryLogs(batch)
+			return
+		case entry := <-queryLogQueue:
+			// the country is resolved here, off the answer path
+			if loc, err := geo.GetLocation(entry.ip); err == nil && loc != nil {
+				entry.log.ClientCountry = strings.ToUpper(loc.CountryCode)
+			}
+
+			batch = append(batch, entry.log)
+			if len(batch) >= queryLogBatchSize {
+				flushQueryLogs(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				flushQueryLogs(batch)
+				batch = batch[:0]
+			}
+
+			if dropped := queryLogDropped.Swap(0); dropped > 0 {
+				logger.Printf("Query log queue full, dropped %d entries\n", dropped)
+			}
+		}
+	}
+}
+
+func flushQueryLogs(batch []postgresql.DNSRequestLog) {
+	// no logs DB configured on this node
+	if len(batch) == 0 || postgresql.Manager.GetPool("logs") == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), queryLogTimeout)
+	defer cancel()
+
+	if err := postgresql.InsertDNSRequestLogs(ctx, batch); err != nil {
+		logger.Printf("Failed to insert %d query logs: %v\n", len(batch), err)
+	}
+}
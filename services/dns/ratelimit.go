@@ -0,0 +1,243 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+	"wired/modules/env"
+	"wired/modules/event"
+	event_data "wired/modules/event/events"
+
+	"github.com/miekg/dns"
+)
+
+/*
+	Response Rate Limiting and per-zone query caps
+
+	RRL only applies to UDP, where spoofed sources make us an amplifier.
+	Identical responses to one client prefix (/24, /56) are limited to DNS_RRL_RATE
+	per second, over the limit every DNS_RRL_SLIP-th response is sent truncated
+	(TC=1) so real clients retry over TCP, the rest is dropped.
+
+	Zone caps (DomainData.QueryCap) limit all queries for a zone on this node,
+	excess UDP queries are dropped and everything else is REFUSED.
+
+	Counters are published every minute as Event_DNSMetrics for the master.
+*/
+
+const (
+	metricsInterval = time.Minute
+	rrlBucketIdle   = time.Minute
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	slip   int
+}
+
+// take refills the bucket by rate per second up to burst and takes one token
+func (b *tokenBucket) take(now time.Time, rate, burst float64) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+var (
+	rrlBuckets  = make(map[string]*tokenBucket) // prefix|category|name -> bucket
+	zoneBuckets = make(map[string]*tokenBucket) // zone -> bucket
+	rateLimitMu sync.Mutex
+
+	dnsMetrics   = event_data.DNSMetricsData{Zones: make(map[string]event_data.DNSZoneMetrics)}
+	dnsMetricsMu sync.Mutex
+)
+
+// zoneQueryAllowed counts the query and checks the query cap of its zone
+func zoneQueryAllowed(qname string) bool {
+	zone := FindApex(qname)
+
+	dnsMetricsMu.Lock()
+	dnsMetrics.Queries++
+	if zone != "" {
+		zoneMetrics := dnsMetrics.Zones[zone]
+		zoneMetrics.Queries++
+		dnsMetrics.Zones[zone] = zoneMetrics
+	}
+	dnsMetricsMu.Unlock()
+
+	domainData := DomainDataIndexName[zone]
+	if domainData == nil || domainData.QueryCap <= 0 {
+		return true
+	}
+
+	rateLimitMu.Lock()
+	bucket, ok := zoneBuckets[zone]
+	if !ok {
+		bucket = &tokenBucket{}
+		zoneBuckets[zone] = bucket
+	}
+
+	allowed := bucket.take(time.Now(), float64(domainData.QueryCap), float64(domainData.QueryCap))
+	rateLimitMu.Unlock()
+
+	if !allowed {
+		dnsMetricsMu.Lock()
+		dnsMetrics.Capped++
+		zoneMetrics := dnsMetrics.Zones[zone]
+		zoneMetrics.Capped++
+		dnsMetrics.Zones[zone] = zoneMetrics
+		dnsMetricsMu.Unlock()
+	}
+
+	return allowed
+}
+
+// writeLimited writes the reply, applying RRL to UDP clients
+func writeLimited(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
+	addr, ok := w.RemoteAddr().(*net.UDPAddr)
+	if !ok {
+		w.WriteMsg(m)
+		return
+	}
+
+	rate, _ := strconv.ParseFloat(env.GetEnv("DNS_RRL_RATE", "20"), 64)
+	if rate <= 0 {
+		w.WriteMsg(m)
+		return
+	}
+
+	slip, _ := strconv.Atoi(env.GetEnv("DNS_RRL_SLIP", "2"))
+	key := clientPrefix(addr.IP) + "|" + rrlKey(m)
+
+	rateLimitMu.Lock()
+	bucket, ok := rrlBuckets[key]
+	if !ok {
+		bucket = &tokenBucket{}
+		rrlBuckets[key] = bucket
+	}
+
+	allowed := bucket.take(time.Now(), rate, rate)
+	slipped := false
+	if !allowed && slip > 0 {
+		bucket.slip++
+		slipped = bucket.slip%slip == 0
+	}
+	rateLimitMu.Unlock()
+
+	if allowed {
+		w.WriteMsg(m)
+		return
+	}
+
+	dnsMetricsMu.Lock()
+	if slipped {
+		dnsMetrics.Slipped++
+	} else {
+		dnsMetrics.Dropped++
+	}
+	dnsMetricsMu.Unlock()
+
+	if !slipped {
+		return
+	}
+
+	tc := new(dns.Msg)
+	tc.SetReply(r)
+	tc.Authoritative = m.Authoritative
+	tc.Truncated = true
+	w.WriteMsg(tc)
+}
+
+// rrlKey classifies a response, NXDOMAIN and errors are keyed by zone so random subdomains share a bucket
+func rrlKey(m *dns.Msg) string {
+	if len(m.Question) == 0 {
+		return "error|"
+	}
+
+	q := m.Question[0]
+	qname := dns.CanonicalName(q.Name)
+
+	switch {
+	case m.Rcode == dns.RcodeNameError:
+		return "nxdomain|" + FindApex(qname)
+	case m.Rcode != dns.RcodeSuccess:
+		return "error|" + FindApex(qname)
+	case len(m.Answer) == 0:
+		return "nodata|" + qname
+	}
+
+	return "answer|" + qname + "|" + dns.TypeToString[q.Qtype]
+}
+
+func clientPrefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(56, 128)).String()
+}
+
+func startMetricsPublisher(ctx context.Context) {
+	ticker := time.NewTicker(metricsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pruneRateLimits()
+			pruneAliasCache()
+			publishMetrics()
+		}
+	}
+}
+
+func pruneRateLimits() {
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+
+	for key, bucket := range rrlBuckets {
+		if time.Since(bucket.last) > rrlBucketIdle {
+			delete(rrlBuckets, key)
+		}
+	}
+
+	for zone := range zoneBuckets {
+		if _, ok := DomainDataIndexName[zone]; !ok {
+			delete(zoneBuckets, zone)
+		}
+	}
+}
+
+func publishMetrics() {
+	node := env.GetEnv("NODE_KEY", "node-key")
+
+	dnsMetricsMu.Lock()
+	snapshot := dnsMetrics
+	snapshot.Node = node
+	snapshot.Zones = make(map[string]event_data.DNSZoneMetrics, len(dnsMetrics.Zones))
+	for zone, zoneMetrics := range dnsMetrics.Zones {
+		snapshot.Zones[zone] = zoneMetrics
+	}
+	dnsMetricsMu.Unlock()
+
+	DNSEventBus.Pub(event.Event{
+		Type:    event.Event_DNSMetrics,
+		FiredAt: time.Now(),
+		FiredBy: node,
+		Data:    snapshot,
+	})
+}
@@ -2,6 +2,8 @@ package dns
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"net"
 	"os"
 	"strings"
@@ -16,9 +18,15 @@ import (
 	"github.com/miekg/dns"
 )
 
+const cnameMaxDepth = 12
+
 var (
 	udpServer *dns.Server
 	tcpServer *dns.Server
+	dotServer *dns.Server
+
+	// GetCertificate is set by the http service, DoT shares its certificates
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
 )
 
 func init() {
@@ -33,27 +41,53 @@ func init() {
 }
 
 func Start(ctx context.Context) {
-	dns.HandleFunc(".", handleRequest)
+	dns.HandleFunc(".", handleQuery)
 
+	addr := env.GetEnv("DNS_ADDR", ":53")
 	go func() {
-		udpServer = &dns.Server{Addr: ":53", Net: "udp"}
+		udpServer = &dns.Server{Addr: addr, Net: "udp", TsigProvider: tsigKeyring{}}
 		err := udpServer.ListenAndServe()
 		if err != nil {
 			logger.Fatal("Failed to start DNS (UDP) server: ", err)
 		}
 	}()
 
-	logger.Println("DNS server started on port 53 (UDP)")
+	logger.Printf("DNS server started on %s (UDP)\n", addr)
 
 	go func() {
-		tcpServer = &dns.Server{Addr: ":53", Net: "tcp"}
+		tcpServer = &dns.Server{Addr: addr, Net: "tcp", TsigProvider: tsigKeyring{}}
 		err := tcpServer.ListenAndServe()
 		if err != nil {
 			logger.Fatal("Failed to start DNS (TCP) server: ", err)
 		}
 	}()
 
-	logger.Println("DNS server started on port 53 (TCP)")
+	logger.Printf("DNS server started on %s (TCP)\n", addr)
+
+	go func() {
+		dotServer = &dns.Server{Addr: ":853", Net: "tcp-tls", TsigProvider: tsigKeyring{}, TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			NextProtos: []string{"dot"},
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if GetCertificate == nil {
+					return nil, fmt.Errorf("certificates are not loaded yet")
+				}
+
+				return GetCertificate(hello)
+			},
+		}}
+
+		err := dotServer.ListenAndServe()
+		if err != nil {
+			logger.Println("Failed to start DNS (DoT) server:", err)
+		}
+	}()
+
+	logger.Println("DNS server started on port 853 (DoT)")
+
+	go startHealthChecker(ctx)
+	go startMetricsPublisher(ctx)
+	go startQueryLogger(ctx)
 
 	DNSEventBus.Pub(event.Event{
 		Type:    event.Event_DNSServiceInitialized,
@@ -76,6 +110,12 @@ func Start(ctx context.Context) {
 			logger.Println("Error shutting down DNS (TCP) server:", err)
 		}
 	}
+
+	if dotServer != nil {
+		if err := dotServer.Shutdown(); err != nil {
+			logger.Println("Error shutting down DNS (DoT) server:", err)
+		}
+	}
 }
 
 func getECS(r *dns.Msg) *dns.EDNS0_SUBNET {
@@ -93,6 +133,22 @@ func getECS(r *dns.Msg) *dns.EDNS0_SUBNET {
 }
 
 func handleRequest(w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) == 1 && (r.Question[0].Qtype == dns.TypeAXFR || r.Question[0].Qtype == dns.TypeIXFR) {
+		handleTransfer(w, r)
+		return
+	}
+
+	if len(r.Question) > 0 && !zoneQueryAllowed(strings.ToLower(r.Question[0].Name)) {
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			return
+		}
+
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(m)
+		return
+	}
+
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.Authoritative = true
@@ -115,138 +171,41 @@ func handleRequest(w dns.ResponseWriter, r *dns.Msg) {
 		return
 	}
 
+	client := queryClient{ip: userIP, loc: userLoc, ecs: ecsSubnet}
+	signed := dnssecOK(r)
 	for _, q := range r.Question {
 		qname := strings.ToLower(q.Name)
 		qtype := q.Qtype
 
-		var (
-			nameExists    bool
-			cnameRecords  []dns.RR
-			answerRecords []dns.RR
-			authorityRRs  []dns.RR
-		)
-
-		zoneRecords := findZone(qname)
-		for _, record := range zoneRecords {
-			rrName := strings.ToLower(record.RR.Header().Name)
-			if rrName == qname && record.RR.Header().Rrtype == qtype {
-				nameExists = true
-				clonedRecord := dns.Copy(record.RR)
-				if record.Metadata.Protected {
-					ipVersion := map[bool]int{true: 6, false: 4}[record.RR.Header().Rrtype == dns.TypeAAAA]
-					loc, err := geo.FindNearestLocation(geo.GeoInfo{
-						IP:         userIP,
-						MMLocation: userLoc,
-					}, ipVersion)
-
-					if err != nil {
-						logger.Printf("Error finding nearest location for IPv%s %s: %v\n", ipVersion, userIP, err)
-						logger.Println("userLoc: ", userLoc)
-						m.Extra = append(m.Extra, makeErrorTxt(qname, err.Error()))
-						continue
-					}
-
-					switch cRecord := clonedRecord.(type) {
-					case *dns.AAAA:
-						cRecord.AAAA = loc.IP
-					case *dns.A:
-						cRecord.A = loc.IP
-
-						//logger.Println(record
-					}
-				}
-
-				answerRecords = append(answerRecords, clonedRecord)
-			} else if record.RR.Header().Rrtype == dns.TypeCNAME {
-				cnameRecords = append(cnameRecords, record.RR)
-			}
+		// RRSIGs are only attached for DO queries below
+		if qtype == dns.TypeDNSKEY && FindApex(qname) == qname {
+			m.Answer = append(m.Answer, dnskeyAnswer(qname)...)
+			continue
 		}
 
-		// CNAME handling
-		if len(cnameRecords) > 0 && qtype != dns.TypeCNAME {
-			for _, cname := range cnameRecords {
-				cname.Header().Name = q.Name
-			}
-
-			m.Answer = append(m.Answer, cnameRecords...)
-
-			// Resolve CNAME targets
-			for _, cname := range cnameRecords {
-				cnameRecord, ok := cname.(*dns.CNAME)
-				if !ok {
-					continue
-				}
-
-				target := dns.CanonicalName(cnameRecord.Target)
-				targetRecs := findZone(target)
-				if len(targetRecs) == 0 {
-					continue
-				}
-
-				var targetAnswers []dns.RR
-				for _, record := range targetRecs {
-					rrName := strings.ToLower(record.RR.Header().Name)
-					if rrName == target && (record.RR.Header().Rrtype == qtype) {
-						clonedRecord := dns.Copy(record.RR)
-						if record.Metadata.Protected {
-							ipVersion := map[bool]int{true: 6, false: 4}[record.RR.Header().Rrtype == dns.TypeAAAA]
-							loc, err := geo.FindNearestLocation(geo.GeoInfo{
-								IP:         userIP,
-								MMLocation: userLoc,
-							}, ipVersion)
-
-							if err != nil {
-								logger.Printf("Error finding nearest location for IPv%s %s: %v\n", ipVersion, userIP, err)
-								logger.Println("userLoc: ", userLoc)
-								m.Extra = append(m.Extra, makeErrorTxt(qname, err.Error()))
-								continue
-							}
-
-							switch record := clonedRecord.(type) {
-							case *dns.AAAA:
-								record.AAAA = loc.IP
-							case *dns.A:
-								record.A = loc.IP
-							}
-						}
-
-						targetAnswers = append(targetAnswers, clonedRecord)
-					}
-				}
-
-				if len(targetAnswers) > 0 {
-					m.Answer = append(m.Answer, targetAnswers...)
-				}
-			}
-		} else if len(cnameRecords) > 0 && qtype == dns.TypeCNAME {
-			for _, cname := range cnameRecords {
-				cname.Header().Name = q.Name
-			}
-
-			m.Answer = append(m.Answer, cnameRecords...)
-		} else {
-			if len(answerRecords) > 0 {
-				for _, answer := range answerRecords {
-					answer.Header().Name = q.Name
-				}
-
-				m.Answer = append(m.Answer, answerRecords...)
-			} else {
-				// NXDOMAIN, NOERROR
-				if nameExists {
-					authorityRRs = getSOA(qname, false)
-				} else {
-					m.SetRcode(r, dns.RcodeNameError)
-					authorityRRs = getSOA(qname, true)
-				}
-			}
+		if qtype == dns.TypeSOA && FindApex(qname) == qname {
+			m.Answer = append(m.Answer, zoneSOA(qname))
+			continue
 		}
 
-		for _, authority := range authorityRRs {
-			authority.Header().Name = q.Name
+		lookup := LookupName(qname)
+		answers, cname, extra := recordAnswers(lookup.Records, q.Name, qtype, client)
+		m.Extra = append(m.Extra, extra...)
+
+		switch {
+		case cname != nil:
+			followCNAME(m, r, qname, cname, qtype, client, signed)
+		case len(answers) > 0:
+			m.Answer = append(m.Answer, answers...)
+		default:
+			m.Ns = append(m.Ns, negativeAnswer(m, r, qname, lookup, signed)...)
 		}
+	}
 
-		m.Ns = append(m.Ns, authorityRRs...)
+	if signed {
+		m.Answer = signSection(m.Answer)
+		m.Ns = signSection(m.Ns)
+		m.SetEdns0(dns.DefaultMsgSize, true)
 	}
 
 	if ecsSubnet != nil {
@@ -280,7 +239,159 @@ func handleRequest(w dns.ResponseWriter, r *dns.Msg) {
 		opt.Option = append(opt.Option, responseSubnet)
 	}
 
-	w.WriteMsg(m)
+	// secondaries sign their SOA refresh queries
+	if tsig := r.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+
+	writeLimited(w, r, m)
+}
+
+type queryClient struct {
+	ip  net.IP
+	loc *geo.MMLocation
+	ecs *dns.EDNS0_SUBNET
+}
+
+// clientAnswer returns a copy of a record, protected addresses are replaced with the node nearest to the client
+func clientAnswer(record *types.DNSRecord, client queryClient) (dns.RR, error) {
+	clonedRecord := dns.Copy(record.RR)
+	if !record.Metadata.Protected {
+		return clonedRecord, nil
+	}
+
+	ipVersion := map[bool]int{true: 6, false: 4}[record.RR.Header().Rrtype == dns.TypeAAAA]
+	loc, err := geo.FindNearestLocation(geo.GeoInfo{
+		IP:         client.ip,
+		MMLocation: client.loc,
+	}, ipVersion)
+
+	if err != nil {
+		logger.Printf("Error finding nearest location for IPv%d %s: %v\n", ipVersion, client.ip, err)
+		logger.Println("userLoc: ", client.loc)
+		return nil, err
+	}
+
+	switch cRecord := clonedRecord.(type) {
+	case *dns.AAAA:
+		cRecord.AAAA = loc.IP
+	case *dns.A:
+		cRecord.A = loc.IP
+	}
+
+	return clonedRecord, nil
+}
+
+// recordAnswers returns copies of the records of qtype renamed to owner, or the CNAME of the name.
+// Stored records are never modified, they are shared by all concurrent queries.
+func recordAnswers(records []*types.DNSRecord, owner string, qtype uint16, client queryClient) ([]dns.RR, *dns.CNAME, []dns.RR) {
+	var (
+		answers []dns.RR
+		extra   []dns.RR
+		cname   *dns.CNAME
+	)
+
+	for _, record := range steerRecords(records, qtype) {
+		switch record.RR.Header().Rrtype {
+		case qtype:
+			clonedRecord, err := clientAnswer(record, client)
+			if err != nil {
+				extra = append(extra, makeErrorTxt(owner, err.Error()))
+				continue
+			}
+
+			clonedRecord.Header().Name = owner
+			answers = append(answers, clonedRecord)
+		case TypeALIAS:
+			answers = append(answers, resolveAlias(record, owner, qtype, client)...)
+		case dns.TypeCNAME:
+			if cname == nil {
+				// the owner gets rewritten to the (possibly wildcard-synthesized) name
+				cname = dns.Copy(record.RR).(*dns.CNAME)
+				cname.Hdr.Name = owner
+			}
+		}
+	}
+
+	return answers, cname, extra
+}
+
+// followCNAME adds the CNAME chain starting at qname, as far as it stays inside our zones.
+// Loops fail with SERVFAIL, the rcode of a dangling chain is the one of its last name (RFC 6604).
+func followCNAME(m, r *dns.Msg, qname string, cname *dns.CNAME, qtype uint16, client queryClient, signed bool) {
+	chainStart := len(m.Answer)
+	m.Answer = append(m.Answer, cname)
+
+	seen := map[string]bool{dns.CanonicalName(qname): true}
+	target := dns.CanonicalName(cname.Target)
+	for depth := 1; depth <= cnameMaxDepth; depth++ {
+		if seen[target] {
+			logger.Printf("CNAME loop at %s while resolving %s\n", target, qname)
+			m.Answer = m.Answer[:chainStart]
+			m.SetRcode(r, dns.RcodeServerFailure)
+			return
+		}
+
+		seen[target] = true
+
+		// not ours, the resolver follows the rest of the chain
+		if FindApex(target) == "" {
+			return
+		}
+
+		lookup := LookupName(target)
+		answers, next, extra := recordAnswers(lookup.Records, target, qtype, client)
+		m.Extra = append(m.Extra, extra...)
+
+		switch {
+		case next != nil:
+			m.Answer = append(m.Answer, next)
+			target = dns.CanonicalName(next.Target)
+		case len(answers) > 0:
+			m.Answer = append(m.Answer, answers...)
+			return
+		default:
+			m.Ns = append(m.Ns, negativeAnswer(m, r, target, lookup, signed)...)
+			return
+		}
+	}
+}
+
+// negativeAnswer sets NXDOMAIN or NODATA for name and returns its authority section
+func negativeAnswer(m, r *dns.Msg, name string, lookup LookupResult, signed bool) []dns.RR {
+	var authorityRRs []dns.RR
+	if lookup.Exists {
+		authorityRRs = getSOA(name, false)
+	} else {
+		m.SetRcode(r, dns.RcodeNameError)
+		authorityRRs = getSOA(name, true)
+	}
+
+	if !signed {
+		return authorityRRs
+	}
+
+	zone := FindApex(name)
+	if zone == "" {
+		return authorityRRs
+	}
+
+	ttl := uint32(dnssecKeyTTL)
+	if len(authorityRRs) > 0 {
+		ttl = authorityRRs[0].Header().Ttl
+	}
+
+	var types []uint16
+	for _, record := range lookup.Records {
+		if record.RR.Header().Rrtype == TypeALIAS {
+			types = append(types, dns.TypeA, dns.TypeAAAA)
+			continue
+		}
+
+		types = append(types, record.RR.Header().Rrtype)
+	}
+
+	return append(authorityRRs, denialNSEC(dns.CanonicalName(name), zone, lookup.Encloser, !lookup.Exists, types, ttl)...)
 }
 
 func makeErrorTxt(qname string, text string) *dns.TXT {
@@ -300,35 +411,34 @@ func makeErrorTxt(qname string, text string) *dns.TXT {
 	}
 }
 
-func getSOA(zone string, nxdomain bool) []dns.RR {
-	recs := findZone(zone)
-	if len(recs) == 0 {
+func getSOA(qname string, nxdomain bool) []dns.RR {
+	zone := FindApex(qname)
+	if zone == "" {
 		return nil
 	}
 
-	for _, record := range recs {
-		if soa, ok := record.RR.(*dns.SOA); ok {
-			soaCopy := *soa
-			soaCopy.Hdr = dns.RR_Header{
-				Name:   soa.Hdr.Name,
-				Rrtype: soa.Hdr.Rrtype,
-				Class:  soa.Hdr.Class,
-				Ttl:    soa.Hdr.Ttl,
-			}
-
-			if nxdomain {
-				soaCopy.Hdr.Ttl = soaCopy.Minttl
-			} else if soaCopy.Hdr.Ttl > soaCopy.Minttl {
-				soaCopy.Hdr.Ttl = soaCopy.Minttl
-			}
-
-			return []dns.RR{&soaCopy}
-		}
+	soa := zoneSOA(zone)
+	if nxdomain {
+		soa.Hdr.Ttl = soa.Minttl
+	} else if soa.Hdr.Ttl > soa.Minttl {
+		soa.Hdr.Ttl = soa.Minttl
 	}
 
-	return nil
+	return []dns.RR{soa}
 }
 
 func findZone(qname string) []*types.DNSRecord {
 	return HeaderNameIndex[qname]
 }
+
+// FindApex returns the apex of the closest zone we are authoritative for
+func FindApex(qname string) string {
+	name := dns.CanonicalName(qname)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if _, ok := DomainDataIndexName[name[off:]]; ok {
+			return name[off:]
+		}
+	}
+
+	return ""
+}
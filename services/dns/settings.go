@@ -0,0 +1,191 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"wired/modules/env"
+	"wired/modules/event"
+	event_data "wired/modules/event/events"
+	"wired/modules/types"
+)
+
+/*
+	Domain settings
+
+	Settings live in the domain group header of the zone file. The dashboard
+	changes them on one node, which applies the value and publishes it as
+	Event_DomainSettingChanged so every other node applies and writes the same
+	value. Values are validated again on every node before they are applied.
+*/
+
+const (
+	settingBalancer      = "balancer"
+	settingCompression   = "compression"
+	settingImageMetadata = "image_metadata"
+	settingTimeouts      = "timeouts"
+	settingRateLimits    = "rate_limits"
+	settingQueryCap      = "query_cap"
+	settingQueryLog      = "query_log"
+	settingTransfer      = "transfer"
+)
+
+// updateDomainSetting applies a setting and replicates it to the other nodes
+func updateDomainSetting(domainData *DomainData, setting, host string, value any) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	if err := applyDomainSetting(domainData, setting, host, raw); err != nil {
+		return err
+	}
+
+	DNSEventBus.Pub(event.Event{
+		Type:    event.Event_DomainSettingChanged,
+		FiredAt: time.Now(),
+		FiredBy: env.GetEnv("NODE_KEY", "node-key"),
+		Data: event_data.DomainSettingChangedData{
+			OwnerId:  domainData.Owner,
+			DomainId: domainData.Id,
+			Setting:  setting,
+			Host:     host,
+			Value:    raw,
+		},
+	})
+
+	return nil
+}
+
+// applyDomainSetting validates a json encoded setting and writes it to the domain
+func applyDomainSetting(domainData *DomainData, setting, host string, raw []byte) error {
+	mutex := getZoneFileMutex(domainData.Domain)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	switch setting {
+	case settingBalancer:
+		var balancer *types.Balancer
+		if err := json.Unmarshal(raw, &balancer); err != nil {
+			return err
+		}
+
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		apex := strings.TrimSuffix(domainData.Domain, ".")
+		if host != apex && !strings.HasSuffix(host, "."+apex) {
+			return fmt.Errorf("%s is not part of %s", host, apex)
+		}
+
+		if balancer != nil {
+			if err := balancer.Validate(); err != nil {
+				return err
+			}
+		}
+
+		// the proxy reads the map without locking, it is replaced instead of modified
+		balancers := make(map[string]types.Balancer, len(domainData.Balancers)+1)
+		for name, current := range domainData.Balancers {
+			balancers[name] = current
+		}
+
+		if balancer != nil {
+			balancers[host] = *balancer
+		} else {
+			delete(balancers, host)
+		}
+
+		domainData.Balancers = balancers
+	case settingTimeouts:
+		var timeouts *types.ProxyTimeouts
+		if err := json.Unmarshal(raw, &timeouts); err != nil {
+			return err
+		}
+
+		if timeouts != nil {
+			if err := timeouts.Validate(); err != nil {
+				return err
+			}
+		}
+
+		domainData.Timeouts = timeouts
+	case settingCompression:
+		var compression *types.Compression
+		if err := json.Unmarshal(raw, &compression); err != nil {
+			return err
+		}
+
+		if compression != nil {
+			if err := compression.Validate(); err != nil {
+				return err
+			}
+		}
+
+		domainData.Compression = compression
+	case settingImageMetadata:
+		var metadata *types.ImageMetadata
+		if err := json.Unmarshal(raw, &metadata); err != nil {
+			return err
+		}
+
+		if metadata != nil {
+			if err := metadata.Validate(); err != nil {
+				return err
+			}
+		}
+
+		domainData.ImageMetadata = metadata
+	case settingRateLimits:
+		var limits []types.RateLimit
+		if err := json.Unmarshal(raw, &limits); err != nil {
+			return err
+		}
+
+		for i := range limits {
+			if err := limits[i].Validate(); err != nil {
+				return err
+			}
+		}
+
+		domainData.RateLimits = limits
+	case settingQueryCap:
+		var queryCap int
+		if err := json.Unmarshal(raw, &queryCap); err != nil {
+			return err
+		}
+
+		if queryCap < 0 {
+			return fmt.Errorf("query cap must not be negative")
+		}
+
+		domainData.QueryCap = queryCap
+	case settingQueryLog:
+		var cfg *QueryLogConfig
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return err
+		}
+
+		if cfg != nil && (cfg.SampleRate < 0 || cfg.SampleRate > 1) {
+			return fmt.Errorf("sample rate must be between 0 and 1")
+		}
+
+		domainData.QueryLog = cfg
+	case settingTransfer:
+		var cfg *TransferConfig
+		if err := json.Unmarshal(raw, &cfg); err != nil {
+			return err
+		}
+
+		if cfg != nil {
+			if err := cfg.Validate(); err != nil {
+				return err
+			}
+		}
+
+		domainData.Transfer = cfg
+	default:
+		return fmt.Errorf("unknown domain setting %q", setting)
+	}
+
+	return WriteZoneFileHeader(domainData)
+}
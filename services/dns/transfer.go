@@ -0,0 +1,375 @@
+package dns
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net"
+	"strings"
+	"time"
+	"wired/modules/logger"
+	"wired/modules/types"
+
+	"github.com/miekg/dns"
+)
+
+/*
+	Zone transfers for hidden secondaries (BIND, Knot, ...)
+
+	AXFR (RFC 5936) -> SOA, every origin record of the zone, SOA
+	IXFR (RFC 1995) -> diff sequences from the zone journal, falls back to AXFR
+	NOTIFY (RFC 1996) -> sent to the configured secondaries after every change
+
+	Only the records as stored in the zonefile are transferred, protected
+	records are never geo-rewritten and IP compatibility records are skipped.
+*/
+
+const (
+	transferChunkSize = 100
+	notifyAttempts    = 3
+	notifyTimeout     = 5 * time.Second
+)
+
+type TransferConfig struct {
+	Secondaries   []string // NOTIFY targets, host or host:port
+	AllowFrom     []string // CIDRs allowed to transfer, empty -> any source holding the TSIG key
+	TSIGName      string   // key name, empty -> no TSIG required
+	TSIGAlgorithm string   // defaults to hmac-sha256.
+	TSIGSecret    string   // base64
+}
+
+// Validate normalizes the config and rejects unusable values
+func (cfg *TransferConfig) Validate() error {
+	// the zone would be open to everyone otherwise
+	if len(cfg.AllowFrom) == 0 && cfg.TSIGName == "" {
+		return fmt.Errorf("transfers need allowed sources or a TSIG key")
+	}
+
+	for _, cidr := range cfg.AllowFrom {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+	}
+
+	if cfg.TSIGName == "" {
+		return nil
+	}
+
+	cfg.TSIGName = dns.CanonicalName(cfg.TSIGName)
+	if cfg.TSIGAlgorithm == "" {
+		cfg.TSIGAlgorithm = dns.HmacSHA256
+	}
+
+	cfg.TSIGAlgorithm = dns.CanonicalName(cfg.TSIGAlgorithm)
+	if _, err := tsigHash(cfg.TSIGAlgorithm, nil); err != nil {
+		return err
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(cfg.TSIGSecret); err != nil {
+		return fmt.Errorf("invalid TSIG secret: %w", err)
+	}
+
+	return nil
+}
+
+func handleTransfer(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	zone := dns.CanonicalName(q.Name)
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	domainData := DomainDataIndexName[zone]
+	if domainData == nil {
+		m.SetRcode(r, dns.RcodeNotAuth)
+		writeTransferReply(w, r, m)
+		return
+	}
+
+	if !transferAllowed(w, r, domainData) {
+		m.SetRcode(r, dns.RcodeRefused)
+		writeTransferReply(w, r, m)
+		return
+	}
+
+	soa := zoneSOA(zone)
+	_, isTCP := w.RemoteAddr().(*net.TCPAddr)
+	if q.Qtype == dns.TypeIXFR {
+		clientSerial, ok := ixfrClientSerial(r)
+		if !isTCP || (ok && !serialBefore(clientSerial, soa.Serial)) {
+			// up to date or UDP, a single SOA tells the client to retry over TCP if needed
+			m.Authoritative = true
+			m.Answer = []dns.RR{soa}
+			writeTransferReply(w, r, m)
+			return
+		}
+
+		if ok {
+			if diffs, ok := journalSince(zone, clientSerial); ok {
+				streamTransfer(w, r, ixfrRecords(soa, diffs))
+				return
+			}
+		}
+	}
+
+	if !isTCP {
+		m.SetRcode(r, dns.RcodeRefused)
+		writeTransferReply(w, r, m)
+		return
+	}
+
+	streamTransfer(w, r, axfrRecords(domainData, soa))
+}
+
+func transferAllowed(w dns.ResponseWriter, r *dns.Msg, domainData *DomainData) bool {
+	cfg := domainData.Transfer
+	if cfg == nil {
+		return false
+	}
+
+	// the keyring verified the TSIG with the key of this zone only
+	if cfg.TSIGName != "" {
+		tsig := r.IsTsig()
+		if tsig == nil || w.TsigStatus() != nil || dns.CanonicalName(tsig.Hdr.Name) != cfg.TSIGName {
+			return false
+		}
+	}
+
+	// configs stored before they were validated may have neither
+	if len(cfg.AllowFrom) == 0 {
+		return cfg.TSIGName != ""
+	}
+
+	host, _, err := net.SplitHostPort(w.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	for _, cidr := range cfg.AllowFrom {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func writeTransferReply(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
+	if tsig := r.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+
+	w.WriteMsg(m)
+}
+
+func streamTransfer(w dns.ResponseWriter, r *dns.Msg, records []dns.RR) {
+	ch := make(chan *dns.Envelope)
+	tr := new(dns.Transfer)
+
+	go func() {
+		defer close(ch)
+		for start := 0; start < len(records); start += transferChunkSize {
+			end := min(start+transferChunkSize, len(records))
+			ch <- &dns.Envelope{RR: records[start:end]}
+		}
+	}()
+
+	if err := tr.Out(w, r, ch); err != nil {
+		logger.Println("Zone transfer to", w.RemoteAddr(), "failed:", err)
+		for range ch {
+		}
+	}
+}
+
+func axfrRecords(domainData *DomainData, soa *dns.SOA) []dns.RR {
+	records := []dns.RR{soa}
+	for _, record := range DomainRecordIndexId[domainData.Id] {
+		if !transferred(record) || record.RR.Header().Rrtype == dns.TypeSOA {
+			continue
+		}
+
+		records = append(records, dns.Copy(record.RR))
+	}
+
+	return append(records, soa)
+}
+
+// transferred reports whether secondaries get a record, by AXFR and in IXFR diffs alike.
+// ALIAS is private to us, secondaries could not serve it, IP compatibility records are derived.
+func transferred(record *types.DNSRecord) bool {
+	return !record.Metadata.IPCompat && record.RR.Header().Rrtype != TypeALIAS
+}
+
+// ixfrRecords builds the condensed IXFR answer, current SOA + (old SOA, removed, new SOA, added)* + current SOA
+func ixfrRecords(soa *dns.SOA, diffs []journalEntry) []dns.RR {
+	records := []dns.RR{soa}
+	for _, diff := range diffs {
+		records = append(records, soaWithSerial(soa, diff.From))
+		records = append(records, parseJournalRRs(diff.Removed)...)
+		records = append(records, soaWithSerial(soa, diff.To))
+		records = append(records, parseJournalRRs(diff.Added)...)
+	}
+
+	return append(records, soa)
+}
+
+func ixfrClientSerial(r *dns.Msg) (uint32, bool) {
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, true
+		}
+	}
+
+	return 0, false
+}
+
+// serialBefore compares serials with RFC 1982 arithmetic
+func serialBefore(a, b uint32) bool {
+	return a != b && int32(b-a) > 0
+}
+
+func soaWithSerial(soa *dns.SOA, serial uint32) *dns.SOA {
+	c := dns.Copy(soa).(*dns.SOA)
+	c.Serial = serial
+	return c
+}
+
+// notifySecondaries tells every configured secondary that the zone changed
+func notifySecondaries(domainData *DomainData) {
+	cfg := domainData.Transfer
+	if cfg == nil || len(cfg.Secondaries) == 0 {
+		return
+	}
+
+	zone := dns.Fqdn(domainData.Domain)
+	soa := zoneSOA(zone)
+	for _, target := range cfg.Secondaries {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(target, "53")
+		}
+
+		go sendNotify(zone, soa, target, cfg)
+	}
+}
+
+func sendNotify(zone string, soa *dns.SOA, target string, cfg *TransferConfig) {
+	m := new(dns.Msg)
+	m.SetNotify(zone)
+	m.Answer = []dns.RR{soa}
+
+	client := &dns.Client{Net: "udp", Timeout: notifyTimeout}
+	if cfg.TSIGName != "" {
+		client.TsigProvider = tsigKeyring{cfg: cfg}
+		m.SetTsig(cfg.TSIGName, cfg.TSIGAlgorithm, 300, time.Now().Unix())
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= notifyAttempts; attempt++ {
+		resp, _, err := client.Exchange(m, target)
+		if err == nil && resp.Rcode == dns.RcodeSuccess {
+			return
+		}
+
+		lastErr = err
+		if err == nil {
+			lastErr = fmt.Errorf("rcode %s", dns.RcodeToString[resp.Rcode])
+		}
+
+		time.Sleep(time.Duration(attempt) * notifyTimeout)
+	}
+
+	logger.Printf("Failed to NOTIFY %s about %s (serial %d): %v\n", target, zone, soa.Serial, lastErr)
+}
+
+// tsigKeyring resolves TSIG keys from the transfer config of the zone in the question of a message.
+// Zones of different users may use the same key name, a key only ever authenticates its own zone.
+type tsigKeyring struct {
+	cfg *TransferConfig // nil -> the config of the zone the message asks about
+}
+
+func (keyring tsigKeyring) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	cfg := keyring.cfg
+	if cfg == nil {
+		cfg = messageTransferConfig(msg)
+	}
+
+	if cfg == nil || cfg.TSIGName == "" || cfg.TSIGName != dns.CanonicalName(t.Hdr.Name) {
+		return nil, dns.ErrSecret
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(cfg.TSIGSecret)
+	if err != nil {
+		return nil, dns.ErrSecret
+	}
+
+	h, err := tsigHash(t.Algorithm, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+func (keyring tsigKeyring) Verify(msg []byte, t *dns.TSIG) error {
+	expected, err := keyring.Generate(msg, t)
+	if err != nil {
+		return err
+	}
+
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(expected, mac) {
+		return dns.ErrSig
+	}
+
+	return nil
+}
+
+// messageTransferConfig returns the transfer config of the zone in the question of a wire format message
+func messageTransferConfig(msg []byte) *TransferConfig {
+	// header -> id, flags, qdcount, ancount, nscount, arcount, the question follows
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[4:6]) == 0 {
+		return nil
+	}
+
+	zone, _, err := dns.UnpackDomainName(msg, 12)
+	if err != nil {
+		return nil
+	}
+
+	domainData := DomainDataIndexName[dns.CanonicalName(zone)]
+	if domainData == nil {
+		return nil
+	}
+
+	return domainData.Transfer
+}
+
+func tsigHash(algorithm string, secret []byte) (hash.Hash, error) {
+	switch strings.ToLower(dns.Fqdn(algorithm)) {
+	case dns.HmacSHA1:
+		return hmac.New(sha1.New, secret), nil
+	case dns.HmacSHA224:
+		return hmac.New(sha256.New224, secret), nil
+	case dns.HmacSHA256:
+		return hmac.New(sha256.New, secret), nil
+	case dns.HmacSHA384:
+		return hmac.New(sha512.New384, secret), nil
+	case dns.HmacSHA512:
+		return hmac.New(sha512.New, secret), nil
+	}
+
+	return nil, fmt.Errorf("unsupported TSIG algorithm %s", algorithm)
+}
@@ -1,6 +1,7 @@
 package dns
 
 import (
+	"strings"
 	"sync"
 	"wired/modules/types"
 
@@ -44,9 +45,18 @@ type IndexedRecord struct {
 }
 
 type DomainData struct {
-	Id     string
-	Domain string
-	Owner  string
+	Id       string
+	Domain   string
+	Owner    string
+	Transfer *TransferConfig `json:",omitempty"`
+	QueryCap int             `json:",omitempty"` // queries per second per node, 0 -> unlimited
+	QueryLog *QueryLogConfig `json:",omitempty"`
+
+	RateLimits    []types.RateLimit         `json:",omitempty"` // reverse proxy throttling
+	Balancers     map[string]types.Balancer `json:",omitempty"` // protected name -> reverse proxy load balancing
+	Timeouts      *types.ProxyTimeouts      `json:",omitempty"` // reverse proxy timeout profile, nil -> default
+	Compression   *types.Compression        `json:",omitempty"` // reverse proxy response compression, nil -> off
+	ImageMetadata *types.ImageMetadata      `json:",omitempty"` // reverse proxy image metadata stripping, nil -> exif only
 }
 
 func InsertRecord(domainData *DomainData, record *types.DNSRecord) {
@@ -132,3 +142,75 @@ func EnsureDomainIndexes(domain DomainData) {
 		DomainIndexName[domain.Domain] = root
 	}
 }
+
+type LookupResult struct {
+	Records  []*types.DNSRecord
+	Exists   bool   // false -> NXDOMAIN
+	Wildcard string // owner of the wildcard the answer was synthesized from (RFC 4592)
+	Encloser string // closest encloser of a name that does not exist
+}
+
+// LookupName walks the trie of the closest zone and falls back to a wildcard
+// child of the closest encloser when the queried name does not exist
+func LookupName(qname string) LookupResult {
+	qname = dns.CanonicalName(qname)
+	apex := FindApex(qname)
+	if apex == "" {
+		return LookupResult{}
+	}
+
+	ZonesMutex.RLock()
+	defer ZonesMutex.RUnlock()
+
+	node := Zones[apex]
+	if node == nil {
+		return LookupResult{}
+	}
+
+	labels := dns.SplitDomainName(qname)
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.Children[labels[i]]
+		if ok && child.hasRecords() {
+			node = child
+			continue
+		}
+
+		// node is the closest encloser, only a wildcard directly below it may match
+		encloser := strings.Join(labels[i+1:], ".") + "."
+		if !dns.IsSubDomain(apex, encloser) {
+			encloser = apex
+		}
+
+		wildcard, ok := node.Children["*"]
+		if !ok || len(wildcard.Records) == 0 {
+			return LookupResult{Encloser: encloser}
+		}
+
+		return LookupResult{
+			Records:  wildcard.Records,
+			Exists:   true,
+			Wildcard: "*." + encloser,
+		}
+	}
+
+	return LookupResult{
+		Records: node.Records,
+		Exists:  true,
+	}
+}
+
+// hasRecords reports whether the node or any node below it still holds records,
+// empty non-terminals exist while pruned leftovers do not
+func (node *TrieNode) hasRecords() bool {
+	if len(node.Records) > 0 {
+		return true
+	}
+
+	for _, child := range node.Children {
+		if child.hasRecords() {
+			return true
+		}
+	}
+
+	return false
+}
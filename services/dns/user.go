@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"sync"
+	"time"
 	"wired/modules/env"
 	"wired/modules/event"
 	event_data "wired/modules/event/events"
@@ -47,12 +48,7 @@ func CreateDomain(user *types.User, domainName string) error {
 	UserDomainIndexId[user.Id] = append(UserDomainIndexId[user.Id], domainData)
 	EnsureDomainIndexes(*domainData)
 
-	mutex, ok := ZoneFileMutexes[domainName]
-	if !ok {
-		mutex = &sync.Mutex{}
-		ZoneFileMutexes[domainName] = mutex
-	}
-
+	mutex := getZoneFileMutex(domainName)
 	mutex.Lock()
 	defer mutex.Unlock()
 
@@ -60,7 +56,7 @@ func CreateDomain(user *types.User, domainName string) error {
 		InsertRecord(domainData, &types.DNSRecord{
 			RR: &dns.NS{
 				Hdr: dns.RR_Header{Name: dns.Fqdn(domainName), Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600},
-				Ns:  fmt.Sprintf("%s.ns.wired.rip", ns),
+				Ns:  fmt.Sprintf("%s.ns.wired.rip.", ns),
 			},
 			Metadata: types.RecordMetadata{
 				Id:        strconv.Itoa(int(sf.GenerateID())),
@@ -82,17 +78,40 @@ func GetRecordsByDomain(user *types.User, domainId string) []*types.DNSRecord {
 }
 
 func CreateRecord(user *types.User, domainId string, record *types.DNSRecord) (string, error) {
-	recordId := strconv.Itoa(int(sf.GenerateID()))
 	domainData, ok := DomainDataIndexId[domainId]
 	if !ok || domainData.Owner != user.Id {
 		return "", fmt.Errorf("domain not found or not owned by user")
 	}
 
-	mutex := ZoneFileMutexes[domainData.Domain]
+	if record.Metadata.Origin != nil {
+		if err := record.Metadata.Origin.Validate(); err != nil {
+			return "", err
+		}
+	}
+
+	if policy := record.Metadata.Policy; policy != nil && policy.Check != nil {
+		if err := policy.Check.Validate(); err != nil {
+			return "", err
+		}
+	}
+
+	record.Metadata.Id = strconv.Itoa(int(sf.GenerateID()))
+	if err := addRecord(domainData, record, true); err != nil {
+		return "", err
+	}
+
+	return record.Metadata.Id, nil
+}
+
+// addRecord writes a record with its id to the zone, replicated records are neither published nor NOTIFYed again
+func addRecord(domainData *DomainData, record *types.DNSRecord, publish bool) error {
+	mutex := getZoneFileMutex(domainData.Domain)
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	record.Metadata.Id = recordId
+	if GetIndexedRecord(record.Metadata.Id) != nil {
+		return fmt.Errorf("record %s already exists", record.Metadata.Id)
+	}
 
 	zonefilePath := filepath.Join("zonefiles", domainData.Domain+".txt")
 	zoneFile, err := os.OpenFile(zonefilePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
@@ -104,39 +123,59 @@ func CreateRecord(user *types.User, domainId string, record *types.DNSRecord) (s
 
 		_, err = zoneFile.WriteString(line + "\n")
 		if err != nil {
-			return "", err
+			return err
 		}
 
 		err = zoneFile.Close()
 		if err != nil {
-			return "", err
+			return err
 		}
 	}
 
 	InsertRecord(domainData, record)
+	recordChange(dns.Fqdn(domainData.Domain), nil, []*types.DNSRecord{record})
+	if !publish {
+		return nil
+	}
+
+	notifySecondaries(domainData)
+
 	DNSEventBus.Pub(event.Event{
-		Type: event.Event_AddRecord,
-		Data: event_data.AddRecordData{OwnerId: user.Id, DomainId: domainId, Record: record},
+		Type:    event.Event_AddRecord,
+		FiredAt: time.Now(),
+		FiredBy: env.GetEnv("NODE_KEY", "node-key"),
+		Data:    event_data.AddRecordData{OwnerId: domainData.Owner, DomainId: domainData.Id, Record: record},
 	})
 
-	return recordId, nil
+	return nil
 }
 
 func DeleteRecord(user *types.User, recordId string) error {
-	indexed := ZoneIndexId[recordId]
+	return removeRecord(recordId, true)
+}
+
+// removeRecord deletes a record from its zone, replicated removals are neither published nor NOTIFYed again
+func removeRecord(recordId string, publish bool) error {
+	indexed := GetIndexedRecord(recordId)
 	if indexed == nil {
 		return fmt.Errorf("record not found")
 	}
 
-	mutex, ok := ZoneFileMutexes[indexed.Domain]
-	if ok {
-		mutex.Lock()
-		defer mutex.Unlock()
+	// indexed.Domain is the owner name of the record, the domain is the zone it lives in
+	domainData := DomainDataIndexName[indexed.Zone]
+	if domainData == nil {
+		return fmt.Errorf("domain of record not found")
 	}
 
+	mutex := getZoneFileMutex(domainData.Domain)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// readers iterate the indexes from other goroutines, e.g. the health checker
+	ZonesMutex.Lock()
 	delete(ZoneIndexId, recordId)
 
-	records := DomainRecordIndexId[indexed.Domain]
+	records := DomainRecordIndexId[domainData.Id]
 	newRecords := make([]*types.DNSRecord, 0, len(records))
 	for _, r := range records {
 		if r.Metadata.Id != recordId {
@@ -144,17 +183,129 @@ func DeleteRecord(user *types.User, recordId string) error {
 		}
 	}
 
-	DomainRecordIndexId[indexed.Domain] = newRecords
-
+	DomainRecordIndexId[domainData.Id] = newRecords
 	trie := Zones[indexed.Zone]
+	ZonesMutex.Unlock()
+
 	if trie != nil {
 		PruneTrie(trie, indexed.Record.RR.Header().Name, recordId)
 	}
 
-	DNSEventBus.Pub(event.Event{
-		Type: event.Event_RemoveRecord,
-		Data: event_data.RemoveRecordData{OwnerId: user.Id, DomainId: DomainDataIndexName[indexed.Domain].Id, Id: recordId},
-	})
+	recordChange(indexed.Zone, []*types.DNSRecord{indexed.Record}, nil)
+	if publish {
+		notifySecondaries(domainData)
+
+		DNSEventBus.Pub(event.Event{
+			Type:    event.Event_RemoveRecord,
+			FiredAt: time.Now(),
+			FiredBy: env.GetEnv("NODE_KEY", "node-key"),
+			Data:    event_data.RemoveRecordData{OwnerId: domainData.Owner, DomainId: domainData.Id, Id: recordId},
+		})
+	}
 
 	return RemoveRecordFromZoneFile(indexed.Zone, recordId)
 }
+
+// SetTransferConfig configures AXFR/IXFR access and NOTIFY targets of a domain
+func SetTransferConfig(user *types.User, domainId string, cfg *TransferConfig) error {
+	domainData, ok := DomainDataIndexId[domainId]
+	if !ok || domainData.Owner != user.Id {
+		return fmt.Errorf("domain not found or not owned by user")
+	}
+
+	if err := updateDomainSetting(domainData, settingTransfer, "", cfg); err != nil {
+		return err
+	}
+
+	// the other nodes apply the change without NOTIFYing again
+	notifySecondaries(domainData)
+	return nil
+}
+
+// SetQueryCap limits the queries per second every node answers for a domain, 0 removes the cap
+func SetQueryCap(user *types.User, domainId string, queryCap int) error {
+	domainData, ok := DomainDataIndexId[domainId]
+	if !ok || domainData.Owner != user.Id {
+		return fmt.Errorf("domain not found or not owned by user")
+	}
+
+	return updateDomainSetting(domainData, settingQueryCap, "", queryCap)
+}
+
+// SetQueryLogConfig sets the query log sampling of a domain, nil logs every query
+func SetQueryLogConfig(user *types.User, domainId string, cfg *QueryLogConfig) error {
+	domainData, ok := DomainDataIndexId[domainId]
+	if !ok || domainData.Owner != user.Id {
+		return fmt.Errorf("domain not found or not owned by user")
+	}
+
+	return updateDomainSetting(domainData, settingQueryLog, "", cfg)
+}
+
+// SetRateLimits replaces the reverse proxy rate limits of a domain
+func SetRateLimits(user *types.User, domainId string, limits []types.RateLimit) error {
+	domainData, ok := DomainDataIndexId[domainId]
+	if !ok || domainData.Owner != user.Id {
+		return fmt.Errorf("domain not found or not owned by user")
+	}
+
+	return updateDomainSetting(domainData, settingRateLimits, "", limits)
+}
+
+// SetBalancer configures the load balancing of a protected name, nil goes back to round robin
+func SetBalancer(user *types.User, domainId string, host string, balancer *types.Balancer) error {
+	domainData, ok := DomainDataIndexId[domainId]
+	if !ok || domainData.Owner != user.Id {
+		return fmt.Errorf("domain not found or not owned by user")
+	}
+
+	// sticky cookies are signed with JWT_SECRET, unsigned ones would let clients pick their origin
+	if balancer != nil && balancer.Sticky && env.GetEnv("JWT_SECRET", "") == "" {
+		return fmt.Errorf("sticky sessions need JWT_SECRET to be set")
+	}
+
+	return updateDomainSetting(domainData, settingBalancer, host, balancer)
+}
+
+// SetProxyTimeouts sets the reverse proxy timeouts of a domain, nil goes back to the default profile
+func SetProxyTimeouts(user *types.User, domainId string, timeouts *types.ProxyTimeouts) error {
+	domainData, ok := DomainDataIndexId[domainId]
+	if !ok || domainData.Owner != user.Id {
+		return fmt.Errorf("domain not found or not owned by user")
+	}
+
+	return updateDomainSetting(domainData, settingTimeouts, "", timeouts)
+}
+
+// SetCompression sets the reverse proxy response compression of a domain, nil turns it off
+func SetCompression(user *types.User, domainId string, compression *types.Compression) error {
+	domainData, ok := DomainDataIndexId[domainId]
+	if !ok || domainData.Owner != user.Id {
+		return fmt.Errorf("domain not found or not owned by user")
+	}
+
+	return updateDomainSetting(domainData, settingCompression, "", compression)
+}
+
+// SetImageMetadata sets the image metadata stripping of a domain, nil restores the default
+func SetImageMetadata(user *types.User, domainId string, metadata *types.ImageMetadata) error {
+	domainData, ok := DomainDataIndexId[domainId]
+	if !ok || domainData.Owner != user.Id {
+		return fmt.Errorf("domain not found or not owned by user")
+	}
+
+	return updateDomainSetting(domainData, settingImageMetadata, "", metadata)
+}
+
+func getZoneFileMutex(domain string) *sync.Mutex {
+	ZonesMutex.Lock()
+	defer ZonesMutex.Unlock()
+
+	mutex, ok := ZoneFileMutexes[domain]
+	if !ok {
+		mutex = &sync.Mutex{}
+		ZoneFileMutexes[domain] = mutex
+	}
+
+	return mutex
+}
@@ -134,6 +134,72 @@ func RemoveRecordFromZoneFile(zone string, recordId string) error {
 	return os.WriteFile(filePath, []byte(strings.Join(lines, "\n")+"\n"), 0644)
 }
 
+// UpdateRecordSSLInfo stores the certificate validity of a record and writes it to its zone file
+func UpdateRecordSSLInfo(recordId string, info types.SSLInfo) error {
+	indexed := GetIndexedRecord(recordId)
+	if indexed == nil {
+		return fmt.Errorf("record not found")
+	}
+
+	domainData := DomainDataIndexName[indexed.Zone]
+	if domainData == nil {
+		return fmt.Errorf("no domain data for zone %s", indexed.Zone)
+	}
+
+	mutex := getZoneFileMutex(domainData.Domain)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// certificates are reloaded often, the zone file is only written when the validity changed
+	current := indexed.Record.Metadata.SSLInfo
+	if current.IssuedAt.Equal(info.IssuedAt) && current.ExpiresAt.Equal(info.ExpiresAt) {
+		return nil
+	}
+
+	indexed.Record.Metadata.SSLInfo = info
+	return replaceRecordInZoneFile(domainData.Domain, indexed.Record)
+}
+
+// replaceRecordInZoneFile rewrites the line of a record with its current data, the zone file mutex must be held
+func replaceRecordInZoneFile(zone string, record *types.DNSRecord) error {
+	filePath := filepath.Join("zonefiles", zone+".txt")
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	marshaledMeta, err := json.Marshal(record.Metadata)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	found := false
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ";", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		var meta types.RecordMetadata
+		if err := json.Unmarshal([]byte(strings.TrimSpace(parts[1])), &meta); err == nil && meta.Id == record.Metadata.Id {
+			lines[i] = strings.TrimSpace(record.RR.String()) + "; " + string(marshaledMeta)
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("record not found in zonefile")
+	}
+
+	return os.WriteFile(filePath, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
 func LoadZonefile() {
 	os.MkdirAll("zonefiles", os.ModePerm)
 	files, err := os.ReadDir("zonefiles")
@@ -258,7 +324,11 @@ func WriteZoneFile(zone string) error {
 	return writer.Flush()
 }
 
+// PruneTrie removes a record from its trie node, lookups may still hold the previous records
 func PruneTrie(root *TrieNode, fqdn string, recordId string) {
+	ZonesMutex.Lock()
+	defer ZonesMutex.Unlock()
+
 	labels := dns.SplitDomainName(fqdn)
 	node := root
 
@@ -274,7 +344,7 @@ func PruneTrie(root *TrieNode, fqdn string, recordId string) {
 		return
 	}
 
-	newRecs := node.Records[:0]
+	newRecs := make([]*types.DNSRecord, 0, len(node.Records))
 	for _, rec := range node.Records {
 		if rec.Metadata.Id != recordId {
 			newRecs = append(newRecs, rec)
@@ -283,3 +353,28 @@ func PruneTrie(root *TrieNode, fqdn string, recordId string) {
 
 	node.Records = newRecs
 }
+
+// WriteZoneFileHeader replaces the domain group header of a zonefile and keeps its records
+func WriteZoneFileHeader(domainData *DomainData) error {
+	filePath := filepath.Join("zonefiles", domainData.Domain+".txt")
+	data, err := os.ReadFile(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	marshaledData, err := json.Marshal(domainData)
+	if err != nil {
+		return err
+	}
+
+	lines := []string{";" + string(marshaledData)}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), ";") {
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	return os.WriteFile(filePath, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
@@ -0,0 +1,285 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"wired/modules/env"
+	"wired/modules/geo"
+	"wired/modules/logger"
+	"wired/modules/postgresql"
+	"wired/modules/snowflake"
+	"wired/services/dns"
+)
+
+/*
+	Access logging into postgresql.HTTPRequestLog
+
+	Every request gets a snowflake request id, sent to the origin and the client as
+	wired-request-id. Proxied requests are queued without blocking and copied into
+	the logs DB in batches, a full queue drops entries instead of slowing requests.
+*/
+
+const (
+	accessLogQueueSize = 16384
+	accessLogBatchSize = 1000
+	accessLogFlush     = 2 * time.Second
+	accessLogTimeout   = 10 * time.Second
+
+	requestIdHeader = "Wired-Request-Id"
+)
+
+var (
+	sf *snowflake.Snowflake
+
+	accessLogQueue   = make(chan postgresql.HTTPRequestLog, accessLogQueueSize)
+	accessLogDropped atomic.Uint64
+
+	redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+)
+
+func init() {
+	env.LoadEnvFile()
+	machineIDStr := env.GetEnv("SNOWFLAKE_MACHINE_ID", "0")
+	machineID, err := strconv.ParseInt(machineIDStr, 10, 64)
+	if err != nil {
+		logger.Fatal("Invalid SNOWFLAKE_MACHINE_ID: ", err)
+	}
+
+	sf, err = snowflake.NewSnowflake(machineID)
+	if err != nil {
+		logger.Fatal("Error creating Snowflake instance: ", err)
+	}
+}
+
+type accessLogKey struct{}
+
+// accessLogState is shared between the middleware and the reverse proxy of a request
+type accessLogState struct {
+	proxied      bool
+	originStatus int
+}
+
+func requestState(r *http.Request) *accessLogState {
+	state, _ := r.Context().Value(accessLogKey{}).(*accessLogState)
+	return state
+}
+
+// markProxied makes the middleware log the request
+func markProxied(r *http.Request) {
+	if state := requestState(r); state != nil {
+		state.proxied = true
+	}
+}
+
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *accessLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection does not support hijacking")
+	}
+
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+
+	return hijacker.Hijack()
+}
+
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type countingBody struct {
+	io.ReadCloser
+	size int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	return n, err
+}
+
+// withAccessLog assigns the request id and logs proxied requests
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestId := strconv.FormatUint(sf.GenerateID(), 10)
+		r.Header.Set(requestIdHeader, requestId)
+		w.Header().Set(requestIdHeader, requestId)
+
+		state := &accessLogState{}
+		r = r.WithContext(context.WithValue(r.Context(), accessLogKey{}, state))
+
+		var body *countingBody
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &countingBody{ReadCloser: r.Body}
+			r.Body = body
+		}
+
+		lw := &accessLogWriter{ResponseWriter: w}
+		next.ServeHTTP(lw, r)
+
+		if !state.proxied {
+			return
+		}
+
+		entry := postgresql.HTTPRequestLog{
+			RequestId:            requestId,
+			Domain:               dns.FindApex(requestHost(r) + "."),
+			RequestTime:          start.UnixMilli(),
+			ClientIP:             clientIP(r),
+			Method:               r.Method,
+			Host:                 requestHost(r),
+			Path:                 r.URL.Path,
+			QueryParams:          marshalLogValue(r.URL.Query()),
+			RequestHeaders:       marshalLogValue(redactHeaders(r.Header)),
+			ResponseHeaders:      marshalLogValue(redactHeaders(lw.Header())),
+			ResponseStatusOrigin: state.originStatus,
+			ResponseStatusProxy:  lw.status,
+			ResponseTime:         time.Since(start).Microseconds(),
+			ResponseSize:         lw.size,
+			RequestHTTPVersion:   r.Proto,
+			Node:                 env.GetEnv("NODE_KEY", "node-key"),
+		}
+
+		if body != nil {
+			entry.RequestSize = body.size
+		}
+
+		if r.TLS != nil {
+			entry.TLSVersion = tls.VersionName(r.TLS.Version)
+		}
+
+		select {
+		case accessLogQueue <- entry:
+		default:
+			accessLogDropped.Add(1)
+		}
+	})
+}
+
+func requestHost(r *http.Request) string {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return host
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func redactHeaders(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range redactedHeaders {
+		if _, ok := redacted[name]; ok {
+			redacted[name] = []string{"[redacted]"}
+		}
+	}
+
+	return redacted
+}
+
+func marshalLogValue(v any) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return json.RawMessage("null")
+	}
+
+	return data
+}
+
+func startAccessLogger(ctx context.Context) {
+	ticker := time.NewTicker(accessLogFlush)
+	defer ticker.Stop()
+
+	batch := make([]postgresql.HTTPRequestLog, 0, accessLogBatchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			flushAccessLogs(batch)
+			return
+		case entry := <-accessLogQueue:
+			// the country is resolved here, off the request path
+			if loc, err := geo.GetLocation(net.ParseIP(entry.ClientIP)); err == nil && loc != nil {
+				entry.ClientCountry = strings.ToUpper(loc.CountryCode)
+			}
+
+			batch = append(batch, entry)
+			if len(batch) >= accessLogBatchSize {
+				flushAccessLogs(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				flushAccessLogs(batch)
+				batch = batch[:0]
+			}
+
+			if dropped := accessLogDropped.Swap(0); dropped > 0 {
+				logger.Printf("Access log queue full, dropped %d entries\n", dropped)
+			}
+		}
+	}
+}
+
+func flushAccessLogs(batch []postgresql.HTTPRequestLog) {
+	// no logs DB configured on this node
+	if len(batch) == 0 || postgresql.Manager.GetPool("logs") == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), accessLogTimeout)
+	defer cancel()
+
+	if err := postgresql.InsertHTTPRequestLogs(ctx, batch); err != nil {
+		logger.Printf("Failed to insert %d access logs: %v\n", len(batch), err)
+	}
+}
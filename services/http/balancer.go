@@ -0,0 +1,343 @@
+package http
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wired/modules/logger"
+	"wired/modules/types"
+	"wired/services/dns"
+)
+
+/*
+	Reverse proxy load balancing
+
+	Every proxied name gets a balancer over the origins of its protected records,
+	it picks one per request with the strategy configured in DomainData.Balancers.
+	Origins are ejected after consecutive failed requests (passive) and while
+	their probes fail (active: the shared dns health check of the record if it
+	has one, a tcp connect otherwise). Ejections double up to ejectionMax and end
+	by themselves, when every origin is out the balancer uses all of them anyway.
+*/
+
+const (
+	balancerCheckInterval = 10 * time.Second
+	balancerCheckTimeout  = 2 * time.Second
+	passiveFailures       = 3 // consecutive failures before an ejection
+	ejectionBase          = 30 * time.Second
+	ejectionMax           = 5 * time.Minute
+	stickyCookie          = "wired_origin"
+)
+
+type balancerOrigin struct {
+	backend protectedBackend
+	proxy   *httputil.ReverseProxy
+	active  atomic.Int64 // requests in flight
+
+	// guarded by the balancer
+	down          bool // failed its last active check
+	failures      int  // consecutive passive failures
+	ejections     int
+	ejectedUntil  time.Time
+	currentWeight int // smooth weighted round robin
+}
+
+type balancer struct {
+	host    string
+	origins []*balancerOrigin
+	next    int
+	mu      sync.Mutex
+}
+
+func newBalancer(host string, backends []protectedBackend) (*balancer, error) {
+	b := &balancer{host: host}
+	for _, backend := range backends {
+		proxy, err := newReverseProxy(host, backend)
+		if err != nil {
+			logger.Printf("Invalid origin TLS settings for %s (record %s): %v\n", host, backend.recordId, err)
+			continue
+		}
+
+		origin := &balancerOrigin{backend: backend, proxy: proxy}
+		b.observe(origin)
+		b.origins = append(b.origins, origin)
+	}
+
+	if len(b.origins) == 0 {
+		return nil, errors.New("no usable origin")
+	}
+
+	return b, nil
+}
+
+// observe counts proxy errors and gateway errors of the origin as passive check failures
+func (b *balancer) observe(origin *balancerOrigin) {
+	errorHandler := origin.proxy.ErrorHandler
+	origin.proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		// clients going away say nothing about the origin
+		if !errors.Is(context.Cause(r.Context()), context.Canceled) {
+			b.report(origin, false)
+		}
+
+		errorHandler(w, r, err)
+	}
+
+	modifyResponse := origin.proxy.ModifyResponse
+	origin.proxy.ModifyResponse = func(resp *http.Response) error {
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			b.report(origin, false)
+		default:
+			b.report(origin, true)
+		}
+
+		return modifyResponse(resp)
+	}
+}
+
+func (b *balancer) report(origin *balancerOrigin, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ok {
+		origin.failures = 0
+		origin.ejections = 0
+		return
+	}
+
+	origin.failures++
+	now := time.Now()
+	if origin.failures < passiveFailures || now.Before(origin.ejectedUntil) {
+		return
+	}
+
+	ejection := min(ejectionMax, ejectionBase<<min(origin.ejections, 8))
+	origin.ejectedUntil = now.Add(ejection)
+	origin.ejections++
+	// a single failure after the ejection ends is enough for the next one
+	origin.failures = passiveFailures - 1
+
+	logger.Printf("Ejected origin %s of %s for %s\n", origin.backend.addr, b.host, ejection)
+}
+
+// config returns the balancing settings of the host, round robin without any
+func (b *balancer) config() types.Balancer {
+	if domainData := dns.DomainDataIndexName[dns.FindApex(b.host+".")]; domainData != nil {
+		if cfg, ok := domainData.Balancers[b.host]; ok {
+			return cfg
+		}
+	}
+
+	return types.Balancer{Strategy: types.BalanceRoundRobin}
+}
+
+func (b *balancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg := b.config()
+	secret := signingSecret()
+	if secret == nil {
+		// unsigned cookies would let clients pick their origin
+		cfg.Sticky = false
+	}
+
+	origin, pinned := b.pick(r, cfg, secret)
+
+	if cfg.Sticky && !pinned {
+		http.SetCookie(w, &http.Cookie{
+			Name:     stickyCookie,
+			Value:    stickyToken(secret, b.host, origin.backend.recordId),
+			Path:     "/",
+			MaxAge:   cfg.StickyTTL,
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	origin.active.Add(1)
+	defer origin.active.Add(-1)
+
+	origin.proxy.ServeHTTP(w, r)
+}
+
+// pick chooses the origin of a request, pinned is true when it came from the sticky cookie
+func (b *balancer) pick(r *http.Request, cfg types.Balancer, secret []byte) (*balancerOrigin, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.origins) == 1 {
+		return b.origins[0], cfg.Sticky && b.stickyOrigin(r, b.origins, secret) != nil
+	}
+
+	now := time.Now()
+	candidates := make([]*balancerOrigin, 0, len(b.origins))
+	for _, origin := range b.origins {
+		if !origin.down && !now.Before(origin.ejectedUntil) {
+			candidates = append(candidates, origin)
+		}
+	}
+
+	if len(candidates) == 0 {
+		// every origin is out, trying one beats failing right away
+		candidates = b.origins
+	}
+
+	if cfg.Sticky {
+		if origin := b.stickyOrigin(r, candidates, secret); origin != nil {
+			return origin, true
+		}
+	}
+
+	switch cfg.Strategy {
+	case types.BalanceLeastConn:
+		start := b.next % len(candidates)
+		b.next++
+
+		best := candidates[start]
+		for i := 1; i < len(candidates); i++ {
+			origin := candidates[(start+i)%len(candidates)]
+			if origin.active.Load() < best.active.Load() {
+				best = origin
+			}
+		}
+
+		return best, false
+	case types.BalanceIPHash:
+		// rendezvous hashing only moves the clients of origins that went away
+		ip := clientIP(r)
+		var (
+			best      *balancerOrigin
+			bestScore uint64
+		)
+
+		for _, origin := range candidates {
+			sum := sha256.Sum256([]byte(ip + "|" + origin.backend.recordId))
+			if score := binary.BigEndian.Uint64(sum[:8]); best == nil || score > bestScore {
+				best, bestScore = origin, score
+			}
+		}
+
+		return best, false
+	case types.BalanceWeighted:
+		// smooth weighted round robin, spreads the turns of heavy origins
+		total := 0
+		var best *balancerOrigin
+		for _, origin := range candidates {
+			origin.currentWeight += origin.backend.weight
+			total += origin.backend.weight
+			if best == nil || origin.currentWeight > best.currentWeight {
+				best = origin
+			}
+		}
+
+		best.currentWeight -= total
+		return best, false
+	}
+
+	origin := candidates[b.next%len(candidates)]
+	b.next++
+	return origin, false
+}
+
+func (b *balancer) stickyOrigin(r *http.Request, origins []*balancerOrigin, secret []byte) *balancerOrigin {
+	cookie, err := r.Cookie(stickyCookie)
+	if err != nil {
+		return nil
+	}
+
+	recordId, _, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(cookie.Value), []byte(stickyToken(secret, b.host, recordId))) {
+		return nil
+	}
+
+	for _, origin := range origins {
+		if origin.backend.recordId == recordId {
+			return origin
+		}
+	}
+
+	return nil
+}
+
+// stickyToken names the origin of a client, signed with signingSecret so clients can't pick one themselves
+func stickyToken(secret []byte, host, recordId string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(host + "|" + recordId))
+	return recordId + "." + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// startBalancerHealthChecks actively probes the origins of names with more than one
+func startBalancerHealthChecks(ctx context.Context) {
+	ticker := time.NewTicker(balancerCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			proxyMu.RLock()
+			balancers := make([]*balancer, 0, len(proxyMap))
+			for _, b := range proxyMap {
+				if len(b.origins) > 1 {
+					balancers = append(balancers, b)
+				}
+			}
+			proxyMu.RUnlock()
+
+			var wg sync.WaitGroup
+			for _, b := range balancers {
+				for _, origin := range b.origins {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						b.setDown(origin, !originHealthy(origin.backend))
+					}()
+				}
+			}
+
+			wg.Wait()
+		}
+	}
+}
+
+func (b *balancer) setDown(origin *balancerOrigin, down bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if origin.down == down {
+		return
+	}
+
+	origin.down = down
+	state := "up"
+	if down {
+		state = "down"
+	}
+
+	logger.Printf("Origin %s of %s is %s\n", origin.backend.addr, b.host, state)
+}
+
+// originHealthy uses the shared health of the record when it has a check, a tcp connect otherwise
+func originHealthy(backend protectedBackend) bool {
+	if indexed := dns.GetIndexedRecord(backend.recordId); indexed != nil && dns.HealthTarget(indexed.Record) != "" {
+		return dns.IsHealthy(indexed.Record)
+	}
+
+	conn, err := net.DialTimeout("tcp", backend.addr.String(), balancerCheckTimeout)
+	if err != nil {
+		return false
+	}
+
+	conn.Close()
+	return true
+}
@@ -0,0 +1,79 @@
+package http
+
+import (
+	"strconv"
+	"wired/modules/env"
+	"wired/modules/event"
+	event_data "wired/modules/event/events"
+	"wired/modules/httpcache"
+	"wired/modules/logger"
+	"wired/services/dns"
+)
+
+/*
+	Edge cache for proxied sites, see modules/httpcache
+
+	HTTP_CACHE_DIR (default cache), HTTP_CACHE_MEMORY_MB (256), HTTP_CACHE_DISK_MB (4096)
+	and HTTP_CACHE_MAX_OBJECT_MB (16) size the cache of this node, its disk tier is
+	cleared on start and lives in HTTP_CACHE_DIR/entries. Purges from the
+	dashboard are published as Event_CachePurge and applied on every node.
+*/
+
+var httpCache *httpcache.Cache
+
+func init() {
+	purgeChan := make(chan event.Event)
+	HTTPEventBus.Sub(event.Event_CachePurge, purgeChan, func() { cachePurgeEventHandler(purgeChan) })
+}
+
+func cachePurgeEventHandler(eventChan <-chan event.Event) {
+	for e := range eventChan {
+		data, ok := event.DecodeData[event_data.CachePurgeData](e)
+		if !ok {
+			logger.Println("Invalid event data for CachePurge")
+			continue
+		}
+
+		if httpCache == nil {
+			continue
+		}
+
+		purged := httpCache.Purge(httpcache.Purge{
+			Domain:   data.Domain,
+			URLs:     data.URLs,
+			Prefixes: data.Prefixes,
+			Tags:     data.Tags,
+		})
+
+		logger.Printf("Purged %d cached responses of %s\n", purged, data.Domain)
+	}
+}
+
+func initCache() {
+	cache, err := httpcache.New(httpcache.Options{
+		Dir:           env.GetEnv("HTTP_CACHE_DIR", "cache"),
+		MemoryLimit:   cacheSizeEnv("HTTP_CACHE_MEMORY_MB", 256),
+		DiskLimit:     cacheSizeEnv("HTTP_CACHE_DISK_MB", 4096),
+		MaxObjectSize: cacheSizeEnv("HTTP_CACHE_MAX_OBJECT_MB", 16),
+		IgnoreHeaders: []string{requestIdHeader},
+		Domain: func(host string) string {
+			return dns.FindApex(host + ".")
+		},
+	})
+	if err != nil {
+		logger.Println("Failed to initialize HTTP cache, responses won't be cached: ", err)
+		return
+	}
+
+	httpCache = cache
+}
+
+func cacheSizeEnv(key string, defaultMB int64) int64 {
+	mb, err := strconv.ParseInt(env.GetEnv(key, strconv.FormatInt(defaultMB, 10)), 10, 64)
+	if err != nil || mb < 0 {
+		logger.Printf("Invalid %s, using %d\n", key, defaultMB)
+		mb = defaultMB
+	}
+
+	return mb << 20
+}
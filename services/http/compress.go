@@ -0,0 +1,252 @@
+package http
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"wired/modules/types"
+	"wired/services/dns"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+	Reverse proxy response compression
+
+	Domains with compression enabled (DomainData.Compression) get compressible
+	responses encoded with the best encoding the client accepts. The
+	Accept-Encoding of a request is narrowed to that one encoding before the
+	cache, so cached variants are keyed by it (Vary) and origins compressing
+	with it themselves are passed through untouched. Responses are compressed
+	after image metadata was stripped, event streams and partial responses
+	are never compressed.
+*/
+
+const (
+	brotliLevel = 4 // on the fly, higher levels cost far more cpu than they save
+	gzipLevel   = 5
+)
+
+var compressibleTypes = []string{
+	"application/javascript",
+	"application/json",
+	"application/manifest+json",
+	"application/wasm",
+	"application/xhtml+xml",
+	"application/xml",
+	"application/x-javascript",
+	"font/otf",
+	"font/ttf",
+	"image/svg+xml",
+	"image/x-icon",
+}
+
+var (
+	gzipWriters   sync.Pool
+	brotliWriters sync.Pool
+	zstdWriters   sync.Pool
+)
+
+// domainCompression returns the compression settings of the domain a host belongs to, nil when it's off
+func domainCompression(host string) *types.Compression {
+	if domainData := dns.DomainDataIndexName[dns.FindApex(host+".")]; domainData != nil && domainData.Compression != nil && domainData.Compression.Enabled {
+		return domainData.Compression
+	}
+
+	return nil
+}
+
+// negotiateEncoding narrows the Accept-Encoding of a request to the encoding the response will use
+func negotiateEncoding(r *http.Request) {
+	compression := domainCompression(requestHost(r))
+	if compression == nil {
+		return
+	}
+
+	encodings := compression.Encodings
+	if len(encodings) == 0 {
+		encodings = types.Encodings
+	}
+
+	if encoding := preferredEncoding(r.Header.Values("Accept-Encoding"), encodings); encoding != "" {
+		r.Header.Set("Accept-Encoding", encoding)
+	} else {
+		r.Header.Del("Accept-Encoding")
+	}
+}
+
+// preferredEncoding picks the supported encoding with the highest q value, ties go to the order of supported
+func preferredEncoding(accept []string, supported []string) string {
+	qualities := make(map[string]float64)
+	wildcard := -1.0
+	for _, value := range accept {
+		for _, part := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(part, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			q := 1.0
+			if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = parsed
+				}
+			}
+
+			if name == "*" {
+				wildcard = q
+			} else if name != "" {
+				qualities[name] = q
+			}
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range supported {
+		q, ok := qualities[encoding]
+		if !ok {
+			q = wildcard
+		}
+
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+
+	return best
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	if mediaType == "text/event-stream" {
+		// every event must reach the client right away
+		return false
+	}
+
+	return strings.HasPrefix(mediaType, "text/") || slices.Contains(compressibleTypes, mediaType) ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// compressResponse encodes a compressible response with the negotiated encoding, host is the proxied name
+func compressResponse(host string, resp *http.Response) {
+	compression := domainCompression(host)
+	if compression == nil || !compressible(resp.Header.Get("Content-Type")) {
+		return
+	}
+
+	// the response depends on the encoding either way
+	if !headerHasToken(resp.Header, "Vary", "Accept-Encoding") && !headerHasToken(resp.Header, "Vary", "*") {
+		resp.Header.Add("Vary", "Accept-Encoding")
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusPartialContent, http.StatusNotModified:
+		return
+	}
+
+	if resp.Header.Get("Content-Encoding") != "" || headerHasToken(resp.Header, "Cache-Control", "no-transform") {
+		return
+	}
+
+	minSize := compression.MinSize
+	if minSize == 0 {
+		minSize = types.DefaultCompressionMinSize
+	}
+
+	if resp.ContentLength >= 0 && resp.ContentLength < int64(minSize) {
+		return
+	}
+
+	encoding := resp.Request.Header.Get("Accept-Encoding")
+	if !slices.Contains(types.Encodings, encoding) {
+		return
+	}
+
+	originalBody := resp.Body
+	pr, pw := io.Pipe()
+	resp.Body = pr
+
+	resp.Header.Set("Content-Encoding", encoding)
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Accept-Ranges")
+	resp.ContentLength = -1
+
+	// the encoded body isn't byte for byte the one the etag was made for
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+
+	go func() {
+		defer originalBody.Close()
+
+		pw.CloseWithError(encodeBody(encoding, originalBody, pw))
+	}()
+}
+
+func encodeBody(encoding string, src io.Reader, dst io.Writer) error {
+	switch encoding {
+	case types.EncodingBrotli:
+		bw, _ := brotliWriters.Get().(*brotli.Writer)
+		if bw == nil {
+			bw = brotli.NewWriterLevel(dst, brotliLevel)
+		} else {
+			bw.Reset(dst)
+		}
+		defer brotliWriters.Put(bw)
+
+		return copyAndClose(bw, src)
+	case types.EncodingZstd:
+		zw, _ := zstdWriters.Get().(*zstd.Encoder)
+		if zw == nil {
+			var err error
+			zw, err = zstd.NewWriter(dst, zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				return err
+			}
+		} else {
+			zw.Reset(dst)
+		}
+		defer zstdWriters.Put(zw)
+
+		return copyAndClose(zw, src)
+	default:
+		gw, _ := gzipWriters.Get().(*gzip.Writer)
+		if gw == nil {
+			gw, _ = gzip.NewWriterLevel(dst, gzipLevel)
+		} else {
+			gw.Reset(dst)
+		}
+		defer gzipWriters.Put(gw)
+
+		return copyAndClose(gw, src)
+	}
+}
+
+func copyAndClose(w io.WriteCloser, src io.Reader) error {
+	if _, err := io.Copy(w, src); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			part, _, _ = strings.Cut(part, "=")
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -2,6 +2,10 @@ package http
 
 import (
 	"net"
+	"slices"
+	"strings"
+	"wired/modules/logger"
+	"wired/modules/types"
 	wired_dns "wired/services/dns"
 
 	"github.com/miekg/dns"
@@ -10,13 +14,22 @@ import (
 type protectedBackend struct {
 	recordId string
 	addr     net.Addr
+	origin   types.OriginConfig
+	weight   int
+}
+
+func (b protectedBackend) equal(other protectedBackend) bool {
+	return b.recordId == other.recordId && b.addr.String() == other.addr.String() &&
+		b.origin == other.origin && b.weight == other.weight
 }
 
 var (
-	protectedHosts = make(map[string]protectedBackend)
+	protectedHosts = make(map[string][]protectedBackend) // guarded by proxyMu
 )
 
-func loadProtectedHosts() {
+// loadProtectedHosts returns the backends of every protected record by name, ordered by record id
+func loadProtectedHosts() map[string][]protectedBackend {
+	hosts := make(map[string][]protectedBackend)
 	records := wired_dns.GetAllRecords()
 	for _, record := range records {
 		if record.Metadata.Protected {
@@ -28,12 +41,49 @@ func loadProtectedHosts() {
 				ip = net.ParseIP(r.AAAA.String())
 			}
 
-			if ip != nil {
-				protectedHosts[record.RR.Header().Name] = protectedBackend{
-					recordId: record.Metadata.Id,
-					addr:     &net.TCPAddr{IP: ip, Port: 80},
+			if ip == nil {
+				continue
+			}
+
+			origin := types.OriginConfig{Scheme: "http", Verify: types.OriginVerifyFull}
+			if record.Metadata.Origin != nil {
+				origin = *record.Metadata.Origin
+				if err := origin.Validate(); err != nil {
+					logger.Printf("Invalid origin of %s, using http on port 80: %v\n", record.RR.Header().Name, err)
+					origin = types.OriginConfig{Scheme: "http", Verify: types.OriginVerifyFull}
 				}
 			}
+
+			weight := 1
+			if record.Metadata.Policy != nil && record.Metadata.Policy.Weight > 0 {
+				weight = int(record.Metadata.Policy.Weight)
+			}
+
+			name := record.RR.Header().Name
+			hosts[name] = append(hosts[name], protectedBackend{
+				recordId: record.Metadata.Id,
+				addr:     &net.TCPAddr{IP: ip, Port: origin.TargetPort()},
+				origin:   origin,
+				weight:   weight,
+			})
 		}
 	}
+
+	// records come in map order, sorting keeps reloads stable
+	for _, backends := range hosts {
+		slices.SortFunc(backends, func(a, b protectedBackend) int {
+			return strings.Compare(a.recordId, b.recordId)
+		})
+	}
+
+	return hosts
+}
+
+// wildcardHost returns the wildcard name covering host, "a.example.com" -> "*.example.com"
+func wildcardHost(host string) string {
+	if i := strings.IndexByte(host, '.'); i != -1 {
+		return "*" + host[i:]
+	}
+
+	return host
 }
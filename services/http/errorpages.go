@@ -0,0 +1,70 @@
+package http
+
+import (
+	"net/http"
+	"time"
+	"wired/modules/env"
+	"wired/modules/event"
+	event_data "wired/modules/event/events"
+	"wired/modules/logger"
+	"wired/modules/pages"
+	"wired/modules/postgresql"
+	"wired/services/dns"
+)
+
+/*
+	Custom error pages
+
+	Users can replace the pages of pages.CustomCodes with their own html, stored in
+	the error_pages table and cached with the user. The pages are served for every
+	domain of the user, changes reach other nodes through Event_ErrorPageChanged.
+*/
+
+func init() {
+	errorPageChan := make(chan event.Event)
+	HTTPEventBus.Sub(event.Event_ErrorPageChanged, errorPageChan, func() { errorPageChangedEventHandler(errorPageChan) })
+}
+
+func errorPageChangedEventHandler(eventChan <-chan event.Event) {
+	for e := range eventChan {
+		if e.FiredBy == env.GetEnv("NODE_KEY", "node-key") {
+			continue
+		}
+
+		data, ok := event.DecodeData[event_data.ErrorPageChangedData](e)
+		if !ok {
+			logger.Println("Invalid event data for ErrorPageChanged")
+			continue
+		}
+
+		postgresql.CacheErrorPage(data.OwnerId, data.Code, data.Html)
+	}
+}
+
+// writeErrorPage answers with the page of code, the custom page of the host's owner when there is one.
+// code differs from status for wired's own pages, e.g. 605 is sent as 504
+func writeErrorPage(w http.ResponseWriter, r *http.Request, host string, status, code int) {
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	if domainData := dns.DomainDataIndexName[dns.FindApex(host+".")]; domainData != nil {
+		for _, c := range []int{code, status} {
+			page, ok := postgresql.CachedErrorPage(domainData.Owner, c)
+			if !ok {
+				continue
+			}
+
+			w.Write(pages.RenderCustom(page, pages.Vars{
+				Status:    status,
+				RequestId: r.Header.Get(requestIdHeader),
+				Node:      env.GetEnv("NODE_KEY", "node-key"),
+				ClientIP:  clientIP(r),
+				Time:      time.Now(),
+			}))
+			return
+		}
+	}
+
+	w.Write(pages.ErrorPages[code].Html)
+}
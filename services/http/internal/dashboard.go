@@ -11,7 +11,22 @@ import (
 	api_auth_discord "wired/services/http/internal/routes/api/auth/discord"
 	api_auth_discord_callback "wired/services/http/internal/routes/api/auth/discord/callback"
 	api_domains "wired/services/http/internal/routes/api/domains"
+	api_domains_balancer "wired/services/http/internal/routes/api/domains/balancer"
+	api_domains_cache_purge "wired/services/http/internal/routes/api/domains/cache/purge"
+	api_domains_compression "wired/services/http/internal/routes/api/domains/compression"
+	api_domains_dnssec "wired/services/http/internal/routes/api/domains/dnssec"
+	api_domains_logs "wired/services/http/internal/routes/api/domains/logs"
+	api_domains_metadata "wired/services/http/internal/routes/api/domains/metadata"
+	api_domains_querycap "wired/services/http/internal/routes/api/domains/querycap"
+	api_domains_querylog "wired/services/http/internal/routes/api/domains/querylog"
+	api_domains_ratelimits "wired/services/http/internal/routes/api/domains/ratelimits"
 	api_domains_records "wired/services/http/internal/routes/api/domains/records"
+	api_domains_renewals "wired/services/http/internal/routes/api/domains/renewals"
+	api_domains_timeouts "wired/services/http/internal/routes/api/domains/timeouts"
+	api_domains_transfer "wired/services/http/internal/routes/api/domains/transfer"
+	api_domains_waf "wired/services/http/internal/routes/api/domains/waf"
+	api_errorpages "wired/services/http/internal/routes/api/errorpages"
+	api_errorpages_preview "wired/services/http/internal/routes/api/errorpages/preview"
 )
 
 type Route struct {
@@ -39,6 +54,32 @@ func PostStart() {
 		{AuthLevel: 0, Method: http.MethodGet, Path: "/dash/api/auth/discord/callback"}: api_auth_discord_callback.Get,
 		{AuthLevel: 1, Method: http.MethodGet, Path: "/dash/api/domains"}:               api_domains.Get,
 		{AuthLevel: 2, Method: http.MethodGet, Path: "/dash/api/domains/records"}:       api_domains_records.Get,
+		{AuthLevel: 2, Method: http.MethodGet, Path: "/dash/api/domains/dnssec"}:        api_domains_dnssec.Get,
+		{AuthLevel: 2, Method: http.MethodGet, Path: "/dash/api/domains/logs"}:          api_domains_logs.Get,
+		{AuthLevel: 2, Method: http.MethodGet, Path: "/dash/api/domains/waf"}:           api_domains_waf.Get,
+		{AuthLevel: 2, Method: http.MethodPost, Path: "/dash/api/domains/waf"}:          api_domains_waf.Post,
+		{AuthLevel: 2, Method: http.MethodPost, Path: "/dash/api/domains/cache/purge"}:  api_domains_cache_purge.Post,
+		{AuthLevel: 2, Method: http.MethodGet, Path: "/dash/api/domains/balancer"}:      api_domains_balancer.Get,
+		{AuthLevel: 2, Method: http.MethodPost, Path: "/dash/api/domains/balancer"}:     api_domains_balancer.Post,
+		{AuthLevel: 2, Method: http.MethodGet, Path: "/dash/api/domains/timeouts"}:      api_domains_timeouts.Get,
+		{AuthLevel: 2, Method: http.MethodPost, Path: "/dash/api/domains/timeouts"}:     api_domains_timeouts.Post,
+		{AuthLevel: 2, Method: http.MethodGet, Path: "/dash/api/domains/compression"}:   api_domains_compression.Get,
+		{AuthLevel: 2, Method: http.MethodPost, Path: "/dash/api/domains/compression"}:  api_domains_compression.Post,
+		{AuthLevel: 2, Method: http.MethodGet, Path: "/dash/api/domains/metadata"}:      api_domains_metadata.Get,
+		{AuthLevel: 2, Method: http.MethodPost, Path: "/dash/api/domains/metadata"}:     api_domains_metadata.Post,
+		{AuthLevel: 2, Method: http.MethodGet, Path: "/dash/api/domains/renewals"}:      api_domains_renewals.Get,
+		{AuthLevel: 2, Method: http.MethodGet, Path: "/dash/api/domains/querycap"}:      api_domains_querycap.Get,
+		{AuthLevel: 2, Method: http.MethodPost, Path: "/dash/api/domains/querycap"}:     api_domains_querycap.Post,
+		{AuthLevel: 2, Method: http.MethodGet, Path: "/dash/api/domains/querylog"}:      api_domains_querylog.Get,
+		{AuthLevel: 2, Method: http.MethodPost, Path: "/dash/api/domains/querylog"}:     api_domains_querylog.Post,
+		{AuthLevel: 2, Method: http.MethodGet, Path: "/dash/api/domains/ratelimits"}:    api_domains_ratelimits.Get,
+		{AuthLevel: 2, Method: http.MethodPost, Path: "/dash/api/domains/ratelimits"}:   api_domains_ratelimits.Post,
+		{AuthLevel: 2, Method: http.MethodGet, Path: "/dash/api/domains/transfer"}:      api_domains_transfer.Get,
+		{AuthLevel: 2, Method: http.MethodPost, Path: "/dash/api/domains/transfer"}:     api_domains_transfer.Post,
+		{AuthLevel: 1, Method: http.MethodGet, Path: "/dash/api/errorpages"}:            api_errorpages.Get,
+		{AuthLevel: 1, Method: http.MethodPost, Path: "/dash/api/errorpages"}:           api_errorpages.Post,
+		{AuthLevel: 1, Method: http.MethodDelete, Path: "/dash/api/errorpages"}:         api_errorpages.Delete,
+		{AuthLevel: 1, Method: http.MethodPost, Path: "/dash/api/errorpages/preview"}:   api_errorpages_preview.Post,
 	}
 
 	assetRoutes := []struct {
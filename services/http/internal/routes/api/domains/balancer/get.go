@@ -0,0 +1,15 @@
+package api_domains_balancer
+
+import (
+	"net/http"
+
+	wired_dns "wired/services/dns"
+	api_domains_setting "wired/services/http/internal/routes/api/domains/setting"
+)
+
+// Get returns the load balancing settings of the protected names of a domain
+func Get(w http.ResponseWriter, r *http.Request) {
+	api_domains_setting.Get(w, r, "balancers", func(domainData *wired_dns.DomainData) map[string]any {
+		return map[string]any{"balancers": domainData.Balancers}
+	})
+}
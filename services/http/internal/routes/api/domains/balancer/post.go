@@ -0,0 +1,28 @@
+package api_domains_balancer
+
+import (
+	"errors"
+	"net/http"
+	"wired/modules/types"
+
+	wired_dns "wired/services/dns"
+	api_domains_setting "wired/services/http/internal/routes/api/domains/setting"
+)
+
+type postBody struct {
+	api_domains_setting.Body
+	Host     string          `json:"host"`
+	Balancer *types.Balancer `json:"balancer"` // null goes back to round robin
+}
+
+// Post sets the load balancing of a protected name
+func Post(w http.ResponseWriter, r *http.Request) {
+	var body postBody
+	api_domains_setting.Post(w, r, &body, 4096, func(user *types.User, domainId string) error {
+		if body.Host == "" {
+			return errors.New("host is required")
+		}
+
+		return wired_dns.SetBalancer(user, domainId, body.Host, body.Balancer)
+	})
+}
@@ -0,0 +1,82 @@
+package api_domains_cache_purge
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+	"wired/modules/env"
+	"wired/modules/event"
+	event_data "wired/modules/event/events"
+	"wired/modules/httpcache"
+
+	wired_dns "wired/services/dns"
+
+	"github.com/miekg/dns"
+)
+
+const maxPurgeItems = 1000
+
+type postBody struct {
+	Domain   string   `json:"domain"`
+	URLs     []string `json:"urls"`
+	Prefixes []string `json:"prefixes"`
+	Tags     []string `json:"tags"`
+}
+
+// Post purges cached responses of a domain on every node by URL, URL prefix or cache tag
+func Post(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body postBody
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Invalid request body"}`))
+		return
+	}
+
+	domain := dns.Fqdn(strings.ToLower(body.Domain))
+	if domain == "." {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Domain is required"}`))
+		return
+	}
+
+	domainData := wired_dns.DomainDataIndexName[domain]
+	if domainData == nil || domainData.Owner != r.Header.Get("Wired-User-Id") {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "Domain not found"}`))
+		return
+	}
+
+	items := len(body.URLs) + len(body.Prefixes) + len(body.Tags)
+	if items == 0 || items > maxPurgeItems {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Between 1 and 1000 urls, prefixes or tags are required"}`))
+		return
+	}
+
+	for _, url := range append(append([]string{}, body.URLs...), body.Prefixes...) {
+		host, _, _ := strings.Cut(httpcache.NormalizeURL(url), "/")
+		if wired_dns.FindApex(host+".") != domain {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "URL does not belong to the domain"}`))
+			return
+		}
+	}
+
+	event.NewEventBus("http").Pub(event.Event{
+		Type:    event.Event_CachePurge,
+		FiredAt: time.Now(),
+		FiredBy: env.GetEnv("NODE_KEY", "node-key"),
+		Data: event_data.CachePurgeData{
+			Domain:   domain,
+			URLs:     body.URLs,
+			Prefixes: body.Prefixes,
+			Tags:     body.Tags,
+		},
+	})
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"success": true}`))
+}
@@ -0,0 +1,20 @@
+package api_domains_compression
+
+import (
+	"net/http"
+	"wired/modules/types"
+
+	wired_dns "wired/services/dns"
+	api_domains_setting "wired/services/http/internal/routes/api/domains/setting"
+)
+
+// Get returns the response compression settings of a domain
+func Get(w http.ResponseWriter, r *http.Request) {
+	api_domains_setting.Get(w, r, "compression", func(domainData *wired_dns.DomainData) map[string]any {
+		return map[string]any{
+			"compression": domainData.Compression,
+			"encodings":   types.Encodings,
+			"minSize":     types.DefaultCompressionMinSize,
+		}
+	})
+}
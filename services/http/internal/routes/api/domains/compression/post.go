@@ -0,0 +1,22 @@
+package api_domains_compression
+
+import (
+	"net/http"
+	"wired/modules/types"
+
+	wired_dns "wired/services/dns"
+	api_domains_setting "wired/services/http/internal/routes/api/domains/setting"
+)
+
+type postBody struct {
+	api_domains_setting.Body
+	Compression *types.Compression `json:"compression"` // null turns compression off
+}
+
+// Post sets the response compression settings of a domain
+func Post(w http.ResponseWriter, r *http.Request) {
+	var body postBody
+	api_domains_setting.Post(w, r, &body, 4096, func(user *types.User, domainId string) error {
+		return wired_dns.SetCompression(user, domainId, body.Compression)
+	})
+}
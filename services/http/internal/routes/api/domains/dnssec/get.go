@@ -0,0 +1,64 @@
+package api_domains_dnssec
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	wired_dns "wired/services/dns"
+
+	"github.com/miekg/dns"
+)
+
+type dnssecInfo struct {
+	Domain     string `json:"domain"`
+	KeyTag     uint16 `json:"key_tag"`
+	Algorithm  uint8  `json:"algorithm"`
+	DigestType uint8  `json:"digest_type"`
+	Digest     string `json:"digest"`
+	DS         string `json:"ds"`
+	DNSKEY     string `json:"dnskey"`
+}
+
+func Get(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	domain := dns.Fqdn(strings.ToLower(r.URL.Query().Get("domain")))
+	if domain == "." {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Domain is required"}`))
+		return
+	}
+
+	domainData := wired_dns.DomainDataIndexName[domain]
+	if domainData == nil || domainData.Owner != r.Header.Get("Wired-User-Id") {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "Domain not found"}`))
+		return
+	}
+
+	keys, err := wired_dns.GetZoneKeys(domain)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "Failed to load DNSSEC keys", "details": "` + err.Error() + `"}`))
+		return
+	}
+
+	ds := keys.DS()
+	marshaledInfo, err := json.Marshal(dnssecInfo{
+		Domain:     strings.TrimSuffix(domain, "."),
+		KeyTag:     ds.KeyTag,
+		Algorithm:  ds.Algorithm,
+		DigestType: ds.DigestType,
+		Digest:     strings.ToUpper(ds.Digest),
+		DS:         ds.String(),
+		DNSKEY:     keys.KSK.String(),
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "Failed to marshal DNSSEC info", "details": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(marshaledInfo)
+}
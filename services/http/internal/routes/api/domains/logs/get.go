@@ -0,0 +1,82 @@
+package api_domains_logs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"wired/modules/postgresql"
+
+	wired_dns "wired/services/dns"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+// Get returns the newest access logs of a domain, older pages via ?before=<request_time>
+func Get(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	domain := dns.Fqdn(strings.ToLower(r.URL.Query().Get("domain")))
+	if domain == "." {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Domain is required"}`))
+		return
+	}
+
+	domainData := wired_dns.DomainDataIndexName[domain]
+	if domainData == nil || domainData.Owner != r.Header.Get("Wired-User-Id") {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "Domain not found"}`))
+		return
+	}
+
+	limit := defaultLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "Invalid limit"}`))
+			return
+		}
+
+		limit = min(parsed, maxLimit)
+	}
+
+	var before int64
+	if value := r.URL.Query().Get("before"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "Invalid before timestamp"}`))
+			return
+		}
+
+		before = parsed
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	logs, err := postgresql.GetHTTPRequestLogs(ctx, domain, before, limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "Failed to query logs", "details": "` + err.Error() + `"}`))
+		return
+	}
+
+	marshaledLogs, err := json.Marshal(logs)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "Failed to marshal logs", "details": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(marshaledLogs)
+}
@@ -0,0 +1,19 @@
+package api_domains_metadata
+
+import (
+	"net/http"
+	"wired/modules/types"
+
+	wired_dns "wired/services/dns"
+	api_domains_setting "wired/services/http/internal/routes/api/domains/setting"
+)
+
+// Get returns the image metadata settings of a domain
+func Get(w http.ResponseWriter, r *http.Request) {
+	api_domains_setting.Get(w, r, "metadata settings", func(domainData *wired_dns.DomainData) map[string]any {
+		return map[string]any{
+			"metadata": domainData.ImageMetadata,
+			"types":    types.MetadataTypes,
+		}
+	})
+}
@@ -0,0 +1,22 @@
+package api_domains_metadata
+
+import (
+	"net/http"
+	"wired/modules/types"
+
+	wired_dns "wired/services/dns"
+	api_domains_setting "wired/services/http/internal/routes/api/domains/setting"
+)
+
+type postBody struct {
+	api_domains_setting.Body
+	Metadata *types.ImageMetadata `json:"metadata"` // null restores the default
+}
+
+// Post sets the image metadata settings of a domain
+func Post(w http.ResponseWriter, r *http.Request) {
+	var body postBody
+	api_domains_setting.Post(w, r, &body, 4096, func(user *types.User, domainId string) error {
+		return wired_dns.SetImageMetadata(user, domainId, body.Metadata)
+	})
+}
@@ -0,0 +1,15 @@
+package api_domains_querycap
+
+import (
+	"net/http"
+
+	wired_dns "wired/services/dns"
+	api_domains_setting "wired/services/http/internal/routes/api/domains/setting"
+)
+
+// Get returns the queries per second every node answers for a domain, 0 when it is not capped
+func Get(w http.ResponseWriter, r *http.Request) {
+	api_domains_setting.Get(w, r, "query cap", func(domainData *wired_dns.DomainData) map[string]any {
+		return map[string]any{"query_cap": domainData.QueryCap}
+	})
+}
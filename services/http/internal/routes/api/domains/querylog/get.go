@@ -0,0 +1,15 @@
+package api_domains_querylog
+
+import (
+	"net/http"
+
+	wired_dns "wired/services/dns"
+	api_domains_setting "wired/services/http/internal/routes/api/domains/setting"
+)
+
+// Get returns the query log sampling of a domain, null when every query is logged
+func Get(w http.ResponseWriter, r *http.Request) {
+	api_domains_setting.Get(w, r, "query log settings", func(domainData *wired_dns.DomainData) map[string]any {
+		return map[string]any{"query_log": domainData.QueryLog}
+	})
+}
@@ -0,0 +1,22 @@
+package api_domains_querylog
+
+import (
+	"net/http"
+	"wired/modules/types"
+
+	wired_dns "wired/services/dns"
+	api_domains_setting "wired/services/http/internal/routes/api/domains/setting"
+)
+
+type postBody struct {
+	api_domains_setting.Body
+	QueryLog *wired_dns.QueryLogConfig `json:"query_log"` // null logs every query
+}
+
+// Post sets the query log sampling or opt-out of a domain
+func Post(w http.ResponseWriter, r *http.Request) {
+	var body postBody
+	api_domains_setting.Post(w, r, &body, 4096, func(user *types.User, domainId string) error {
+		return wired_dns.SetQueryLogConfig(user, domainId, body.QueryLog)
+	})
+}
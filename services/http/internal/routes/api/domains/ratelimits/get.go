@@ -0,0 +1,15 @@
+package api_domains_ratelimits
+
+import (
+	"net/http"
+
+	wired_dns "wired/services/dns"
+	api_domains_setting "wired/services/http/internal/routes/api/domains/setting"
+)
+
+// Get returns the reverse proxy rate limits of a domain
+func Get(w http.ResponseWriter, r *http.Request) {
+	api_domains_setting.Get(w, r, "rate limits", func(domainData *wired_dns.DomainData) map[string]any {
+		return map[string]any{"rate_limits": domainData.RateLimits}
+	})
+}
@@ -0,0 +1,22 @@
+package api_domains_ratelimits
+
+import (
+	"net/http"
+	"wired/modules/types"
+
+	wired_dns "wired/services/dns"
+	api_domains_setting "wired/services/http/internal/routes/api/domains/setting"
+)
+
+type postBody struct {
+	api_domains_setting.Body
+	RateLimits []types.RateLimit `json:"rate_limits"` // empty removes every limit
+}
+
+// Post replaces the reverse proxy rate limits of a domain
+func Post(w http.ResponseWriter, r *http.Request) {
+	var body postBody
+	api_domains_setting.Post(w, r, &body, 16384, func(user *types.User, domainId string) error {
+		return wired_dns.SetRateLimits(user, domainId, body.RateLimits)
+	})
+}
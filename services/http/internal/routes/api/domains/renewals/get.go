@@ -0,0 +1,65 @@
+package api_domains_renewals
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"wired/modules/certstore"
+
+	wired_dns "wired/services/dns"
+
+	"github.com/miekg/dns"
+)
+
+// Get returns the upcoming and failed certificate renewals of a domain
+func Get(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	domain := dns.Fqdn(strings.ToLower(r.URL.Query().Get("domain")))
+	if domain == "." {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Domain is required"}`))
+		return
+	}
+
+	domainData := wired_dns.DomainDataIndexName[domain]
+	if domainData == nil || domainData.Owner != r.Header.Get("Wired-User-Id") {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "Domain not found"}`))
+		return
+	}
+
+	// certificates are shared between domains, only the names of this one are shown
+	zone := strings.TrimSuffix(domain, ".")
+	inZone := func(name string) bool {
+		return name == zone || strings.HasSuffix(name, "."+zone)
+	}
+
+	upcoming, failed := []certstore.Renewal{}, []certstore.Renewal{}
+	for _, renewal := range certstore.Renewals() {
+		if !slices.ContainsFunc(renewal.Names, inZone) {
+			continue
+		}
+
+		renewal.Names = slices.DeleteFunc(slices.Clone(renewal.Names), func(name string) bool { return !inZone(name) })
+		if renewal.Failed() {
+			failed = append(failed, renewal)
+		} else if !renewal.Unused {
+			upcoming = append(upcoming, renewal)
+		}
+	}
+
+	marshaledRenewals, err := json.Marshal(map[string]any{
+		"domain":   domain,
+		"upcoming": upcoming,
+		"failed":   failed,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "Failed to marshal renewals", "details": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(marshaledRenewals)
+}
@@ -0,0 +1,100 @@
+package api_domains_setting
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"wired/modules/types"
+
+	wired_dns "wired/services/dns"
+
+	"github.com/miekg/dns"
+)
+
+/*
+	Domain setting routes
+
+	Every setting of a domain is read and written the same way, the routes
+	only pick their fields and setter. Bodies embed Body for the domain.
+*/
+
+// Body is the part every setting request shares
+type Body struct {
+	Domain string `json:"domain"`
+}
+
+func (body *Body) domainName() string {
+	return body.Domain
+}
+
+type settingBody interface {
+	domainName() string
+}
+
+// Get answers with the fields of a domain owned by the user, name describes the setting in errors
+func Get(w http.ResponseWriter, r *http.Request, name string, fields func(domainData *wired_dns.DomainData) map[string]any) {
+	w.Header().Set("Content-Type", "application/json")
+	domain := dns.Fqdn(strings.ToLower(r.URL.Query().Get("domain")))
+	domainData := ownedDomain(w, r, domain)
+	if domainData == nil {
+		return
+	}
+
+	response := fields(domainData)
+	response["domain"] = domain
+
+	marshaledSetting, err := json.Marshal(response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "Failed to marshal ` + name + `", "details": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(marshaledSetting)
+}
+
+// Post decodes up to limit bytes into body and applies them to a domain owned by the user
+func Post(w http.ResponseWriter, r *http.Request, body settingBody, limit int64, apply func(user *types.User, domainId string) error) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit)).Decode(body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Invalid request body"}`))
+		return
+	}
+
+	domainData := ownedDomain(w, r, dns.Fqdn(strings.ToLower(body.domainName())))
+	if domainData == nil {
+		return
+	}
+
+	user := &types.User{Id: domainData.Owner}
+	if err := apply(user, domainData.Id); err != nil {
+		response, _ := json.Marshal(map[string]string{"error": err.Error()})
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(response)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"success": true}`))
+}
+
+// ownedDomain returns the domain if the user owns it, otherwise it answers the request and returns nil
+func ownedDomain(w http.ResponseWriter, r *http.Request, domain string) *wired_dns.DomainData {
+	if domain == "." {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Domain is required"}`))
+		return nil
+	}
+
+	domainData := wired_dns.DomainDataIndexName[domain]
+	if domainData == nil || domainData.Owner != r.Header.Get("Wired-User-Id") {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "Domain not found"}`))
+		return nil
+	}
+
+	return domainData
+}
@@ -0,0 +1,25 @@
+package api_domains_timeouts
+
+import (
+	"net/http"
+	"wired/modules/types"
+
+	wired_dns "wired/services/dns"
+	api_domains_setting "wired/services/http/internal/routes/api/domains/setting"
+)
+
+// Get returns the reverse proxy timeouts of a domain, as configured and with the profile applied
+func Get(w http.ResponseWriter, r *http.Request) {
+	api_domains_setting.Get(w, r, "timeouts", func(domainData *wired_dns.DomainData) map[string]any {
+		effective := types.TimeoutProfiles[types.TimeoutsDefault]
+		if domainData.Timeouts != nil {
+			effective = domainData.Timeouts.Resolve()
+		}
+
+		return map[string]any{
+			"timeouts":  domainData.Timeouts,
+			"effective": effective,
+			"profiles":  types.TimeoutProfiles,
+		}
+	})
+}
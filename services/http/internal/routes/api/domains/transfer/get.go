@@ -0,0 +1,22 @@
+package api_domains_transfer
+
+import (
+	"net/http"
+
+	wired_dns "wired/services/dns"
+	api_domains_setting "wired/services/http/internal/routes/api/domains/setting"
+)
+
+// Get returns the zone transfer settings of a domain, the TSIG secret is write only
+func Get(w http.ResponseWriter, r *http.Request) {
+	api_domains_setting.Get(w, r, "transfer settings", func(domainData *wired_dns.DomainData) map[string]any {
+		var transfer *wired_dns.TransferConfig
+		if domainData.Transfer != nil {
+			cfg := *domainData.Transfer
+			cfg.TSIGSecret = ""
+			transfer = &cfg
+		}
+
+		return map[string]any{"transfer": transfer}
+	})
+}
@@ -0,0 +1,22 @@
+package api_domains_transfer
+
+import (
+	"net/http"
+	"wired/modules/types"
+
+	wired_dns "wired/services/dns"
+	api_domains_setting "wired/services/http/internal/routes/api/domains/setting"
+)
+
+type postBody struct {
+	api_domains_setting.Body
+	Transfer *wired_dns.TransferConfig `json:"transfer"` // null disables transfers and NOTIFY
+}
+
+// Post sets who may transfer a domain and which secondaries get NOTIFY
+func Post(w http.ResponseWriter, r *http.Request) {
+	var body postBody
+	api_domains_setting.Post(w, r, &body, 16384, func(user *types.User, domainId string) error {
+		return wired_dns.SetTransferConfig(user, domainId, body.Transfer)
+	})
+}
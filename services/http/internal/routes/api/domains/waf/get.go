@@ -0,0 +1,51 @@
+package api_domains_waf
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"wired/modules/postgresql"
+	"wired/modules/types"
+
+	wired_dns "wired/services/dns"
+
+	"github.com/miekg/dns"
+)
+
+// Get returns the firewall rules of a domain
+func Get(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	domain := dns.Fqdn(strings.ToLower(r.URL.Query().Get("domain")))
+	if domain == "." {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Domain is required"}`))
+		return
+	}
+
+	domainData := wired_dns.DomainDataIndexName[domain]
+	if domainData == nil || domainData.Owner != r.Header.Get("Wired-User-Id") {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "Domain not found"}`))
+		return
+	}
+
+	user := &types.User{Id: domainData.Owner}
+	if err := postgresql.GetUser(user); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "Failed to load user", "details": "` + err.Error() + `"}`))
+		return
+	}
+
+	marshaledRules, err := json.Marshal(map[string]string{
+		"domain": domain,
+		"rules":  user.WAFRules[domain],
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "Failed to marshal rules", "details": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(marshaledRules)
+}
@@ -0,0 +1,93 @@
+package api_domains_waf
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"wired/modules/env"
+	"wired/modules/event"
+	event_data "wired/modules/event/events"
+	"wired/modules/postgresql"
+	"wired/modules/waf"
+
+	wired_dns "wired/services/dns"
+
+	"github.com/miekg/dns"
+)
+
+const maxRulesSize = 64 << 10 // 64KB
+
+type postBody struct {
+	Domain string `json:"domain"`
+	Rules  string `json:"rules"`
+}
+
+// Post replaces the firewall rules of a domain, rules that don't parse are rejected with their position
+func Post(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body postBody
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRulesSize)).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Invalid request body"}`))
+		return
+	}
+
+	domain := dns.Fqdn(strings.ToLower(body.Domain))
+	if domain == "." {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Domain is required"}`))
+		return
+	}
+
+	domainData := wired_dns.DomainDataIndexName[domain]
+	if domainData == nil || domainData.Owner != r.Header.Get("Wired-User-Id") {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "Domain not found"}`))
+		return
+	}
+
+	if strings.TrimSpace(body.Rules) != "" {
+		ruleSet, err := waf.Parse(body.Rules)
+		if err != nil {
+			response := map[string]any{"error": err.Error()}
+
+			var parseErr *waf.ParseError
+			if errors.As(err, &parseErr) {
+				response["line"] = parseErr.Line
+				response["column"] = parseErr.Col
+			}
+
+			marshaledError, _ := json.Marshal(response)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(marshaledError)
+			return
+		}
+
+		if ruleSet.UsesChallenge() && env.GetEnv("JWT_SECRET", "") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "Challenge rules need JWT_SECRET to be set"}`))
+			return
+		}
+	} else {
+		body.Rules = ""
+	}
+
+	if err := postgresql.SetWAFRules(domainData.Owner, domain, body.Rules); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "Failed to store rules", "details": "` + err.Error() + `"}`))
+		return
+	}
+
+	event.NewEventBus("http").Pub(event.Event{
+		Type:    event.Event_WAFRulesChanged,
+		FiredAt: time.Now(),
+		FiredBy: env.GetEnv("NODE_KEY", "node-key"),
+		Data:    event_data.WAFRulesChangedData{OwnerId: domainData.Owner, Domain: domain, Rules: body.Rules},
+	})
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"success": true}`))
+}
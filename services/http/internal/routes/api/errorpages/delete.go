@@ -0,0 +1,27 @@
+package api_errorpages
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"wired/modules/pages"
+)
+
+// Delete removes a custom error page, the built-in page is served again
+func Delete(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	code, err := strconv.Atoi(r.URL.Query().Get("code"))
+	if err != nil || !slices.Contains(pages.CustomCodes, code) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Invalid error page code"}`))
+		return
+	}
+
+	if !storePage(w, r.Header.Get("Wired-User-Id"), code, "") {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"success": true}`))
+}
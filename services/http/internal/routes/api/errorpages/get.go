@@ -0,0 +1,34 @@
+package api_errorpages
+
+import (
+	"encoding/json"
+	"net/http"
+	"wired/modules/pages"
+	"wired/modules/postgresql"
+	"wired/modules/types"
+)
+
+// Get returns the custom error pages of the user by code
+func Get(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	user := &types.User{Id: r.Header.Get("Wired-User-Id")}
+	if err := postgresql.GetUser(user); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "Failed to load user", "details": "` + err.Error() + `"}`))
+		return
+	}
+
+	marshaledPages, err := json.Marshal(map[string]any{
+		"pages": user.ErrorPages,
+		"codes": pages.CustomCodes,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "Failed to marshal error pages", "details": "` + err.Error() + `"}`))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(marshaledPages)
+}
@@ -0,0 +1,79 @@
+package api_errorpages
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"wired/modules/env"
+	"wired/modules/event"
+	event_data "wired/modules/event/events"
+	"wired/modules/pages"
+	"wired/modules/postgresql"
+	"wired/modules/types"
+)
+
+const maxPageSize = 64 << 10 // 64KB
+
+type postBody struct {
+	Code int    `json:"code"`
+	Html string `json:"html"`
+}
+
+// Post creates or replaces a custom error page of the user
+func Post(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body postBody
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPageSize+1024)).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Invalid request body"}`))
+		return
+	}
+
+	if !slices.Contains(pages.CustomCodes, body.Code) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "This error page can't be customized"}`))
+		return
+	}
+
+	if strings.TrimSpace(body.Html) == "" || len(body.Html) > maxPageSize {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Html must be between 1 byte and 64KB"}`))
+		return
+	}
+
+	userId := r.Header.Get("Wired-User-Id")
+	if !storePage(w, userId, body.Code, body.Html) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"success": true}`))
+}
+
+// storePage saves a page and tells the other nodes, empty html removes it
+func storePage(w http.ResponseWriter, userId string, code int, html string) bool {
+	// loads the user into the cache the proxy reads pages from
+	if err := postgresql.GetUser(&types.User{Id: userId}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "Failed to load user", "details": "` + err.Error() + `"}`))
+		return false
+	}
+
+	if err := postgresql.SetErrorPage(userId, code, html); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "Failed to store error page", "details": "` + err.Error() + `"}`))
+		return false
+	}
+
+	event.NewEventBus("http").Pub(event.Event{
+		Type:    event.Event_ErrorPageChanged,
+		FiredAt: time.Now(),
+		FiredBy: env.GetEnv("NODE_KEY", "node-key"),
+		Data:    event_data.ErrorPageChangedData{OwnerId: userId, Code: code, Html: html},
+	})
+
+	return true
+}
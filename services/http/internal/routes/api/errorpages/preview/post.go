@@ -0,0 +1,64 @@
+package api_errorpages_preview
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+	"wired/modules/env"
+	"wired/modules/pages"
+)
+
+const maxPageSize = 64 << 10 // 64KB
+
+type postBody struct {
+	Code int    `json:"code"`
+	Html string `json:"html"` // empty previews the built-in page
+}
+
+// Post renders a page with example values without storing it
+func Post(w http.ResponseWriter, r *http.Request) {
+	var body postBody
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPageSize+1024)).Decode(&body); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Invalid request body"}`))
+		return
+	}
+
+	builtin, ok := pages.ErrorPages[body.Code]
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Unknown error page code"}`))
+		return
+	}
+
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+
+	// wired's own codes are sent as gateway timeouts
+	status := body.Code
+	if status == 605 {
+		status = http.StatusGatewayTimeout
+	}
+
+	page := builtin.Html
+	if body.Html != "" {
+		page = pages.RenderCustom(body.Html, pages.Vars{
+			Status:    status,
+			RequestId: r.Header.Get("Wired-Request-Id"),
+			Node:      env.GetEnv("NODE_KEY", "node-key"),
+			ClientIP:  clientIP,
+			Time:      time.Now(),
+		})
+	}
+
+	// the preview runs on the dashboard origin, scripts of the page must not
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusOK)
+	w.Write(page)
+}
@@ -0,0 +1,86 @@
+package http
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"wired/modules/exif"
+	"wired/modules/types"
+	"wired/services/dns"
+)
+
+/*
+	Image metadata stripping
+
+	Proxied images lose their EXIF data unless the domain turned stripping
+	off (DomainData.ImageMetadata), domains can strip XMP, IPTC and comments
+	too. Only full, unencoded responses are cleaned, ranges and origin
+	compressed bodies can't be parsed on their own. Images that fail to
+	parse are sent as the origin returned them.
+*/
+
+var metadataKinds = map[string]exif.Kind{
+	types.MetadataExif:    exif.Exif,
+	types.MetadataXMP:     exif.XMP,
+	types.MetadataIPTC:    exif.IPTC,
+	types.MetadataComment: exif.Comment,
+}
+
+// domainMetadataKinds returns the metadata kinds to strip from images of the domain a host belongs to
+func domainMetadataKinds(host string) exif.Kind {
+	domainData := dns.DomainDataIndexName[dns.FindApex(host+".")]
+	if domainData == nil || domainData.ImageMetadata == nil {
+		return exif.Exif
+	}
+
+	if !domainData.ImageMetadata.Enabled {
+		return 0
+	}
+
+	if len(domainData.ImageMetadata.Strip) == 0 {
+		return exif.All
+	}
+
+	var kinds exif.Kind
+	for _, metadataType := range domainData.ImageMetadata.Strip {
+		kinds |= metadataKinds[metadataType]
+	}
+
+	return kinds
+}
+
+// stripImageMetadata cleans the body of an image response, host is the proxied name
+func stripImageMetadata(host string, resp *http.Response) {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" {
+		return
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if !exif.Supported(contentType) {
+		return
+	}
+
+	kinds := domainMetadataKinds(host)
+	if kinds == 0 {
+		return
+	}
+
+	originalBody := resp.Body
+	pr, pw := io.Pipe()
+	resp.Body = pr
+
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Accept-Ranges")
+	resp.ContentLength = -1
+
+	// the cleaned body isn't byte for byte the one the etag was made for
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+
+	go func() {
+		defer originalBody.Close()
+
+		pw.CloseWithError(exif.Strip(contentType, originalBody, pw, kinds))
+	}()
+}
@@ -0,0 +1,61 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"wired/modules/types"
+)
+
+// originTransport builds the transport to a protected record's origin, https origins
+// are verified against origin.SNI or the record name depending on origin.Verify
+func originTransport(host string, origin types.OriginConfig) (*http.Transport, error) {
+	transport := &http.Transport{
+		MaxIdleConns:          0,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: types.MaxResponseHeaderTimeout * time.Second, // the domain's timeouts cut in earlier
+		DisableKeepAlives:     false,
+		ForceAttemptHTTP2:     true,
+		MaxConnsPerHost:       0,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+	}
+
+	if origin.Scheme != "https" {
+		return transport, nil
+	}
+
+	serverName := origin.SNI
+	if serverName == "" {
+		// wildcard records default to their parent name, "*.example.com" -> "example.com"
+		serverName = strings.TrimPrefix(host, "*.")
+	}
+
+	transport.TLSClientConfig = &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	switch origin.Verify {
+	case types.OriginVerifyOff:
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	case types.OriginVerifyStrict:
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(origin.CA)) {
+			return nil, errors.New("no CA certificate in PEM data")
+		}
+
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	return transport, nil
+}
@@ -0,0 +1,276 @@
+package http
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"wired/modules/env"
+	"wired/modules/event"
+	event_data "wired/modules/event/events"
+	"wired/modules/logger"
+	"wired/modules/types"
+	"wired/services/dns"
+)
+
+/*
+	Reverse proxy rate limiting
+
+	Domains configure token buckets (DomainData.RateLimits) per path prefix, keyed
+	by client ip, ip prefix, header or cookie. Every node keeps its own buckets and
+	publishes how many tokens it took per bucket as Event_RateLimitCounters, other
+	nodes take the same amount from their buckets so limits hold across nodes with
+	a delay of about one exchange interval.
+
+	Header and cookie keys are chosen by the client, so buckets idle for
+	rateLimitIdle are dropped and at most rateLimitMaxBuckets are kept. Once
+	full, new clients are limited by their ip and remote counters for unknown
+	buckets are ignored.
+*/
+
+const (
+	rateLimitSync       = 2 * time.Second
+	rateLimitIdle       = 5 * time.Minute
+	rateLimitMaxCounts  = 10000 // bucket counters per exchange
+	rateLimitMaxBuckets = 100000
+	rateLimitRetryAfter = 1 // seconds, lower bound of Retry-After
+)
+
+type httpBucket struct {
+	tokens float64
+	burst  float64
+	last   time.Time
+	seeded bool // false until the first local request, the burst is unknown before
+}
+
+// take refills the bucket by rate per second up to burst and takes one token
+func (b *httpBucket) take(now time.Time, rate, burst float64) bool {
+	if !b.seeded {
+		// tokens taken on other nodes before the first local request
+		b.tokens += burst
+		b.seeded = true
+	}
+
+	if !b.last.IsZero() {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+
+	b.burst = burst
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// takeRemote subtracts tokens taken on other nodes
+func (b *httpBucket) takeRemote(now time.Time, count uint64) {
+	b.tokens -= float64(count)
+	if b.last.IsZero() {
+		b.last = now
+	}
+
+	if b.seeded {
+		// a node far over the limit shouldn't lock everyone out for long
+		b.tokens = max(b.tokens, -b.burst)
+	}
+}
+
+// retryAfter returns the seconds until the bucket holds a token again
+func (b *httpBucket) retryAfter(rate float64) int {
+	return max(rateLimitRetryAfter, int(math.Ceil((1-b.tokens)/rate)))
+}
+
+var (
+	httpBuckets   = make(map[string]*httpBucket) // domain|prefix|key -> bucket
+	httpCounts    = make(map[string]uint64)      // tokens taken since the last exchange
+	httpBucketsMu sync.Mutex
+)
+
+func init() {
+	countersChan := make(chan event.Event)
+	HTTPEventBus.Sub(event.Event_RateLimitCounters, countersChan, func() { rateLimitCountersEventHandler(countersChan) })
+}
+
+func rateLimitCountersEventHandler(eventChan <-chan event.Event) {
+	for e := range eventChan {
+		if e.FiredBy == env.GetEnv("NODE_KEY", "node-key") {
+			continue
+		}
+
+		data, ok := event.DecodeData[event_data.RateLimitCountersData](e)
+		if !ok {
+			logger.Println("Invalid event data for RateLimitCounters")
+			continue
+		}
+
+		now := time.Now()
+		httpBucketsMu.Lock()
+		for key, count := range data.Counts {
+			bucket, ok := httpBuckets[key]
+			if !ok {
+				if len(httpBuckets) >= rateLimitMaxBuckets {
+					continue
+				}
+
+				bucket = &httpBucket{}
+				httpBuckets[key] = bucket
+			}
+
+			bucket.takeRemote(now, count)
+		}
+		httpBucketsMu.Unlock()
+	}
+}
+
+// matchRateLimit returns the limit with the longest path prefix matching path
+func matchRateLimit(limits []types.RateLimit, path string) (types.RateLimit, bool) {
+	var (
+		match types.RateLimit
+		found bool
+	)
+
+	for _, limit := range limits {
+		if !strings.HasPrefix(path, limit.PathPrefix) {
+			continue
+		}
+
+		if !found || len(limit.PathPrefix) > len(match.PathPrefix) {
+			match, found = limit, true
+		}
+	}
+
+	return match, found
+}
+
+// rateLimitKey identifies the client for a limit, clients without the header or cookie fall back to their ip
+func rateLimitKey(limit types.RateLimit, r *http.Request) string {
+	kind, name, _ := strings.Cut(limit.Key, ":")
+	switch kind {
+	case "prefix":
+		ip := net.ParseIP(clientIP(r))
+		if ip == nil {
+			break
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			return "prefix:" + ip4.Mask(net.CIDRMask(24, 32)).String()
+		}
+
+		return "prefix:" + ip.Mask(net.CIDRMask(56, 128)).String()
+	case "header":
+		if value := r.Header.Get(name); value != "" {
+			return "header:" + value
+		}
+	case "cookie":
+		if cookie, err := r.Cookie(name); err == nil && cookie.Value != "" {
+			return "cookie:" + cookie.Value
+		}
+	}
+
+	return "ip:" + clientIP(r)
+}
+
+// applyRateLimit takes a token for the request, it returns false when the request was answered with 429
+func applyRateLimit(w http.ResponseWriter, r *http.Request) bool {
+	domain := dns.FindApex(requestHost(r) + ".")
+	domainData := dns.DomainDataIndexName[domain]
+	if domainData == nil || len(domainData.RateLimits) == 0 {
+		return true
+	}
+
+	limit, ok := matchRateLimit(domainData.RateLimits, r.URL.Path)
+	if !ok {
+		return true
+	}
+
+	burst := float64(limit.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, limit.Rate)
+	}
+
+	prefix := domain + "|" + limit.PathPrefix + "|"
+	key := prefix + rateLimitKey(limit, r)
+
+	httpBucketsMu.Lock()
+	bucket, ok := httpBuckets[key]
+	if !ok && len(httpBuckets) >= rateLimitMaxBuckets {
+		key = prefix + "ip:" + clientIP(r)
+		bucket, ok = httpBuckets[key]
+	}
+
+	if !ok {
+		bucket = &httpBucket{}
+		httpBuckets[key] = bucket
+	}
+
+	allowed := bucket.take(time.Now(), limit.Rate, burst)
+	retryAfter := bucket.retryAfter(limit.Rate)
+	if allowed {
+		httpCounts[key]++
+	}
+	httpBucketsMu.Unlock()
+
+	if allowed {
+		return true
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeErrorPage(w, r, requestHost(r), http.StatusTooManyRequests, 429)
+	return false
+}
+
+// startRateLimitSync publishes the local counters and drops idle buckets
+func startRateLimitSync(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitSync)
+	defer ticker.Stop()
+
+	node := env.GetEnv("NODE_KEY", "node-key")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			httpBucketsMu.Lock()
+			counts := make(map[string]uint64, min(len(httpCounts), rateLimitMaxCounts))
+			for key, count := range httpCounts {
+				if len(counts) >= rateLimitMaxCounts {
+					break
+				}
+
+				counts[key] = count
+			}
+			httpCounts = make(map[string]uint64)
+
+			pruneHTTPBuckets(now)
+			httpBucketsMu.Unlock()
+
+			if len(counts) == 0 {
+				continue
+			}
+
+			HTTPEventBus.Pub(event.Event{
+				Type:    event.Event_RateLimitCounters,
+				FiredAt: now,
+				FiredBy: node,
+				Data:    event_data.RateLimitCountersData{Node: node, Counts: counts},
+			})
+		}
+	}
+}
+
+// pruneHTTPBuckets drops idle buckets and the ones of domains without limits, httpBucketsMu must be held
+func pruneHTTPBuckets(now time.Time) {
+	for key, bucket := range httpBuckets {
+		domain, _, _ := strings.Cut(key, "|")
+		if domainData := dns.DomainDataIndexName[domain]; domainData == nil || len(domainData.RateLimits) == 0 || now.Sub(bucket.last) > rateLimitIdle {
+			delete(httpBuckets, key)
+		}
+	}
+}
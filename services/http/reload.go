@@ -0,0 +1,393 @@
+package http
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"wired/modules/event"
+	"wired/modules/logger"
+	"wired/modules/types"
+	"wired/services/dns"
+)
+
+/*
+	Hot reload of proxied hosts
+
+	Record changes on the dns event bus resync protectedHosts, proxyMap and
+	CertMap with the zone data. Resyncs are delayed a little since replicated
+	records reach the zone data after their event, and run periodically to catch
+	anything missed. Hosts without a certificate are served with a self-signed
+	placeholder until CertificateNeeded got them one.
+
+	Names have an RSA and an ECDSA certificate, the ECDSA one is stored next to
+	the RSA one as <name>.ecdsa.crt/.key.
+*/
+
+const (
+	reloadDelay         = time.Second
+	reloadInterval      = time.Minute
+	placeholderLifetime = 7 * 24 * time.Hour
+)
+
+var (
+	sanCerts      = make(map[string]*tls.Certificate) // dns name -> RSA SAN certificate, guarded by CertMapLock
+	sanECDSACerts = make(map[string]*tls.Certificate) // dns name -> ECDSA SAN certificate, guarded by CertMapLock
+	reloadChan    = make(chan struct{}, 1)
+
+	// CertificateNeeded schedules the issuance for a host served with a placeholder, set by modules/ssl
+	CertificateNeeded func(host string)
+)
+
+func init() {
+	addChan := make(chan event.Event)
+	dns.DNSEventBus.Sub(event.Event_AddRecord, addChan, func() { recordEventHandler(addChan) })
+
+	removeChan := make(chan event.Event)
+	dns.DNSEventBus.Sub(event.Event_RemoveRecord, removeChan, func() { recordEventHandler(removeChan) })
+}
+
+// recordEventHandler must not block, events are published with the zone file lock held
+func recordEventHandler(eventChan <-chan event.Event) {
+	for range eventChan {
+		requestReload()
+	}
+}
+
+func requestReload() {
+	select {
+	case reloadChan <- struct{}{}:
+	default:
+	}
+}
+
+func startProxyReloader(ctx context.Context) {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reloadChan:
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(reloadDelay):
+			}
+
+			reloadProxies()
+		case <-ticker.C:
+			reloadProxies()
+		}
+	}
+}
+
+// reloadProxies adds, updates and removes proxies to match the protected records
+func reloadProxies() {
+	hosts := loadProtectedHosts()
+
+	proxyMu.RLock()
+	var added, removed []string
+	for host, backends := range hosts {
+		if current, ok := protectedHosts[host]; !ok || !slices.EqualFunc(current, backends, protectedBackend.equal) {
+			added = append(added, host)
+		}
+	}
+
+	for host := range protectedHosts {
+		if _, ok := hosts[host]; !ok {
+			removed = append(removed, host)
+		}
+	}
+	proxyMu.RUnlock()
+
+	for _, host := range removed {
+		removeProxy(host)
+	}
+
+	for _, host := range added {
+		addProxy(host, hosts[host])
+	}
+
+	reloadPlaceholders()
+}
+
+// addProxy starts proxying a host, replacing its previous proxy
+func addProxy(host string, backends []protectedBackend) {
+	normalizedHost := strings.ToLower(strings.TrimSuffix(host, "."))
+
+	proxy, err := newBalancer(normalizedHost, backends)
+	if err != nil {
+		logger.Printf("Not proxying %s: %v\n", normalizedHost, err)
+	}
+
+	// built before locking, reading the certificate files would stall every handshake
+	fresh := hostCertificate(normalizedHost)
+
+	CertMapLock.Lock()
+	entry, ok := CertMap[normalizedHost]
+	if !ok {
+		entry = fresh
+		CertMap[normalizedHost] = entry
+	}
+	entry.RecordId = backends[0].recordId
+	CertMapLock.Unlock()
+
+	proxyMu.Lock()
+	protectedHosts[host] = backends
+	if proxy != nil {
+		proxyMap[normalizedHost] = proxy
+	} else {
+		delete(proxyMap, normalizedHost)
+	}
+	proxyMu.Unlock()
+
+	if entry.Placeholder {
+		logger.Printf("No certificate for %s, serving a self-signed one until it got issued\n", normalizedHost)
+		if CertificateNeeded != nil {
+			CertificateNeeded(normalizedHost)
+		}
+		return
+	}
+
+	for _, backend := range backends {
+		updateSSLInfo(backend.recordId, entry.Cert)
+	}
+}
+
+func removeProxy(host string) {
+	normalizedHost := strings.ToLower(strings.TrimSuffix(host, "."))
+
+	proxyMu.Lock()
+	delete(protectedHosts, host)
+	delete(proxyMap, normalizedHost)
+	proxyMu.Unlock()
+
+	CertMapLock.Lock()
+	delete(CertMap, normalizedHost)
+	CertMapLock.Unlock()
+}
+
+// ReloadCertificates reads the certificate files again and swaps in new and renewed certificates
+func ReloadCertificates() {
+	loadSANCertificates()
+	reloadEntries(true)
+}
+
+func reloadPlaceholders() {
+	reloadEntries(false)
+}
+
+// reloadEntries replaces placeholders with issued certificates, all also swaps issued ones for their renewals
+func reloadEntries(all bool) {
+	type issued struct {
+		recordId string
+		cert     *tls.Certificate
+	}
+
+	// the certificates are read without the lock, handshakes go on meanwhile
+	CertMapLock.RLock()
+	hosts := make([]string, 0, len(CertMap))
+	for host, entry := range CertMap {
+		if entry.Placeholder || all {
+			hosts = append(hosts, host)
+		}
+	}
+	CertMapLock.RUnlock()
+
+	type loaded struct {
+		cert      *tls.Certificate
+		ecdsaCert *tls.Certificate
+	}
+
+	certs := make(map[string]loaded, len(hosts))
+	for _, host := range hosts {
+		if cert, ecdsaCert := loadCertificate(host); cert != nil {
+			certs[host] = loaded{cert, ecdsaCert}
+		}
+	}
+
+	var replaced []issued
+	CertMapLock.Lock()
+	for host, c := range certs {
+		// removed or issued meanwhile
+		entry := CertMap[host]
+		if entry == nil || (!entry.Placeholder && !all) || (c.cert == entry.Cert && c.ecdsaCert == entry.ECDSACert) {
+			continue
+		}
+
+		if entry.Placeholder {
+			logger.Printf("Replaced the placeholder certificate of %s\n", host)
+		}
+
+		entry.Cert, entry.ECDSACert, entry.Placeholder = c.cert, c.ecdsaCert, false
+		replaced = append(replaced, issued{entry.RecordId, c.cert})
+	}
+	CertMapLock.Unlock()
+
+	for _, r := range replaced {
+		updateSSLInfo(r.recordId, r.cert)
+	}
+}
+
+// loadSANCertificates indexes the SAN certificates in certs/ by their dns names
+func loadSANCertificates() {
+	certs := make(map[string]*tls.Certificate)
+	ecdsaCerts := make(map[string]*tls.Certificate)
+	var all []tls.Certificate
+
+	sanFiles, _ := filepath.Glob("certs/san_*.crt")
+	for _, certFile := range sanFiles {
+		base := strings.TrimSuffix(filepath.Base(certFile), ".crt")
+		keyFile := filepath.Join("certs", base+".key")
+
+		cert, err := loadKeyPair(certFile, keyFile)
+		if err != nil {
+			logger.Printf("Error loading SAN certificate %s: %v\n", base, err)
+			continue
+		}
+
+		index := certs
+		if _, ok := cert.PrivateKey.(*ecdsa.PrivateKey); ok {
+			index = ecdsaCerts
+		}
+
+		if cert.Leaf != nil {
+			for _, dnsName := range cert.Leaf.DNSNames {
+				// names in several bundles are served from the newest
+				name := strings.ToLower(dnsName)
+				if current, ok := index[name]; !ok || current.Leaf.NotBefore.Before(cert.Leaf.NotBefore) {
+					index[name] = cert
+				}
+			}
+		}
+
+		all = append(all, *cert)
+	}
+
+	CertMapLock.Lock()
+	sanCerts = certs
+	sanECDSACerts = ecdsaCerts
+	tlsConfig.Certificates = all
+	CertMapLock.Unlock()
+}
+
+func loadKeyPair(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if cert.Leaf == nil && len(cert.Certificate) > 0 {
+		cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+
+	return &cert, nil
+}
+
+// loadCertificate returns the SAN or single certificates of a host, RSA first, nil when there is none.
+// Single certificates are read from disk, CertMapLock must not be held.
+func loadCertificate(host string) (*tls.Certificate, *tls.Certificate) {
+	CertMapLock.RLock()
+	cert, ecdsaCert := sanCerts[host], sanECDSACerts[host]
+	CertMapLock.RUnlock()
+
+	if cert == nil && ecdsaCert == nil {
+		cert, _ = loadKeyPair(fmt.Sprintf("certs/%s.crt", host), fmt.Sprintf("certs/%s.key", host))
+		ecdsaCert, _ = loadKeyPair(fmt.Sprintf("certs/%s.ecdsa.crt", host), fmt.Sprintf("certs/%s.ecdsa.key", host))
+	}
+
+	// names only issued with ECDSA serve it to everyone
+	if cert == nil {
+		return ecdsaCert, nil
+	}
+
+	return cert, ecdsaCert
+}
+
+// HasCertificate reports whether an issued certificate for the host is in certs/
+func HasCertificate(host string) bool {
+	cert, _ := loadCertificate(host)
+	return cert != nil
+}
+
+// Serves reports whether the host is proxied
+func Serves(host string) bool {
+	CertMapLock.RLock()
+	defer CertMapLock.RUnlock()
+
+	return CertMap[host] != nil
+}
+
+// hostCertificate returns the entry for a newly proxied host, CertMapLock must not be held
+func hostCertificate(host string) *SSLEntry {
+	if cert, ecdsaCert := loadCertificate(host); cert != nil {
+		return &SSLEntry{Cert: cert, ECDSACert: ecdsaCert}
+	}
+
+	cert, err := placeholderCertificate(host)
+	if err != nil {
+		// the handshake fails for this host only
+		logger.Printf("Failed to create a placeholder certificate for %s: %v\n", host, err)
+		cert = &tls.Certificate{}
+	}
+
+	return &SSLEntry{Cert: cert, Placeholder: true}
+}
+
+func placeholderCertificate(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(placeholderLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// updateSSLInfo stores the validity of a certificate in the record it was issued for
+func updateSSLInfo(recordId string, cert *tls.Certificate) {
+	if cert.Leaf == nil {
+		return
+	}
+
+	err := dns.UpdateRecordSSLInfo(recordId, types.SSLInfo{IssuedAt: cert.Leaf.NotBefore, ExpiresAt: cert.Leaf.NotAfter})
+	if err != nil {
+		logger.Printf("Failed to store the certificate validity of record %s: %v\n", recordId, err)
+	}
+}
@@ -3,23 +3,18 @@ package http
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"path/filepath"
 	"slices"
 	"strings"
 	"sync"
 	"time"
 	"wired/modules/env"
-	"wired/modules/exif"
 	"wired/modules/logger"
-	"wired/modules/pages"
 	"wired/services/dns"
 	http_internal "wired/services/http/internal"
 
@@ -28,30 +23,36 @@ import (
 )
 
 type SSLEntry struct {
-	RecordId string
-	Cert     *tls.Certificate
+	RecordId    string
+	Cert        *tls.Certificate
+	ECDSACert   *tls.Certificate // preferred for clients supporting it, nil -> Cert only
+	Placeholder bool             // self-signed until a certificate got issued
+}
+
+// certificate picks the ECDSA certificate when the client supports it, the RSA one otherwise
+func (e *SSLEntry) certificate(hello *tls.ClientHelloInfo) *tls.Certificate {
+	if e.ECDSACert != nil && hello.SupportsCertificate(e.ECDSACert) == nil {
+		return e.ECDSACert
+	}
+
+	return e.Cert
 }
 
 var (
 	CertMap            = make(map[string]*SSLEntry)
 	CertMapLock        = &sync.RWMutex{}
-	proxyMap           = make(map[string]*httputil.ReverseProxy)
+	proxyMap           = make(map[string]*balancer) // guarded by proxyMu
+	proxyMu            sync.RWMutex
 	httpRedirectServer *http.Server
 	httpsServer        *http.Server
 	https3Server       *http3.Server
 
 	tlsConfig = &tls.Config{
 		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			host := strings.ToLower(hello.ServerName)
-			if h, _, err := net.SplitHostPort(host); err == nil {
-				host = h
-			}
-
-			if SSLEntry, ok := CertMap[host]; ok {
-				return SSLEntry.Cert, nil
-			}
+			CertMapLock.RLock()
+			defer CertMapLock.RUnlock()
 
-			return nil, fmt.Errorf("no certificate available for %s", host)
+			return certificateFor(hello)
 		},
 		Certificates: []tls.Certificate{},
 		NextProtos: []string{
@@ -62,13 +63,53 @@ var (
 	}
 )
 
+func init() {
+	dns.GetCertificate = dotCertificate
+}
+
+// dotCertificate picks the certificate for DoT, clients connecting by IP get the first SAN certificate
+func dotCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	CertMapLock.RLock()
+	defer CertMapLock.RUnlock()
+
+	cert, err := certificateFor(hello)
+	if err != nil && len(tlsConfig.Certificates) > 0 {
+		return &tlsConfig.Certificates[0], nil
+	}
+
+	return cert, err
+}
+
+// certificateFor looks up the certificate for the server name of a handshake, CertMapLock must be held
+func certificateFor(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.ToLower(hello.ServerName)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if SSLEntry, ok := CertMap[host]; ok {
+		return SSLEntry.certificate(hello), nil
+	}
+
+	if SSLEntry, ok := CertMap[wildcardHost(host)]; ok {
+		return SSLEntry.certificate(hello), nil
+	}
+
+	return nil, fmt.Errorf("no certificate available for %s", host)
+}
+
 func Start(ctx context.Context) {
 	http_internal.PostStart()
-	loadProtectedHosts()
 	initReverseProxies()
+	loadWAFRules()
+	initCache()
+	go startAccessLogger(ctx)
+	go startRateLimitSync(ctx)
+	go startProxyReloader(ctx)
+	go startBalancerHealthChecks(ctx)
 
 	rootHosts := strings.Split(env.GetEnv("ROOT_HOSTS", ""), ",")
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	handler := withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.ProtoMajor < 3 {
 			err := https3Server.SetQUICHeaders(w.Header())
 			if err != nil {
@@ -76,6 +117,11 @@ func Start(ctx context.Context) {
 			}
 		}
 
+		if r.URL.Path == "/dns-query" && slices.Contains(rootHosts, strings.ToLower(r.Host)) {
+			dns.ServeDoH(w, r)
+			return
+		}
+
 		if strings.HasPrefix(r.URL.Path, "/dash") && strings.Split(env.GetEnv("ROOT_HOSTS", ""), ",") != nil {
 			http_internal.HandleWiredRequest(w, r)
 			return
@@ -91,14 +137,35 @@ func Start(ctx context.Context) {
 			host = h
 		}
 
+		proxyMu.RLock()
 		proxy, ok := proxyMap[host]
+		if !ok {
+			proxy, ok = proxyMap[wildcardHost(host)]
+		}
+		proxyMu.RUnlock()
+
 		if !ok {
 			http.Error(w, "Invalid host", http.StatusNotFound)
 			return
 		}
 
+		if !applyRateLimit(w, r) || !applyWAF(w, r) {
+			return
+		}
+
+		markProxied(r)
+		negotiateEncoding(r)
+		w, r, done := applyTimeouts(w, r)
+		defer done()
+
+		// upgrades need the connection, the cache only hands out recorded responses
+		if httpCache != nil && !isUpgrade(r) {
+			httpCache.ServeHTTP(w, r, proxy)
+			return
+		}
+
 		proxy.ServeHTTP(w, r)
-	})
+	}))
 
 	httpsServer = &http.Server{
 		Addr:              "[::]:443",
@@ -182,140 +249,59 @@ func Start(ctx context.Context) {
 }
 
 func initReverseProxies() {
-	sanCerts := make(map[string]*tls.Certificate)
-	sanFiles, _ := filepath.Glob("certs/san_*.crt")
-	for _, certFile := range sanFiles {
-		base := strings.TrimSuffix(filepath.Base(certFile), ".crt")
-		keyFile := filepath.Join("certs", base+".key")
-
-		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-		if err != nil {
-			logger.Printf("Error loading SAN certificate %s: %v", base, err)
-			continue
-		}
-
-		if cert.Leaf == nil && len(cert.Certificate) > 0 {
-			cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
-		}
+	loadSANCertificates()
+	reloadProxies()
+}
 
-		if cert.Leaf != nil {
-			for _, dnsName := range cert.Leaf.DNSNames {
-				sanCerts[strings.ToLower(dnsName)] = &cert
-			}
+// newReverseProxy builds the proxy of a protected host
+func newReverseProxy(host string, backendInfo protectedBackend) (*httputil.ReverseProxy, error) {
+	backendAddr := backendInfo.addr.String()
+	target, _ := url.Parse(fmt.Sprintf("%s://%s", backendInfo.origin.Scheme, backendAddr))
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	if originHost := backendInfo.origin.Host; originHost != "" {
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			req.Host = originHost
 		}
-
-		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
 	}
-
-	for host, backendInfo := range protectedHosts {
-		normalizedHost := strings.ToLower(strings.TrimSuffix(host, "."))
-		var cert *tls.Certificate
-
-		if sanCert, exists := sanCerts[normalizedHost]; exists {
-			cert = sanCert
-		} else {
-			certFile := fmt.Sprintf("certs/%s.crt", normalizedHost)
-			keyFile := fmt.Sprintf("certs/%s.key", normalizedHost)
-			certValue, err := tls.LoadX509KeyPair(certFile, keyFile)
-			cert = &certValue
-			if err != nil {
-				logger.Fatal(fmt.Sprintf("Error loading certificate for %s: %v", normalizedHost, err))
-			}
-		}
-
-		if cert.Leaf == nil && len(cert.Certificate) > 0 {
-			cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
-		}
-
-		CertMap[normalizedHost] = &SSLEntry{
-			RecordId: backendInfo.recordId,
-			Cert:     cert,
+	proxy.ErrorLog = log.New(&errorFilter{}, "", 0)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if originTimedOut(r, err) {
+			logger.Println("Origin timed out: ", err)
+			writeErrorPage(w, r, host, http.StatusGatewayTimeout, 605)
+			return
 		}
 
-		backendAddr := backendInfo.addr.String()
-		target, _ := url.Parse(fmt.Sprintf("http://%s", backendAddr))
-		proxy := httputil.NewSingleHostReverseProxy(target)
-		proxy.ErrorLog = log.New(&errorFilter{}, "", 0)
-		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-			logger.Println("Error in reverse proxy: ", err)
-			w.Header().Set("Content-Type", "text/html")
-			w.WriteHeader(502)
-			w.Write(pages.ErrorPages[502].Html)
+		logger.Println("Error in reverse proxy: ", err)
+		writeErrorPage(w, r, host, http.StatusBadGateway, 502)
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		originResponded(resp)
+		if state := requestState(resp.Request); state != nil {
+			state.originStatus = resp.StatusCode
 		}
-		proxy.ModifyResponse = func(resp *http.Response) error {
-			if resp.Request.Method == http.MethodHead || resp.Body == nil {
-				return nil
-			}
 
-			resp.Header.Set("server", "wired")
-			resp.Header.Set("wired-request-id", "-")
-			resp.Header.Set("wired-http-version", resp.Request.Proto)
-
-			contentType := resp.Header.Get("Content-Type")
-			if contentType != "image/jpeg" && contentType != "image/png" {
-				return nil
-			}
-
-			originalBody := resp.Body
-			pr, pw := io.Pipe()
-			resp.Body = pr
-
-			resp.Header.Del("Content-Length")
-			resp.Header.Del("Content-Encoding")
-			resp.ContentLength = -1
-
-			go func() {
-				defer pw.Close()
-
-				switch {
-				case strings.HasPrefix(contentType, "image/jpeg"):
-					err := exif.CleanJPEG(originalBody, pw)
-					if err != nil {
-						pw.CloseWithError(err)
-					}
-				case strings.HasPrefix(contentType, "image/png"):
-					err := exif.CleanPNG(originalBody, pw)
-					if err != nil {
-						pw.CloseWithError(err)
-					}
-				default:
-					io.Copy(pw, originalBody)
-				}
-			}()
+		// the request id is set by withAccessLog, origins can't override it
+		resp.Header.Del(requestIdHeader)
 
+		if resp.Request.Method == http.MethodHead || resp.Body == nil {
 			return nil
 		}
-		proxy.Transport = &http.Transport{
-			MaxIdleConns:          0,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-			ResponseHeaderTimeout: 5 * time.Second,
-			DisableKeepAlives:     false,
-			ForceAttemptHTTP2:     true,
-			MaxConnsPerHost:       0,
-			DialContext: (&net.Dialer{
-				Timeout:   5 * time.Second,
-				KeepAlive: 30 * time.Second,
-				DualStack: true,
-			}).DialContext,
-		}
 
-		proxyMap[normalizedHost] = proxy
-
-		indexedRecord := dns.ZoneIndexId[backendInfo.recordId]
-		if indexedRecord == nil {
-			logger.Println("Record not found for host: ", host)
-			continue
-		}
+		resp.Header.Set("server", "wired")
+		resp.Header.Set("wired-http-version", resp.Request.Proto)
 
-		mutex, ok := dns.ZoneFileMutexes[indexedRecord.Domain]
-		if ok {
-			mutex.Lock()
-			defer mutex.Unlock()
-		}
+		stripImageMetadata(host, resp)
+		compressResponse(host, resp)
+		return nil
+	}
 
-		indexedRecord.Record.Metadata.SSLInfo.IssuedAt = cert.Leaf.NotBefore
-		indexedRecord.Record.Metadata.SSLInfo.ExpiresAt = cert.Leaf.NotAfter
+	transport, err := originTransport(host, backendInfo.origin)
+	if err != nil {
+		return nil, err
 	}
+
+	proxy.Transport = transport
+	return proxy, nil
 }
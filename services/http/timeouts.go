@@ -0,0 +1,222 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+	"wired/modules/types"
+	"wired/services/dns"
+)
+
+/*
+	Reverse proxy timeouts
+
+	The server timeouts only hold until a request reaches a protected host, from
+	there the timeout profile of its domain (DomainData.Timeouts) sets the read
+	and write deadlines and limits how long the origin may take. Streamed
+	responses (event streams, unlimited profiles) and upgraded connections aren't
+	bound to a deadline but closed after Idle without traffic. Origins running
+	out of time are answered with the 605 page.
+*/
+
+// errOriginTimeout is the cancel cause of requests whose origin ran out of time
+var errOriginTimeout = errors.New("origin timed out")
+
+type timeoutStateKey struct{}
+
+type timeoutState struct {
+	header   *time.Timer
+	response *time.Timer // nil for unlimited responses
+	writer   *timeoutWriter
+}
+
+// domainTimeouts returns the resolved timeouts of the domain a host belongs to
+func domainTimeouts(host string) types.ProxyTimeouts {
+	if domainData := dns.DomainDataIndexName[dns.FindApex(host+".")]; domainData != nil && domainData.Timeouts != nil {
+		return domainData.Timeouts.Resolve()
+	}
+
+	return types.TimeoutProfiles[types.TimeoutsDefault]
+}
+
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
+
+func isUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// applyTimeouts sets the deadlines of a proxied request, done must be called once the request is answered
+func applyTimeouts(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, func()) {
+	timeouts := domainTimeouts(requestHost(r))
+	now := time.Now()
+	rc := http.NewResponseController(w)
+	tw := &timeoutWriter{ResponseWriter: w, rc: rc, idle: seconds(timeouts.Idle)}
+
+	// not every protocol supports deadlines, the server timeouts stay in place then
+	upgrade := isUpgrade(r)
+	if upgrade {
+		// the connection outlives the request, idleConn watches it after the upgrade
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+	} else {
+		rc.SetReadDeadline(now.Add(seconds(timeouts.Read)))
+		if timeouts.Response > 0 {
+			rc.SetWriteDeadline(now.Add(seconds(timeouts.Response)))
+		} else {
+			tw.streaming.Store(true)
+			tw.extend()
+		}
+	}
+
+	ctx, cancel := context.WithCancelCause(r.Context())
+	state := &timeoutState{writer: tw}
+	state.header = time.AfterFunc(seconds(timeouts.ResponseHeader), func() { cancel(errOriginTimeout) })
+	if timeouts.Response > 0 && !upgrade {
+		state.response = time.AfterFunc(seconds(timeouts.Response), func() { cancel(errOriginTimeout) })
+	}
+
+	done := func() {
+		state.header.Stop()
+		if state.response != nil {
+			state.response.Stop()
+		}
+
+		cancel(nil)
+	}
+
+	return tw, r.WithContext(context.WithValue(ctx, timeoutStateKey{}, state)), done
+}
+
+// originResponded stops the header timer, streamed and upgraded responses switch to idle timeouts
+func originResponded(resp *http.Response) {
+	state, _ := resp.Request.Context().Value(timeoutStateKey{}).(*timeoutState)
+	if state == nil {
+		return
+	}
+
+	state.header.Stop()
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode == http.StatusSwitchingProtocols || mediaType == "text/event-stream" {
+		if state.response != nil {
+			state.response.Stop()
+		}
+
+		state.writer.streaming.Store(true)
+		state.writer.extend()
+	}
+
+	if state.writer.streaming.Load() {
+		// the server treats an expired read deadline as the client going away
+		state.writer.rc.SetReadDeadline(time.Time{})
+	}
+}
+
+// originTimedOut reports whether a proxy error came from the origin running out of time
+func originTimedOut(r *http.Request, err error) bool {
+	if errors.Is(context.Cause(r.Context()), errOriginTimeout) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// timeoutWriter pushes the write deadline forward on every write while streaming
+type timeoutWriter struct {
+	http.ResponseWriter
+	rc        *http.ResponseController
+	idle      time.Duration
+	streaming atomic.Bool
+	extended  atomic.Int64 // unix nanoseconds of the last extension
+}
+
+func (w *timeoutWriter) extend() {
+	now := time.Now()
+	// a few deadline updates per idle period are plenty
+	if now.UnixNano()-w.extended.Load() < int64(min(time.Second, w.idle/4)) {
+		return
+	}
+
+	w.extended.Store(now.UnixNano())
+	w.rc.SetWriteDeadline(now.Add(w.idle))
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	if w.streaming.Load() {
+		w.extend()
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timeoutWriter) Flush() {
+	if w.streaming.Load() {
+		w.extend()
+	}
+
+	w.rc.Flush()
+}
+
+func (w *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := w.rc.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := &idleConn{Conn: conn, idle: w.idle}
+	c.touch()
+	return c, brw, nil
+}
+
+func (w *timeoutWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// idleConn closes an upgraded connection after idle without traffic in either direction
+type idleConn struct {
+	net.Conn
+	idle         time.Duration
+	lastActivity atomic.Int64
+}
+
+func (c *idleConn) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(c.idle))
+		n, err := c.Conn.Read(b)
+		if n > 0 {
+			c.touch()
+		}
+
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && n == 0 &&
+			time.Since(time.Unix(0, c.lastActivity.Load())) < c.idle {
+			// the other direction was busy meanwhile
+			continue
+		}
+
+		return n, err
+	}
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.idle))
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.touch()
+	}
+
+	return n, err
+}
@@ -0,0 +1,342 @@
+package http
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"wired/modules/env"
+	"wired/modules/event"
+	event_data "wired/modules/event/events"
+	"wired/modules/geo"
+	"wired/modules/logger"
+	"wired/modules/postgresql"
+	"wired/modules/types"
+	"wired/modules/waf"
+	"wired/services/dns"
+)
+
+/*
+	Web application firewall
+
+	Every domain can have a rule set (see modules/waf), stored with its owner in
+	postgresql. Rule sets are compiled once and replaced when the dashboard changes
+	them, other nodes are told through Event_WAFRulesChanged on the http event bus.
+
+	Challenged clients solve a proof of work puzzle signed for their ip and host
+	and get a clearance cookie once the solution checks out. Puzzles and cookies
+	are signed with JWT_SECRET, rule sets that challenge are refused without it.
+*/
+
+const (
+	wafMaxBody             = 64 << 10 // 64KB
+	wafChallengeTTL        = 24 * time.Hour
+	wafChallengeCookie     = "wired_challenge"
+	wafSolutionCookie      = "wired_challenge_solution"
+	wafPuzzleTTL           = 5 * time.Minute
+	wafChallengeDifficulty = 16 // leading zero bits, about 65k hashes
+)
+
+var (
+	HTTPEventBus = event.NewEventBus("http")
+
+	wafRuleSets = make(map[string]*waf.RuleSet) // apex domain -> rules
+	wafMu       sync.RWMutex
+)
+
+func init() {
+	wafChan := make(chan event.Event)
+	HTTPEventBus.Sub(event.Event_WAFRulesChanged, wafChan, func() { wafRulesChangedEventHandler(wafChan) })
+}
+
+func wafRulesChangedEventHandler(eventChan <-chan event.Event) {
+	for e := range eventChan {
+		data, ok := event.DecodeData[event_data.WAFRulesChangedData](e)
+		if !ok {
+			logger.Println("Invalid event data for WAFRulesChanged")
+			continue
+		}
+
+		if e.FiredBy != env.GetEnv("NODE_KEY", "node-key") {
+			postgresql.CacheWAFRules(data.OwnerId, data.Domain, data.Rules)
+		}
+
+		if err := setWAFRules(data.Domain, data.Rules); err != nil {
+			logger.Printf("Invalid WAF rules for %s: %v\n", data.Domain, err)
+		}
+	}
+}
+
+// loadWAFRules compiles the rule sets of every domain from its owner
+func loadWAFRules() {
+	for domain, domainData := range dns.DomainDataIndexName {
+		owner := &types.User{Id: domainData.Owner}
+		if err := postgresql.GetUser(owner); err != nil {
+			logger.Printf("Failed to load WAF rules for %s: %v\n", domain, err)
+			continue
+		}
+
+		if err := setWAFRules(domain, owner.WAFRules[domain]); err != nil {
+			logger.Printf("Invalid WAF rules for %s: %v\n", domain, err)
+		}
+	}
+}
+
+func setWAFRules(domain, rules string) error {
+	if strings.TrimSpace(rules) == "" {
+		wafMu.Lock()
+		delete(wafRuleSets, domain)
+		wafMu.Unlock()
+		return nil
+	}
+
+	ruleSet, err := waf.Parse(rules)
+	if err != nil {
+		return err
+	}
+
+	if ruleSet.UsesChallenge() && signingSecret() == nil {
+		return errors.New("challenge rules need JWT_SECRET to be set")
+	}
+
+	wafMu.Lock()
+	wafRuleSets[domain] = ruleSet
+	wafMu.Unlock()
+	return nil
+}
+
+// applyWAF evaluates the rules of the requested domain, it returns false when the request was answered
+func applyWAF(w http.ResponseWriter, r *http.Request) bool {
+	host := requestHost(r)
+	domain := dns.FindApex(host + ".")
+
+	wafMu.RLock()
+	ruleSet := wafRuleSets[domain]
+	wafMu.RUnlock()
+
+	if ruleSet == nil {
+		return true
+	}
+
+	req := &waf.Request{
+		Method: r.Method,
+		Host:   host,
+		Path:   r.URL.Path,
+		Query:  r.URL.Query(),
+		Header: r.Header,
+		IP:     net.ParseIP(clientIP(r)),
+	}
+
+	if ruleSet.UsesCountry() {
+		if loc, err := geo.GetLocation(req.IP); err == nil && loc != nil {
+			req.Country = loc.CountryCode
+		}
+	}
+
+	if ruleSet.UsesASN() {
+		if asn, err := geo.GetASN(req.IP); err == nil {
+			req.ASN = asn.Number
+		}
+	}
+
+	if ruleSet.UsesBody() && r.Body != nil && r.Body != http.NoBody {
+		body, err := io.ReadAll(io.LimitReader(r.Body, wafMaxBody))
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return false
+		}
+
+		req.Body = body
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	}
+
+	action, rule := ruleSet.Evaluate(req, func(rule *waf.Rule) {
+		logger.Printf("WAF rule on line %d matched %s %s%s from %s\n", rule.Line, r.Method, host, r.URL.Path, req.IP)
+	})
+
+	switch action {
+	case waf.ActionBlock:
+		logger.Printf("WAF blocked %s %s%s from %s (line %d)\n", r.Method, host, r.URL.Path, req.IP, rule.Line)
+		writeErrorPage(w, r, host, http.StatusForbidden, 403)
+		return false
+	case waf.ActionChallenge:
+		if validChallenge(r, req.IP) {
+			return true
+		}
+
+		if solvedChallenge(r, req.IP) {
+			passChallenge(w, r, req.IP)
+			return true
+		}
+
+		writeChallenge(w, r, req.IP)
+		return false
+	}
+
+	return true
+}
+
+// signingSecret returns the secret signing challenges and sticky cookies, nil when JWT_SECRET is unset
+func signingSecret() []byte {
+	secret := env.GetEnv("JWT_SECRET", "")
+	if secret == "" {
+		return nil
+	}
+
+	return []byte(secret)
+}
+
+// challengeToken binds a solved challenge to the client ip and host until expires
+func challengeToken(secret []byte, ip net.IP, host string, expires int64) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s|%s|%d", ip, host, expires)
+	return strconv.FormatInt(expires, 10) + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func validChallenge(r *http.Request, ip net.IP) bool {
+	secret := signingSecret()
+	if secret == nil {
+		return false
+	}
+
+	cookie, err := r.Cookie(wafChallengeCookie)
+	if err != nil {
+		return false
+	}
+
+	expiresStr, _, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	return hmac.Equal([]byte(cookie.Value), []byte(challengeToken(secret, ip, requestHost(r), expires)))
+}
+
+// powChallenge returns a puzzle for the client ip and host, <expires>.<nonce>.<mac>
+func powChallenge(secret []byte, ip net.IP, host string, expires int64, nonce string) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "pow|%s|%s|%d|%s", ip, host, expires, nonce)
+	return strconv.FormatInt(expires, 10) + "." + nonce + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// solvedChallenge checks the solution cookie, a puzzle we issued to this client and a counter whose
+// sha256(puzzle ":" counter) starts with wafChallengeDifficulty zero bits
+func solvedChallenge(r *http.Request, ip net.IP) bool {
+	secret := signingSecret()
+	if secret == nil {
+		return false
+	}
+
+	cookie, err := r.Cookie(wafSolutionCookie)
+	if err != nil {
+		return false
+	}
+
+	puzzle, counter, ok := strings.Cut(cookie.Value, ":")
+	if !ok || counter == "" || len(counter) > 20 {
+		return false
+	}
+
+	parts := strings.Split(puzzle, ".")
+	if len(parts) != 3 {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	if !hmac.Equal([]byte(puzzle), []byte(powChallenge(secret, ip, requestHost(r), expires, parts[1]))) {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(cookie.Value))
+	return leadingZeroBits(sum[:]) >= wafChallengeDifficulty
+}
+
+func leadingZeroBits(b []byte) int {
+	zeros := 0
+	for _, c := range b {
+		if c != 0 {
+			return zeros + bits.LeadingZeros8(c)
+		}
+
+		zeros += 8
+	}
+
+	return zeros
+}
+
+// passChallenge hands out the clearance cookie for a solved puzzle
+func passChallenge(w http.ResponseWriter, r *http.Request, ip net.IP) {
+	expires := time.Now().Add(wafChallengeTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     wafChallengeCookie,
+		Value:    challengeToken(signingSecret(), ip, requestHost(r), expires.Unix()),
+		Path:     "/",
+		MaxAge:   int(wafChallengeTTL.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.SetCookie(w, &http.Cookie{Name: wafSolutionCookie, Path: "/", MaxAge: -1, Secure: true})
+}
+
+// writeChallenge answers with a page that solves a proof of work puzzle with javascript and reloads
+func writeChallenge(w http.ResponseWriter, r *http.Request, ip net.IP) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	puzzle := powChallenge(signingSecret(), ip, requestHost(r), time.Now().Add(wafPuzzleTTL).Unix(), hex.EncodeToString(nonce))
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Checking your browser</title></head>
+<body>
+<noscript>Please enable JavaScript to continue.</noscript>
+<p>Checking your browser...</p>
+<script>
+(async () => {
+	const puzzle = %q, difficulty = %d, encoder = new TextEncoder();
+	for (let counter = 0; ; counter++) {
+		const hash = new Uint8Array(await crypto.subtle.digest("SHA-256", encoder.encode(puzzle + ":" + counter)));
+		let zeros = 0;
+		for (const b of hash) {
+			if (b !== 0) { zeros += Math.clz32(b) - 24; break; }
+			zeros += 8;
+		}
+
+		if (zeros >= difficulty) {
+			document.cookie = %q + "=" + puzzle + ":" + counter + "; path=/; max-age=%d; secure; samesite=lax";
+			location.reload();
+			return;
+		}
+	}
+})();
+</script>
+</body>
+</html>`, puzzle, wafChallengeDifficulty, wafSolutionCookie, int(wafPuzzleTTL.Seconds()))
+}